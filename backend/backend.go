@@ -2,18 +2,19 @@
 package backend
 
 import (
-	"errors"
+	"github.com/linanh/go-imap"
 )
 
 // ErrInvalidCredentials is returned by Backend.Login when a username or a
-// password is incorrect.
-var ErrInvalidCredentials = errors.New("Invalid credentials")
+// password is incorrect. It has the AUTHENTICATIONFAILED response code.
+var ErrInvalidCredentials error = &imap.StatusError{Code: imap.CodeAuthenticationFailed, Info: "Invalid credentials"}
 
 // Backend is an IMAP server backend. A backend operation always deals with
 // users.
 type Backend interface {
 	// Login authenticates a user. If the username or the password is incorrect,
-	// it returns ErrInvalidCredentials.
+	// it returns ErrInvalidCredentials. The server name requested by the client
+	// with TLS SNI can be retrieved from serverConn with ServerName.
 	Login(serverConn interface{}, username, password string) (User, error)
 	// SupportedExtensions returns the list of extension identifiers that
 	// are understood by the backend. Note that values are not capability names
@@ -45,3 +46,14 @@ type ExtensionOption interface {
 type ExtensionResult interface {
 	ExtResult()
 }
+
+// ServerName returns the server name requested by the client with TLS Server
+// Name Indication, given the connection passed to backend methods such as
+// Backend.Login. It returns an empty string if the client hasn't sent any, or
+// if the connection doesn't provide it.
+func ServerName(serverConn interface{}) string {
+	if c, ok := serverConn.(interface{ Info() *imap.ConnInfo }); ok {
+		return c.Info().ServerName
+	}
+	return ""
+}
@@ -0,0 +1,247 @@
+package backend
+
+import (
+	"context"
+	"time"
+
+	"github.com/linanh/go-imap"
+)
+
+// BackendContext is a Backend supporting context.Context. The server passes
+// a context which is cancelled when the client disconnects or logs out.
+type BackendContext interface {
+	Backend
+
+	// LoginContext is the context-aware variant of Login.
+	LoginContext(ctx context.Context, connInfo interface{}, username, password string) (User, error)
+}
+
+// UserContext is a User supporting context.Context.
+type UserContext interface {
+	User
+
+	// ListMailboxesContext is the context-aware variant of ListMailboxes.
+	ListMailboxesContext(ctx context.Context, subscribed bool) ([]Mailbox, error)
+	// GetMailboxContext is the context-aware variant of GetMailbox.
+	GetMailboxContext(ctx context.Context, name string) (Mailbox, error)
+	// CreateMailboxContext is the context-aware variant of CreateMailbox.
+	CreateMailboxContext(ctx context.Context, name string) error
+	// DeleteMailboxContext is the context-aware variant of DeleteMailbox.
+	DeleteMailboxContext(ctx context.Context, name string) error
+	// RenameMailboxContext is the context-aware variant of RenameMailbox.
+	RenameMailboxContext(ctx context.Context, existingName, newName string) error
+}
+
+// MailboxContext is a Mailbox supporting context.Context. Long operations,
+// such as ListMessagesContext and SearchMessagesContext, should return
+// ctx.Err() as soon as the context is done: the context carries the
+// server's deadline, if any.
+type MailboxContext interface {
+	Mailbox
+
+	// StatusContext is the context-aware variant of Status.
+	StatusContext(ctx context.Context, items []imap.StatusItem, opts []ExtensionOption) (*imap.MailboxStatus, []ExtensionResult, error)
+	// ListMessagesContext is the context-aware variant of ListMessages. ch
+	// must be closed when the function returns, even if ctx is done.
+	ListMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message, opts []ExtensionOption) ([]ExtensionResult, error)
+	// SearchMessagesContext is the context-aware variant of SearchMessages.
+	SearchMessagesContext(ctx context.Context, uid bool, criteria *imap.SearchCriteria, opts []ExtensionOption) ([]uint32, []ExtensionResult, error)
+	// CreateMessageContext is the context-aware variant of CreateMessage.
+	CreateMessageContext(ctx context.Context, flags []string, date time.Time, body imap.Literal, opts []ExtensionOption) ([]ExtensionResult, error)
+	// UpdateMessagesFlagsContext is the context-aware variant of
+	// UpdateMessagesFlags.
+	UpdateMessagesFlagsContext(ctx context.Context, uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string, opts []ExtensionOption) ([]ExtensionResult, error)
+	// CopyMessagesContext is the context-aware variant of CopyMessages.
+	CopyMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, dest string, opts []ExtensionOption) ([]ExtensionResult, error)
+	// ExpungeContext is the context-aware variant of Expunge.
+	ExpungeContext(ctx context.Context, opts []ExtensionOption) ([]ExtensionResult, error)
+}
+
+// BackendWithContext returns be as a BackendContext. If be doesn't implement
+// BackendContext, the context is only checked before calling Login.
+func BackendWithContext(be Backend) BackendContext {
+	if bc, ok := be.(BackendContext); ok {
+		return bc
+	}
+	return backendAdapter{be}
+}
+
+// UserWithContext returns u as a UserContext. If u doesn't implement
+// UserContext, the context is only checked before each call.
+func UserWithContext(u User) UserContext {
+	if uc, ok := u.(UserContext); ok {
+		return uc
+	}
+	return userAdapter{u}
+}
+
+// MailboxWithContext returns mbox as a MailboxContext. If mbox doesn't
+// implement MailboxContext, the context is checked before each call, and
+// ListMessagesContext and SearchMessagesContext return as soon as the context
+// is done, letting the backend operation finish in the background.
+func MailboxWithContext(mbox Mailbox) MailboxContext {
+	if mc, ok := mbox.(MailboxContext); ok {
+		return mc
+	}
+	return mailboxAdapter{mbox}
+}
+
+type backendAdapter struct {
+	Backend
+}
+
+func (be backendAdapter) LoginContext(ctx context.Context, connInfo interface{}, username, password string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return be.Login(connInfo, username, password)
+}
+
+type userAdapter struct {
+	User
+}
+
+func (u userAdapter) ListMailboxesContext(ctx context.Context, subscribed bool) ([]Mailbox, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return u.ListMailboxes(subscribed)
+}
+
+func (u userAdapter) GetMailboxContext(ctx context.Context, name string) (Mailbox, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return u.GetMailbox(name)
+}
+
+func (u userAdapter) CreateMailboxContext(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return u.CreateMailbox(name)
+}
+
+func (u userAdapter) DeleteMailboxContext(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return u.DeleteMailbox(name)
+}
+
+func (u userAdapter) RenameMailboxContext(ctx context.Context, existingName, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return u.RenameMailbox(existingName, newName)
+}
+
+type mailboxAdapter struct {
+	Mailbox
+}
+
+func (mbox mailboxAdapter) StatusContext(ctx context.Context, items []imap.StatusItem, opts []ExtensionOption) (*imap.MailboxStatus, []ExtensionResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return mbox.Status(items, opts)
+}
+
+func (mbox mailboxAdapter) ListMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message, opts []ExtensionOption) ([]ExtensionResult, error) {
+	defer close(ch)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		res []ExtensionResult
+		err error
+	}
+
+	messages := make(chan *imap.Message)
+	done := make(chan result, 1)
+	go func() {
+		res, err := mbox.ListMessages(uid, seqset, items, messages, opts)
+		done <- result{res, err}
+	}()
+
+	// Make sure the backend doesn't block if we stop early
+	drain := func() {
+		go func() {
+			for range messages {
+			}
+		}()
+	}
+
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				r := <-done
+				return r.res, r.err
+			}
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+				drain()
+				return nil, ctx.Err()
+			}
+		case <-ctx.Done():
+			drain()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (mbox mailboxAdapter) SearchMessagesContext(ctx context.Context, uid bool, criteria *imap.SearchCriteria, opts []ExtensionOption) ([]uint32, []ExtensionResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	type result struct {
+		ids []uint32
+		res []ExtensionResult
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		ids, res, err := mbox.SearchMessages(uid, criteria, opts)
+		done <- result{ids, res, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.ids, r.res, r.err
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+func (mbox mailboxAdapter) CreateMessageContext(ctx context.Context, flags []string, date time.Time, body imap.Literal, opts []ExtensionOption) ([]ExtensionResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return mbox.CreateMessage(flags, date, body, opts)
+}
+
+func (mbox mailboxAdapter) UpdateMessagesFlagsContext(ctx context.Context, uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string, opts []ExtensionOption) ([]ExtensionResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return mbox.UpdateMessagesFlags(uid, seqset, operation, flags, opts)
+}
+
+func (mbox mailboxAdapter) CopyMessagesContext(ctx context.Context, uid bool, seqset *imap.SeqSet, dest string, opts []ExtensionOption) ([]ExtensionResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return mbox.CopyMessages(uid, seqset, dest, opts)
+}
+
+func (mbox mailboxAdapter) ExpungeContext(ctx context.Context, opts []ExtensionOption) ([]ExtensionResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return mbox.Expunge(opts)
+}
@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/linanh/go-imap"
+)
+
+// slowMailbox is a Mailbox whose operations never complete until unblocked.
+type slowMailbox struct {
+	Mailbox
+	unblock chan struct{}
+}
+
+func (mbox *slowMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message, opts []ExtensionOption) ([]ExtensionResult, error) {
+	defer close(ch)
+	for i := uint32(1); ; i++ {
+		select {
+		case <-mbox.unblock:
+			return nil, nil
+		default:
+		}
+		ch <- &imap.Message{SeqNum: i}
+	}
+}
+
+func (mbox *slowMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria, opts []ExtensionOption) ([]uint32, []ExtensionResult, error) {
+	<-mbox.unblock
+	return nil, nil, nil
+}
+
+func TestMailboxWithContext_ListMessages(t *testing.T) {
+	mbox := &slowMailbox{unblock: make(chan struct{})}
+	defer close(mbox.unblock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		_, err := MailboxWithContext(mbox).ListMessagesContext(ctx, false, nil, nil, ch, nil)
+		done <- err
+	}()
+
+	if msg := <-ch; msg.SeqNum != 1 {
+		t.Fatalf("Bad first message: %v", msg.SeqNum)
+	}
+	cancel()
+
+	// Stop reading messages: the adapter must not block
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("ListMessagesContext() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListMessagesContext() didn't return after cancellation")
+	}
+
+	// The channel must be closed
+	for range ch {
+	}
+}
+
+func TestMailboxWithContext_SearchMessages(t *testing.T) {
+	mbox := &slowMailbox{unblock: make(chan struct{})}
+	defer close(mbox.unblock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, _, err := MailboxWithContext(mbox).SearchMessagesContext(ctx, false, nil, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("SearchMessagesContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestMailboxWithContext_Implemented(t *testing.T) {
+	var mbox MailboxContext = mailboxAdapter{&slowMailbox{}}
+	if MailboxWithContext(mbox) != mbox {
+		t.Error("MailboxWithContext() wrapped a MailboxContext")
+	}
+}
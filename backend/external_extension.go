@@ -0,0 +1,18 @@
+package backend
+
+import (
+	"crypto/x509"
+)
+
+// ExternalBackend is a Backend that supports authentication with TLS client
+// certificates. Backends implementing this interface get the EXTERNAL SASL
+// mechanism enabled on TLS connections with a verified client certificate.
+type ExternalBackend interface {
+	Backend
+
+	// LoginExternal authenticates the owner of a verified client certificate.
+	// identity is the authorization identity requested by the client: if
+	// empty, the user must be derived from the certificate. connInfo is the
+	// same as for Backend.Login.
+	LoginExternal(connInfo interface{}, cert *x509.Certificate, identity string) (User, error)
+}
@@ -2,7 +2,6 @@
 package memory
 
 import (
-	"errors"
 	"time"
 
 	"github.com/linanh/go-imap/backend"
@@ -18,7 +17,7 @@ func (be *Backend) Login(_ interface{}, username, password string) (backend.User
 		return user, nil
 	}
 
-	return nil, errors.New("Bad username or password")
+	return nil, backend.ErrInvalidCredentials
 }
 
 func (be *Backend) SupportedExtensions() []string {
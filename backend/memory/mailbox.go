@@ -222,6 +222,34 @@ func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string
 	return nil, nil
 }
 
+func (mbox *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, destName string, _ []backend.ExtensionOption) ([]backend.ExtensionResult, error) {
+	dest, ok := mbox.user.mailboxes[destName]
+	if !ok {
+		return nil, backend.ErrNoSuchMailbox
+	}
+
+	var kept []*Message
+	for i, msg := range mbox.Messages {
+		var id uint32
+		if uid {
+			id = msg.Uid
+		} else {
+			id = uint32(i + 1)
+		}
+		if !seqset.Contains(id) {
+			kept = append(kept, msg)
+			continue
+		}
+
+		msgCopy := *msg
+		msgCopy.Uid = dest.uidNext()
+		dest.Messages = append(dest.Messages, &msgCopy)
+	}
+	mbox.Messages = kept
+
+	return nil, nil
+}
+
 func (mbox *Mailbox) Expunge(_ []backend.ExtensionOption) ([]backend.ExtensionResult, error) {
 	for i := len(mbox.Messages) - 1; i >= 0; i-- {
 		msg := mbox.Messages[i]
@@ -1,8 +1,7 @@
 package memory
 
 import (
-	"errors"
-
+	"github.com/linanh/go-imap"
 	"github.com/linanh/go-imap/backend"
 )
 
@@ -30,14 +29,14 @@ func (u *User) ListMailboxes(subscribed bool) (mailboxes []backend.Mailbox, err
 func (u *User) GetMailbox(name string) (mailbox backend.Mailbox, err error) {
 	mailbox, ok := u.mailboxes[name]
 	if !ok {
-		err = errors.New("No such mailbox")
+		err = backend.ErrNoSuchMailbox
 	}
 	return
 }
 
 func (u *User) CreateMailbox(name string) error {
 	if _, ok := u.mailboxes[name]; ok {
-		return errors.New("Mailbox already exists")
+		return backend.ErrMailboxAlreadyExists
 	}
 
 	u.mailboxes[name] = &Mailbox{name: name, user: u}
@@ -46,10 +45,10 @@ func (u *User) CreateMailbox(name string) error {
 
 func (u *User) DeleteMailbox(name string) error {
 	if name == "INBOX" {
-		return errors.New("Cannot delete INBOX")
+		return &imap.StatusError{Code: imap.CodeCannot, Info: "Cannot delete INBOX"}
 	}
 	if _, ok := u.mailboxes[name]; !ok {
-		return errors.New("No such mailbox")
+		return backend.ErrNoSuchMailbox
 	}
 
 	delete(u.mailboxes, name)
@@ -59,7 +58,7 @@ func (u *User) DeleteMailbox(name string) error {
 func (u *User) RenameMailbox(existingName, newName string) error {
 	mbox, ok := u.mailboxes[existingName]
 	if !ok {
-		return errors.New("No such mailbox")
+		return backend.ErrNoSuchMailbox
 	}
 
 	u.mailboxes[newName] = &Mailbox{
@@ -0,0 +1,25 @@
+package backend
+
+import (
+	"github.com/linanh/go-imap"
+)
+
+// MoveMailbox is a Mailbox that is able to move messages atomically to
+// another mailbox. Mailboxes not implementing this interface get MOVE
+// emulated by the server with a COPY, STORE and UID EXPUNGE sequence, which
+// requires UIDPLUS support.
+//
+// See RFC 6851 for details.
+type MoveMailbox interface {
+	Mailbox
+
+	// MoveMessages moves the specified message(s) to the end of the specified
+	// destination mailbox and removes them from this mailbox. The flags and
+	// internal date of the message(s) SHOULD be preserved in the copy.
+	//
+	// If the destination mailbox does not exist, a server must return
+	// ErrNoSuchMailbox.
+	//
+	// Backends that implement UIDPLUS should return a CopyUIDs result.
+	MoveMessages(uid bool, seqset *imap.SeqSet, dest string, opts []ExtensionOption) ([]ExtensionResult, error)
+}
@@ -0,0 +1,18 @@
+package backend
+
+import (
+	"github.com/linanh/go-imap"
+)
+
+// NamespaceUser is a User that exposes its mailbox namespaces. Users not
+// implementing this interface get a single personal namespace with an empty
+// prefix.
+//
+// See RFC 2342 for details.
+type NamespaceUser interface {
+	User
+
+	// Namespaces returns the personal, other users' and shared namespaces
+	// visible to this user. Nil means the namespace type isn't available.
+	Namespaces() (personal, other, shared []imap.NamespaceDescriptor, err error)
+}
@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// SCRAM mechanisms, as defined in RFC 5802 and RFC 7677.
+const (
+	SCRAMSHA1   = "SCRAM-SHA-1"
+	SCRAMSHA256 = "SCRAM-SHA-256"
+)
+
+// SCRAMCredentials are the salted credentials stored for a user, as defined in
+// RFC 5802 section 3. They allow a server to authenticate a user without
+// knowing its cleartext password.
+type SCRAMCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// UserGetter is a Backend that is able to retrieve a user without a password,
+// once the user has been authenticated by other means (e.g. SCRAM).
+type UserGetter interface {
+	Backend
+
+	// GetUser returns the user named username. connInfo is the same as for
+	// Backend.Login.
+	GetUser(connInfo interface{}, username string) (User, error)
+}
+
+// SCRAMBackend is a Backend that supports SCRAM authentication. Backends
+// implementing this interface get the SCRAM-SHA-1 and SCRAM-SHA-256 SASL
+// mechanisms enabled, with their -PLUS variants on TLS connections.
+type SCRAMBackend interface {
+	UserGetter
+
+	// SCRAMCredentials returns the stored credentials of username for the
+	// given mechanism (SCRAMSHA1 or SCRAMSHA256). An error must be returned if
+	// the user doesn't exist or has no credentials for this mechanism.
+	SCRAMCredentials(connInfo interface{}, username, mechanism string) (*SCRAMCredentials, error)
+}
+
+// SCRAMHash returns the hash function used by a SCRAM mechanism, nil if the
+// mechanism is unknown.
+func SCRAMHash(mechanism string) func() hash.Hash {
+	switch mechanism {
+	case SCRAMSHA1:
+		return sha1.New
+	case SCRAMSHA256:
+		return sha256.New
+	}
+	return nil
+}
+
+// NewSCRAMCredentials derives the SCRAM credentials to store for a password.
+func NewSCRAMCredentials(mechanism, password string, salt []byte, iterations int) (*SCRAMCredentials, error) {
+	h := SCRAMHash(mechanism)
+	if h == nil {
+		return nil, errors.New("Unknown SCRAM mechanism")
+	}
+	if iterations < 1 {
+		return nil, errors.New("Invalid SCRAM iteration count")
+	}
+
+	salted := pbkdf2([]byte(password), salt, iterations, h)
+
+	clientKey := scramHMAC(h, salted, "Client Key")
+	storedKey := h()
+	storedKey.Write(clientKey)
+
+	return &SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey.Sum(nil),
+		ServerKey:  scramHMAC(h, salted, "Server Key"),
+	}, nil
+}
+
+func scramHMAC(h func() hash.Hash, key []byte, s string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// pbkdf2 implements Hi() as defined in RFC 5802 section 2.2, which is PBKDF2
+// with an output length equal to the hash size.
+func pbkdf2(password, salt []byte, iterations int, h func() hash.Hash) []byte {
+	mac := hmac.New(h, password)
+
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	mac.Write(salt)
+	mac.Write(block[:])
+	u := mac.Sum(nil)
+
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
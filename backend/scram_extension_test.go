@@ -0,0 +1,36 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"testing"
+)
+
+// Test vector from RFC 5802 section 5.
+func TestNewSCRAMCredentials(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("QSXCR+Q6sek8bf92")
+	creds, err := NewSCRAMCredentials(SCRAMSHA1, "pencil", salt, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authMessage := "n=user,r=fyko+d2lbbFgONRv9qkxdawL," +
+		"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096," +
+		"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j"
+
+	proof, _ := base64.StdEncoding.DecodeString("v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=")
+	clientSignature := scramHMAC(sha1.New, creds.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	if storedKey := sha1.Sum(clientKey); !hmac.Equal(storedKey[:], creds.StoredKey) {
+		t.Error("Invalid stored key")
+	}
+
+	serverSignature := base64.StdEncoding.EncodeToString(scramHMAC(sha1.New, creds.ServerKey, authMessage))
+	if serverSignature != "rmF9pqV8S7suAoZWja4dJRkFsKQ=" {
+		t.Error("Invalid server key, got server signature", serverSignature)
+	}
+}
@@ -0,0 +1,271 @@
+package updatebus
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"sync"
+
+	"github.com/linanh/go-imap/backend"
+)
+
+// maxLineSize is the maximum size of an encoded update.
+const maxLineSize = 1024 * 1024
+
+// DefaultMaxQueuedUpdates is the default maximum number of updates queued by a
+// Hub for a bus.
+const DefaultMaxQueuedUpdates = 1024
+
+// Bus is an update bus connected to a Hub. Updates are encoded as JSON, one
+// per line.
+type Bus struct {
+	conn    net.Conn
+	updates chan backend.Update
+
+	locker sync.Mutex // protects enc and err
+	enc    *json.Encoder
+	err    error
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial connects to a Hub, e.g. Dial("unix", "/run/imap/updates.sock").
+func Dial(network, addr string) (*Bus, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewBus(conn), nil
+}
+
+// NewBus creates an update bus over a connection to a Hub.
+func NewBus(conn net.Conn) *Bus {
+	b := &Bus{
+		conn:    conn,
+		updates: make(chan backend.Update),
+		enc:     json.NewEncoder(conn),
+		closed:  make(chan struct{}),
+	}
+	go b.read()
+	return b
+}
+
+func (b *Bus) read() {
+	scanner := bufio.NewScanner(b.conn)
+	scanner.Buffer(nil, maxLineSize)
+	for scanner.Scan() {
+		var w wireUpdate
+		if err := json.Unmarshal(scanner.Bytes(), &w); err != nil {
+			continue
+		}
+		update, err := decodeUpdate(&w)
+		if err != nil {
+			// Ignore updates from newer versions
+			continue
+		}
+
+		select {
+		case b.updates <- update:
+		case <-b.closed:
+			return
+		}
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = ErrClosed
+	}
+	b.locker.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.locker.Unlock()
+}
+
+// Publish delivers an update locally, then sends it to the hub. The update is
+// delivered locally even if it cannot be sent to the hub. Updates carrying
+// sequence numbers are only delivered locally, since they cannot be relayed:
+// an error is returned in this case, but the bus remains usable.
+func (b *Bus) Publish(update backend.Update) error {
+	select {
+	case b.updates <- update:
+	case <-b.closed:
+		return ErrClosed
+	}
+
+	w, err := encodeUpdate(update)
+	if err != nil {
+		return err
+	}
+
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	if err := b.enc.Encode(w); err != nil {
+		b.err = err
+		return err
+	}
+	return nil
+}
+
+func (b *Bus) Updates() <-chan backend.Update {
+	return b.updates
+}
+
+// Err returns the error which caused the connection to the hub to be lost, if
+// any.
+func (b *Bus) Err() error {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return b.err
+}
+
+func (b *Bus) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		err = b.conn.Close()
+	})
+	return err
+}
+
+// Hub relays updates between buses: each update received from a bus is sent
+// to all other buses. Each bus has its own queue, so that a slow bus doesn't
+// delay the other ones.
+type Hub struct {
+	// The maximum number of updates queued for a bus. A bus falling further
+	// behind is disconnected. If zero, DefaultMaxQueuedUpdates is used.
+	MaxQueuedUpdates int
+
+	locker    sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]*hubConn
+}
+
+// A hubConn is a bus connected to a Hub. A single goroutine writes the updates
+// queued for it.
+type hubConn struct {
+	conn      net.Conn
+	lines     chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *hubConn) write() {
+	for {
+		select {
+		case line := <-c.lines:
+			if _, err := c.conn.Write(line); err != nil {
+				c.close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *hubConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// NewHub creates a new hub.
+func NewHub() *Hub {
+	return &Hub{
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]*hubConn),
+	}
+}
+
+// Serve accepts bus connections on the Listener l.
+func (h *Hub) Serve(l net.Listener) error {
+	h.locker.Lock()
+	h.listeners[l] = struct{}{}
+	h.locker.Unlock()
+
+	defer func() {
+		h.locker.Lock()
+		defer h.locker.Unlock()
+		l.Close()
+		delete(h.listeners, l)
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		max := h.MaxQueuedUpdates
+		if max <= 0 {
+			max = DefaultMaxQueuedUpdates
+		}
+		hc := &hubConn{
+			conn:   conn,
+			lines:  make(chan []byte, max),
+			closed: make(chan struct{}),
+		}
+
+		h.locker.Lock()
+		h.conns[conn] = hc
+		h.locker.Unlock()
+
+		go hc.write()
+		go h.serveConn(hc)
+	}
+}
+
+func (h *Hub) serveConn(hc *hubConn) {
+	conn := hc.conn
+	defer func() {
+		h.locker.Lock()
+		delete(h.conns, conn)
+		h.locker.Unlock()
+		hc.close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, maxLineSize)
+	for scanner.Scan() {
+		line := make([]byte, 0, len(scanner.Bytes())+1)
+		line = append(line, scanner.Bytes()...)
+		h.broadcast(conn, append(line, '\n'))
+	}
+}
+
+func (h *Hub) broadcast(from net.Conn, line []byte) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	for conn, hc := range h.conns {
+		if conn == from {
+			continue
+		}
+		select {
+		case hc.lines <- line:
+		default:
+			// The bus has missed updates: disconnect it, so that it notices
+			hc.close()
+		}
+	}
+}
+
+// Close stops listening and closes all bus connections.
+func (h *Hub) Close() error {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	for l := range h.listeners {
+		l.Close()
+	}
+	for _, hc := range h.conns {
+		hc.close()
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// Package updatebus provides implementations of backend.UpdateBus.
+//
+// NewLocal returns an in-process bus, for a single server instance. Dial
+// connects a server instance to a Hub over TCP or a Unix socket: the hub
+// relays updates published by each instance to all other ones. It is a simple
+// reference implementation: production deployments may prefer a bus based on
+// an existing message broker.
+package updatebus
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/linanh/go-imap/backend"
+)
+
+// ErrClosed is returned by Publish when the bus has been closed.
+var ErrClosed = errors.New("Update bus closed")
+
+type localBus struct {
+	updates   chan backend.Update
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLocal creates an in-process bus.
+func NewLocal() backend.UpdateBus {
+	return &localBus{
+		updates: make(chan backend.Update),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (b *localBus) Publish(update backend.Update) error {
+	select {
+	case b.updates <- update:
+		return nil
+	case <-b.closed:
+		return ErrClosed
+	}
+}
+
+func (b *localBus) Updates() <-chan backend.Update {
+	return b.updates
+}
+
+func (b *localBus) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+	return nil
+}
@@ -0,0 +1,297 @@
+package updatebus
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+)
+
+func receive(t *testing.T, bus backend.UpdateBus) backend.Update {
+	t.Helper()
+
+	select {
+	case update := <-bus.Updates():
+		return update
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an update")
+		return nil
+	}
+}
+
+func TestLocal(t *testing.T) {
+	bus := NewLocal()
+
+	update := &backend.ExpungeUidUpdate{
+		Update: backend.NewUpdate("username", "INBOX"),
+		Uid:    42,
+	}
+	go bus.Publish(update)
+
+	if got := receive(t, bus); got != update {
+		t.Fatalf("Expected the published update, got %v", got)
+	}
+
+	bus.Close()
+	if err := bus.Publish(update); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestHub(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub()
+	go hub.Serve(l)
+	defer hub.Close()
+
+	var buses []*Bus
+	for i := 0; i < 3; i++ {
+		bus, err := Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bus.Close()
+		buses = append(buses, bus)
+	}
+
+	// Wait for all buses to be connected to the hub
+	for {
+		hub.locker.Lock()
+		n := len(hub.conns)
+		hub.locker.Unlock()
+		if n == len(buses) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	update := &backend.ExistsUidUpdate{
+		Update: backend.NewUpdate("username", "INBOX"),
+		Uids:   []uint32{42, 43},
+	}
+	go buses[0].Publish(update)
+
+	if got := receive(t, buses[0]); got != update {
+		t.Fatalf("Expected the published update on the local bus, got %v", got)
+	}
+	for _, bus := range buses[1:] {
+		got, ok := receive(t, bus).(*backend.ExistsUidUpdate)
+		if !ok {
+			t.Fatalf("Expected an ExistsUidUpdate, got %T", got)
+		}
+		if got.Username() != "username" || got.Mailbox() != "INBOX" || !reflect.DeepEqual(got.Uids, update.Uids) {
+			t.Fatalf("Invalid update: %v", got)
+		}
+	}
+}
+
+func TestBus_LocalOnly(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub()
+	go hub.Serve(l)
+	defer hub.Close()
+
+	bus, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+
+	update := &backend.ExpungeUpdate{
+		Update: backend.NewUpdate("username", "INBOX"),
+		SeqNum: 2,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- bus.Publish(update)
+	}()
+	if got := receive(t, bus); got != update {
+		t.Fatalf("Expected the published update on the local bus, got %v", got)
+	}
+	if err := <-errs; err == nil {
+		t.Error("Expected an error for an update which cannot be relayed")
+	}
+
+	// The bus remains usable
+	go bus.Publish(&backend.ExpungeUidUpdate{Update: backend.NewUpdate("username", "INBOX"), Uid: 42})
+	receive(t, bus)
+	if err := bus.Err(); err != nil {
+		t.Fatal("Unexpected bus error:", err)
+	}
+}
+
+func TestHub_SlowBus(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub()
+	hub.MaxQueuedUpdates = 1
+	go hub.Serve(l)
+	defer hub.Close()
+
+	bus, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	go func() {
+		for range bus.Updates() {
+		}
+	}()
+
+	// This bus never reads updates
+	slow, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	waitConns := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			hub.locker.Lock()
+			got := len(hub.conns)
+			hub.locker.Unlock()
+			if got == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %v buses connected to the hub, got %v", n, got)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitConns(2)
+
+	// Publishing doesn't block until the slow bus is disconnected
+	info := strings.Repeat("x", 512*1024)
+	for i := 0; i < 64; i++ {
+		update := &backend.StatusUpdate{
+			Update:     backend.NewUpdate("username", ""),
+			StatusResp: &imap.StatusResp{Type: imap.StatusRespOk, Info: info},
+		}
+		if err := bus.Publish(update); err != nil {
+			t.Fatal("Cannot publish update:", err)
+		}
+	}
+	waitConns(1)
+}
+
+func TestEncodeUpdate(t *testing.T) {
+	status := imap.NewMailboxStatus("INBOX", []imap.StatusItem{imap.StatusMessages})
+	status.Messages = 3
+
+	msg := imap.NewMessage(2, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+	msg.Uid = 7
+	msg.Flags = []string{imap.SeenFlag}
+
+	updates := []backend.Update{
+		&backend.StatusUpdate{
+			Update:     backend.NewUpdate("username", ""),
+			StatusResp: &imap.StatusResp{Type: imap.StatusRespOk, Code: imap.CodeAlert, Info: "Hello"},
+		},
+		&backend.MailboxUpdate{Update: backend.NewUpdate("username", "INBOX"), MailboxStatus: status},
+		&backend.MailboxInfoUpdate{
+			Update:      backend.NewUpdate("username", ""),
+			MailboxInfo: &imap.MailboxInfo{Name: "Archive", Delimiter: "/"},
+		},
+		&backend.MessageUpdate{Update: backend.NewUpdate("username", "INBOX"), Message: msg},
+		&backend.ExpungeUidUpdate{Update: backend.NewUpdate("username", "INBOX"), Uid: 7},
+	}
+
+	for _, update := range updates {
+		w, err := encodeUpdate(update)
+		if err != nil {
+			t.Fatalf("Cannot encode %T: %v", update, err)
+		}
+		got, err := decodeUpdate(w)
+		if err != nil {
+			t.Fatalf("Cannot decode %T: %v", update, err)
+		}
+
+		if reflect.TypeOf(got) != reflect.TypeOf(update) {
+			t.Fatalf("Expected %T, got %T", update, got)
+		}
+		if got.Username() != update.Username() || got.Mailbox() != update.Mailbox() {
+			t.Fatalf("Invalid username or mailbox for %T", update)
+		}
+
+		switch got := got.(type) {
+		case *backend.StatusUpdate:
+			if got.Code != imap.CodeAlert || got.Info != "Hello" {
+				t.Errorf("Invalid status update: %v", got.StatusResp)
+			}
+		case *backend.MailboxUpdate:
+			if _, ok := got.Items[imap.StatusMessages]; !ok || got.Messages != 3 {
+				t.Errorf("Invalid mailbox update: %v", got.MailboxStatus)
+			}
+		case *backend.MailboxInfoUpdate:
+			if got.Name != "Archive" || got.Delimiter != "/" {
+				t.Errorf("Invalid mailbox info update: %v", got.MailboxInfo)
+			}
+		case *backend.MessageUpdate:
+			// Sequence numbers aren't relayed
+			if got.SeqNum != 0 || got.Uid != 7 || !reflect.DeepEqual(got.Flags, msg.Flags) {
+				t.Errorf("Invalid message update: %v", got.Message)
+			}
+		case *backend.ExpungeUidUpdate:
+			if got.Uid != 7 {
+				t.Errorf("Invalid expunge update: %v", got.Uid)
+			}
+		}
+	}
+}
+
+func TestEncodeUpdate_Domain(t *testing.T) {
+	update := backend.WithDomain(&backend.ExpungeUidUpdate{
+		Update: backend.NewUpdate("username", "INBOX"),
+		Uid:    7,
+	}, "example.org")
+
+	w, err := encodeUpdate(update)
+	if err != nil {
+		t.Fatal("Cannot encode update:", err)
+	}
+	got, err := decodeUpdate(w)
+	if err != nil {
+		t.Fatal("Cannot decode update:", err)
+	}
+
+	expunge, ok := got.(*backend.ExpungeUidUpdate)
+	if !ok {
+		t.Fatalf("Expected an ExpungeUidUpdate, got %T", got)
+	}
+	if domain := backend.UpdateDomain(expunge); domain != "example.org" {
+		t.Errorf("Expected domain example.org, got %q", domain)
+	}
+	if expunge.Username() != "username" || expunge.Mailbox() != "INBOX" || expunge.Uid != 7 {
+		t.Errorf("Invalid update: %v", expunge)
+	}
+}
+
+func TestEncodeUpdate_SeqNum(t *testing.T) {
+	updates := []backend.Update{
+		&backend.ExpungeUpdate{Update: backend.NewUpdate("username", "INBOX"), SeqNum: 2},
+		&backend.MessageUpdate{
+			Update:  backend.NewUpdate("username", "INBOX"),
+			Message: imap.NewMessage(2, []imap.FetchItem{imap.FetchFlags}),
+		},
+	}
+
+	for _, update := range updates {
+		if _, err := encodeUpdate(update); err == nil {
+			t.Errorf("Expected %T with a sequence number to be rejected", update)
+		}
+	}
+}
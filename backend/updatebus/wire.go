@@ -0,0 +1,183 @@
+package updatebus
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+)
+
+// wireUpdate is the JSON representation of an update.
+//
+// Only the fields relevant to unilateral updates are transmitted: status
+// response arguments are dropped, and messages only carry their UID and flags.
+//
+// Sequence numbers depend on the state of each server instance, so they are
+// never transmitted: messages are identified by UID, expunges must be reported
+// with backend.ExpungeUidUpdate and new messages with backend.ExistsUidUpdate.
+type wireUpdate struct {
+	Type     string `json:"type"`
+	Username string `json:"username,omitempty"`
+	Mailbox  string `json:"mailbox,omitempty"`
+	// The virtual domain of the update, see backend.WithDomain.
+	Domain string `json:"domain,omitempty"`
+
+	Status        *wireStatusResp    `json:"status,omitempty"`
+	MailboxInfo   *imap.MailboxInfo  `json:"mailbox_info,omitempty"`
+	Message       *wireMessage       `json:"message,omitempty"`
+	MailboxStatus *wireMailboxStatus `json:"mailbox_status,omitempty"`
+	Uid           uint32             `json:"uid,omitempty"`
+	Uids          []uint32           `json:"uids,omitempty"`
+}
+
+type wireStatusResp struct {
+	Type imap.StatusRespType `json:"type"`
+	Code imap.StatusRespCode `json:"code,omitempty"`
+	Info string              `json:"info,omitempty"`
+}
+
+type wireMailboxStatus struct {
+	Name           string            `json:"name"`
+	ReadOnly       bool              `json:"read_only,omitempty"`
+	Items          []imap.StatusItem `json:"items"`
+	Flags          []string          `json:"flags,omitempty"`
+	PermanentFlags []string          `json:"permanent_flags,omitempty"`
+	Messages       uint32            `json:"messages,omitempty"`
+	Recent         uint32            `json:"recent,omitempty"`
+	Unseen         uint32            `json:"unseen,omitempty"`
+	UidNext        uint32            `json:"uid_next,omitempty"`
+	UidValidity    uint32            `json:"uid_validity,omitempty"`
+}
+
+type wireMessage struct {
+	Uid   uint32   `json:"uid"`
+	Flags []string `json:"flags"`
+}
+
+const (
+	typeStatus      = "status"
+	typeMailbox     = "mailbox"
+	typeMailboxInfo = "mailbox_info"
+	typeMessage     = "message"
+	typeExpungeUid  = "expunge_uid"
+	typeExistsUid   = "exists_uid"
+)
+
+func encodeUpdate(update backend.Update) (*wireUpdate, error) {
+	w := &wireUpdate{
+		Username: update.Username(),
+		Mailbox:  update.Mailbox(),
+		Domain:   backend.UpdateDomain(update),
+	}
+
+	switch update := update.(type) {
+	case *backend.StatusUpdate:
+		w.Type = typeStatus
+		w.Status = &wireStatusResp{
+			Type: update.StatusResp.Type,
+			Code: update.StatusResp.Code,
+			Info: update.StatusResp.Info,
+		}
+	case *backend.MailboxUpdate:
+		status := update.MailboxStatus
+		w.Type = typeMailbox
+		w.MailboxStatus = &wireMailboxStatus{
+			Name:           status.Name,
+			ReadOnly:       status.ReadOnly,
+			Flags:          status.Flags,
+			PermanentFlags: status.PermanentFlags,
+			Messages:       status.Messages,
+			Recent:         status.Recent,
+			Unseen:         status.Unseen,
+			UidNext:        status.UidNext,
+			UidValidity:    status.UidValidity,
+		}
+		for item := range status.Items {
+			w.MailboxStatus.Items = append(w.MailboxStatus.Items, item)
+		}
+	case *backend.MailboxInfoUpdate:
+		w.Type = typeMailboxInfo
+		w.MailboxInfo = update.MailboxInfo
+	case *backend.MessageUpdate:
+		if update.Message.Uid == 0 {
+			return nil, errors.New("updatebus: message updates without UID cannot be relayed")
+		}
+		w.Type = typeMessage
+		w.Message = &wireMessage{
+			Uid:   update.Message.Uid,
+			Flags: update.Message.Flags,
+		}
+	case *backend.ExpungeUpdate:
+		return nil, errors.New("updatebus: expunge updates with sequence numbers cannot be relayed, use ExpungeUidUpdate")
+	case *backend.ExpungeUidUpdate:
+		w.Type = typeExpungeUid
+		w.Uid = update.Uid
+	case *backend.ExistsUidUpdate:
+		w.Type = typeExistsUid
+		w.Uids = update.Uids
+	default:
+		return nil, fmt.Errorf("updatebus: unsupported update type %T", update)
+	}
+
+	return w, nil
+}
+
+func decodeUpdate(w *wireUpdate) (backend.Update, error) {
+	update, err := decodeUpdateType(w)
+	if err != nil || w.Domain == "" {
+		return update, err
+	}
+	return backend.WithDomain(update, w.Domain), nil
+}
+
+func decodeUpdateType(w *wireUpdate) (backend.Update, error) {
+	u := backend.NewUpdate(w.Username, w.Mailbox)
+
+	switch w.Type {
+	case typeStatus:
+		if w.Status == nil {
+			break
+		}
+		return &backend.StatusUpdate{Update: u, StatusResp: &imap.StatusResp{
+			Type: w.Status.Type,
+			Code: w.Status.Code,
+			Info: w.Status.Info,
+		}}, nil
+	case typeMailbox:
+		if w.MailboxStatus == nil {
+			break
+		}
+		status := imap.NewMailboxStatus(w.MailboxStatus.Name, w.MailboxStatus.Items)
+		status.ReadOnly = w.MailboxStatus.ReadOnly
+		status.Flags = w.MailboxStatus.Flags
+		status.PermanentFlags = w.MailboxStatus.PermanentFlags
+		status.Messages = w.MailboxStatus.Messages
+		status.Recent = w.MailboxStatus.Recent
+		status.Unseen = w.MailboxStatus.Unseen
+		status.UidNext = w.MailboxStatus.UidNext
+		status.UidValidity = w.MailboxStatus.UidValidity
+		return &backend.MailboxUpdate{Update: u, MailboxStatus: status}, nil
+	case typeMailboxInfo:
+		if w.MailboxInfo == nil {
+			break
+		}
+		return &backend.MailboxInfoUpdate{Update: u, MailboxInfo: w.MailboxInfo}, nil
+	case typeMessage:
+		if w.Message == nil || w.Message.Uid == 0 {
+			break
+		}
+		// The sequence number is set by the mailbox view of each connection
+		msg := imap.NewMessage(0, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+		msg.Uid = w.Message.Uid
+		msg.Flags = w.Message.Flags
+		return &backend.MessageUpdate{Update: u, Message: msg}, nil
+	case typeExpungeUid:
+		return &backend.ExpungeUidUpdate{Update: u, Uid: w.Uid}, nil
+	case typeExistsUid:
+		return &backend.ExistsUidUpdate{Update: u, Uids: w.Uids}, nil
+	default:
+		return nil, fmt.Errorf("updatebus: unknown update type %q", w.Type)
+	}
+	return nil, fmt.Errorf("updatebus: malformed %q update", w.Type)
+}
@@ -66,7 +66,9 @@ type MailboxInfoUpdate struct {
 	*imap.MailboxInfo
 }
 
-// MessageUpdate is a message update.
+// MessageUpdate is a message update. If Message.SeqNum is zero, the message
+// is identified by Message.Uid: the server computes the sequence number of the
+// message for each connection.
 type MessageUpdate struct {
 	Update
 	*imap.Message
@@ -78,6 +80,90 @@ type ExpungeUpdate struct {
 	SeqNum uint32
 }
 
+// ExpungeUidUpdate is an expunge update identifying the message by its UID.
+// Unlike ExpungeUpdate, the backend doesn't need to know the sequence numbers
+// seen by each connection: the server computes them, and defers the EXPUNGE
+// responses until they are allowed.
+type ExpungeUidUpdate struct {
+	Update
+	Uid uint32
+}
+
+// ExistsUidUpdate is a new messages update identifying the messages by their
+// UIDs.
+type ExistsUidUpdate struct {
+	Update
+	Uids []uint32
+}
+
+// domainUpdate is an update which only concerns the users of a virtual
+// domain.
+type domainUpdate struct {
+	Update
+	domain string
+}
+
+// WithDomain returns a copy of an update which only concerns the users of a
+// virtual domain, e.g. the clients of a server tenant. The copy has the same
+// Done channel as the update.
+func WithDomain(update Update, domain string) Update {
+	switch u := update.(type) {
+	case *StatusUpdate:
+		c := *u
+		c.Update = &domainUpdate{u.Update, domain}
+		return &c
+	case *MailboxUpdate:
+		c := *u
+		c.Update = &domainUpdate{u.Update, domain}
+		return &c
+	case *MailboxInfoUpdate:
+		c := *u
+		c.Update = &domainUpdate{u.Update, domain}
+		return &c
+	case *MessageUpdate:
+		c := *u
+		c.Update = &domainUpdate{u.Update, domain}
+		return &c
+	case *ExpungeUpdate:
+		c := *u
+		c.Update = &domainUpdate{u.Update, domain}
+		return &c
+	case *ExpungeUidUpdate:
+		c := *u
+		c.Update = &domainUpdate{u.Update, domain}
+		return &c
+	case *ExistsUidUpdate:
+		c := *u
+		c.Update = &domainUpdate{u.Update, domain}
+		return &c
+	}
+	return &domainUpdate{update, domain}
+}
+
+// UpdateDomain returns the virtual domain of an update returned by WithDomain,
+// or an empty string if the update concerns all domains.
+func UpdateDomain(update Update) string {
+	switch u := update.(type) {
+	case *domainUpdate:
+		return u.domain
+	case *StatusUpdate:
+		return UpdateDomain(u.Update)
+	case *MailboxUpdate:
+		return UpdateDomain(u.Update)
+	case *MailboxInfoUpdate:
+		return UpdateDomain(u.Update)
+	case *MessageUpdate:
+		return UpdateDomain(u.Update)
+	case *ExpungeUpdate:
+		return UpdateDomain(u.Update)
+	case *ExpungeUidUpdate:
+		return UpdateDomain(u.Update)
+	case *ExistsUidUpdate:
+		return UpdateDomain(u.Update)
+	}
+	return ""
+}
+
 // BackendUpdater is a Backend that implements Updater is able to send
 // unilateral backend updates. Backends not implementing this interface don't
 // correctly send unilateral updates, for instance if a user logs in from two
@@ -90,6 +176,25 @@ type BackendUpdater interface {
 	Updates() <-chan Update
 }
 
+// An UpdateBus distributes updates between several server instances, e.g.
+// servers running behind a load balancer and sharing the same storage. Updates
+// published on any instance are received by all of them.
+//
+// Sequence numbers differ between instances: updates should identify messages
+// by UID, e.g. with ExpungeUidUpdate rather than ExpungeUpdate. Buses may only
+// deliver other updates to the local instance.
+type UpdateBus interface {
+	// Publish sends an update to all server instances, including this one. The
+	// update is received as-is by this instance, so that its Done channel is
+	// closed when it has been broadcast to local clients.
+	Publish(update Update) error
+	// Updates returns a channel where updates published by all server instances
+	// are received.
+	Updates() <-chan Update
+	// Close closes the bus. Publish then returns an error.
+	Close() error
+}
+
 // MailboxPoller is a Mailbox that is able to poll updates for new messages or
 // message status updates during a period of inactivity.
 type MailboxPoller interface {
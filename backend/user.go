@@ -1,15 +1,19 @@
 package backend
 
-import "errors"
+import "github.com/linanh/go-imap"
 
+// Backends can also return the errors defined in the imap package, e.g.
+// imap.ErrOverQuota, or any other *imap.StatusError: the server replies with
+// the corresponding response code.
 var (
 	// ErrNoSuchMailbox is returned by User.GetMailbox, User.DeleteMailbox and
 	// User.RenameMailbox when retrieving, deleting or renaming a mailbox that
-	// doesn't exist.
-	ErrNoSuchMailbox = errors.New("No such mailbox")
+	// doesn't exist. It has the NONEXISTENT response code.
+	ErrNoSuchMailbox error = &imap.StatusError{Code: imap.CodeNonExistent, Info: "No such mailbox"}
 	// ErrMailboxAlreadyExists is returned by User.CreateMailbox and
 	// User.RenameMailbox when creating or renaming mailbox that already exists.
-	ErrMailboxAlreadyExists = errors.New("Mailbox already exists")
+	// It has the ALREADYEXISTS response code.
+	ErrMailboxAlreadyExists error = &imap.StatusError{Code: imap.CodeAlreadyExists, Info: "Mailbox already exists"}
 )
 
 // User represents a user in the mail storage system. A user operation always
@@ -79,8 +79,10 @@ type Client struct {
 	mailbox *imap.MailboxStatus
 	// The cached server capabilities.
 	caps map[string]bool
-	// state, mailbox and caps may be accessed in different goroutines. Protect
-	// access.
+	// The capabilities enabled with ENABLE.
+	enabled map[string]bool
+	// state, mailbox, caps and enabled may be accessed in different
+	// goroutines. Protect access.
 	locker sync.Mutex
 
 	// A channel to which unilateral updates from the server will be sent. An
@@ -177,7 +179,33 @@ type handleResult struct {
 	err    error
 }
 
+// utf8Accept checks if UTF8=ACCEPT or IMAP4rev2 has been enabled.
+func (c *Client) utf8Accept() bool {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.enabled["UTF8=ACCEPT"] || c.enabled["IMAP4REV2"]
+}
+
+// imap4rev2 checks if IMAP4rev2 has been enabled.
+func (c *Client) imap4rev2() bool {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.enabled["IMAP4REV2"]
+}
+
+// setUTF8 switches commands carrying mailbox names to raw UTF-8 if UTF8=ACCEPT
+// or IMAP4rev2 has been enabled.
+func (c *Client) setUTF8(cmdr imap.Commander) {
+	if uid, ok := cmdr.(*commands.Uid); ok {
+		cmdr = uid.Cmd
+	}
+	if setter, ok := cmdr.(commands.UTF8Setter); ok && c.utf8Accept() {
+		setter.SetUTF8(true)
+	}
+}
+
 func (c *Client) execute(cmdr imap.Commander, h responses.Handler) (*imap.StatusResp, error) {
+	c.setUTF8(cmdr)
 	cmd := cmdr.Command()
 	cmd.Tag = generateTag()
 
@@ -547,6 +575,13 @@ func (c *Client) LoggedOut() <-chan struct{} {
 	return c.loggedOut
 }
 
+// SetDebugRedaction defines the data removed from debug output, e.g.
+// credentials. It applies to the io.Writer defined by the next call to
+// SetDebug.
+func (c *Client) SetDebugRedaction(redaction imap.DebugRedaction) {
+	c.conn.SetDebugRedaction(redaction)
+}
+
 // SetDebug defines an io.Writer to which all network activity will be logged.
 // If nil is provided, network activity will not be logged.
 func (c *Client) SetDebug(w io.Writer) {
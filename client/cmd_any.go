@@ -5,6 +5,7 @@ import (
 
 	"github.com/linanh/go-imap"
 	"github.com/linanh/go-imap/commands"
+	"github.com/linanh/go-imap/responses"
 )
 
 // ErrAlreadyLoggedOut is returned if Logout is called when the client is
@@ -85,3 +86,20 @@ func (c *Client) Logout() error {
 	}
 	return nil
 }
+
+// ID sends the client identification to the server and returns the server
+// identification, as defined in RFC 2971. clientID may be nil, in which case
+// NIL is sent. The returned map is nil if the server returned NIL.
+func (c *Client) ID(clientID map[string]string) (serverID map[string]string, err error) {
+	cmd := &commands.ID{Params: clientID}
+	res := &responses.ID{}
+
+	status, err := c.execute(cmd, res)
+	if err != nil {
+		return nil, err
+	} else if err := status.Err(); err != nil {
+		return nil, err
+	}
+
+	return res.Params, nil
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/linanh/go-imap"
@@ -78,3 +79,32 @@ func TestClient_Logout(t *testing.T) {
 		t.Errorf("c.State() = %v, want %v", state, imap.LogoutState)
 	}
 }
+
+func TestClient_ID(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	var serverID map[string]string
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		serverID, err = c.ID(map[string]string{imap.IDName: "go-imap", imap.IDVersion: "1.0"})
+		done <- err
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if cmd != `ID ("name" "go-imap" "version" "1.0")` {
+		t.Fatalf("client sent command %v, want %v", cmd, `ID ("name" "go-imap" "version" "1.0")`)
+	}
+	s.WriteString(`* ID ("name" "Cyrus" "os" NIL)` + "\r\n")
+	s.WriteString(tag + " OK ID completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.ID() = %v", err)
+	}
+
+	want := map[string]string{"name": "Cyrus"}
+	if !reflect.DeepEqual(serverID, want) {
+		t.Errorf("c.ID() = %v, want %v", serverID, want)
+	}
+}
@@ -2,6 +2,8 @@ package client
 
 import (
 	"errors"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/linanh/go-imap"
@@ -9,9 +11,17 @@ import (
 	"github.com/linanh/go-imap/responses"
 )
 
-// ErrNotLoggedIn is returned if a function that requires the client to be
-// logged in is called then the client isn't.
-var ErrNotLoggedIn = errors.New("Not logged in")
+var (
+	// ErrNotLoggedIn is returned if a function that requires the client to be
+	// logged in is called then the client isn't.
+	ErrNotLoggedIn = errors.New("Not logged in")
+	// ErrCompressionAlreadyEnabled is returned if Compress is called when
+	// compression is already enabled.
+	ErrCompressionAlreadyEnabled = errors.New("Compression is already enabled")
+	// ErrCompressionUnsupported is returned if Compress is called when the
+	// server doesn't support COMPRESS=DEFLATE.
+	ErrCompressionUnsupported = errors.New("COMPRESS=DEFLATE is not supported by the server")
+)
 
 func (c *Client) ensureAuthenticated() error {
 	state := c.State()
@@ -21,6 +31,80 @@ func (c *Client) ensureAuthenticated() error {
 	return nil
 }
 
+// Compress enables DEFLATE compression, as defined in RFC 4978. level is the
+// compression level, see compress/flate. All further commands and responses
+// are compressed.
+func (c *Client) Compress(level int) error {
+	if err := c.ensureAuthenticated(); err != nil {
+		return err
+	}
+	if c.conn.IsCompressed() {
+		return ErrCompressionAlreadyEnabled
+	}
+	if ok, err := c.Support("COMPRESS=" + imap.CompressDeflate); err != nil {
+		return err
+	} else if !ok {
+		return ErrCompressionUnsupported
+	}
+
+	cmd := &commands.Compress{Mechanism: imap.CompressDeflate}
+
+	return c.Upgrade(func(conn net.Conn) (net.Conn, error) {
+		// Flag connection as in upgrading
+		c.upgrading = true
+		if status, err := c.execute(cmd, nil); err != nil {
+			return nil, err
+		} else if err := status.Err(); err != nil {
+			return nil, err
+		}
+
+		// Wait for reader to block.
+		c.conn.WaitReady()
+		return imap.NewDeflateConn(conn, level)
+	})
+}
+
+// Enable requests the server to enable the given capabilities, as defined in
+// RFC 5161. It returns the capabilities that have actually been enabled.
+//
+// Once UTF8=ACCEPT is enabled, mailbox names, strings and appended messages
+// are exchanged as raw UTF-8 (see RFC 6855).
+//
+// Once IMAP4rev2 is enabled, the client switches to IMAP4rev2 semantics (see
+// RFC 9051): mailbox names are raw UTF-8, SEARCH results are parsed from
+// ESEARCH responses and Lsub uses LIST (SUBSCRIBED).
+func (c *Client) Enable(caps []string) ([]string, error) {
+	if err := c.ensureAuthenticated(); err != nil {
+		return nil, err
+	}
+
+	cmd := &commands.Enable{Caps: caps}
+	res := &responses.Enabled{}
+
+	status, err := c.execute(cmd, res)
+	if err != nil {
+		return nil, err
+	} else if err := status.Err(); err != nil {
+		return nil, err
+	}
+
+	c.locker.Lock()
+	if c.enabled == nil {
+		c.enabled = make(map[string]bool)
+	}
+	for _, cap := range res.Caps {
+		c.enabled[strings.ToUpper(cap)] = true
+	}
+	utf8Accept := c.enabled["UTF8=ACCEPT"] || c.enabled["IMAP4REV2"]
+	c.locker.Unlock()
+
+	if utf8Accept {
+		c.conn.Writer.AllowUTF8 = true
+	}
+
+	return res.Caps, nil
+}
+
 // Select selects a mailbox so that messages in the mailbox can be accessed. Any
 // currently selected mailbox is deselected before attempting the new selection.
 // Even if the readOnly parameter is set to false, the server can decide to open
@@ -170,7 +254,7 @@ func (c *Client) List(ref, name string, ch chan *imap.MailboxInfo) error {
 		Reference: ref,
 		Mailbox:   name,
 	}
-	res := &responses.List{Mailboxes: ch}
+	res := &responses.List{Mailboxes: ch, UTF8: c.utf8Accept()}
 
 	status, err := c.execute(cmd, res)
 	if err != nil {
@@ -196,6 +280,13 @@ func (c *Client) Lsub(ref, name string, ch chan *imap.MailboxInfo) error {
 	res := &responses.List{
 		Mailboxes:  ch,
 		Subscribed: true,
+		UTF8:       c.utf8Accept(),
+	}
+	if c.imap4rev2() {
+		// IMAP4rev2 removes LSUB
+		cmd.Subscribed = false
+		cmd.SelectOpts = []string{"SUBSCRIBED"}
+		res.Subscribed = false
 	}
 
 	status, err := c.execute(cmd, res)
@@ -221,6 +312,7 @@ func (c *Client) Status(name string, items []imap.StatusItem) (*imap.MailboxStat
 	}
 	res := &responses.Status{
 		Mailbox: new(imap.MailboxStatus),
+		UTF8:    c.utf8Accept(),
 	}
 
 	status, err := c.execute(cmd, res)
@@ -252,3 +344,22 @@ func (c *Client) Append(mbox string, flags []string, date time.Time, msg imap.Li
 	}
 	return status.Err()
 }
+
+// Namespace returns the personal, other users' and shared namespaces, as
+// defined in RFC 2342.
+func (c *Client) Namespace() (personal, other, shared []imap.NamespaceDescriptor, err error) {
+	if err = c.ensureAuthenticated(); err != nil {
+		return
+	}
+
+	res := &responses.Namespace{}
+
+	status, err := c.execute(&commands.Namespace{}, res)
+	if err != nil {
+		return
+	}
+	if err = status.Err(); err != nil {
+		return
+	}
+	return res.Personal, res.Other, res.Shared, nil
+}
@@ -2,6 +2,9 @@ package client
 
 import (
 	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
 	"io"
 	"reflect"
 	"testing"
@@ -91,6 +94,65 @@ func TestClient_Select_ReadOnly(t *testing.T) {
 	}
 }
 
+func TestClient_Enable_UTF8Accept(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	setClientState(c, imap.AuthenticatedState, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		enabled, err := c.Enable([]string{"UTF8=ACCEPT"})
+		if err == nil && !reflect.DeepEqual(enabled, []string{"UTF8=ACCEPT"}) {
+			err = fmt.Errorf("enabled %v, want [UTF8=ACCEPT]", enabled)
+		}
+		done <- err
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if cmd != "ENABLE UTF8=ACCEPT" {
+		t.Fatalf("client sent command %v, want %v", cmd, "ENABLE UTF8=ACCEPT")
+	}
+
+	s.WriteString("* ENABLED UTF8=ACCEPT\r\n")
+	s.WriteString(tag + " OK ENABLE completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.Enable() = %v", err)
+	}
+
+	go func() {
+		done <- c.Create("Répertoire &-")
+	}()
+
+	tag, cmd = s.ScanCmd()
+	if cmd != "CREATE \"Répertoire &-\"" {
+		t.Fatalf("client sent command %v, want %v", cmd, "CREATE \"Répertoire &-\"")
+	}
+
+	s.WriteString(tag + " OK CREATE completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.Create() = %v", err)
+	}
+
+	mailboxes := make(chan *imap.MailboxInfo, 1)
+	go func() {
+		done <- c.List("", "*", mailboxes)
+	}()
+
+	tag, _ = s.ScanCmd()
+	s.WriteString("* LIST () \"/\" \"Répertoire &-\"\r\n")
+	s.WriteString(tag + " OK LIST completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.List() = %v", err)
+	}
+	if mbox := <-mailboxes; mbox == nil || mbox.Name != "Répertoire &-" {
+		t.Fatalf("Bad mailbox: %v", mbox)
+	}
+}
+
 func TestClient_Create(t *testing.T) {
 	c, s := newTestClient(t)
 	defer s.Close()
@@ -114,6 +176,33 @@ func TestClient_Create(t *testing.T) {
 	}
 }
 
+func TestClient_Create_OverQuota(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	setClientState(c, imap.AuthenticatedState, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Create("New Mailbox")
+	}()
+
+	tag, _ := s.ScanCmd()
+	s.WriteString(tag + " NO [OVERQUOTA] Quota exceeded\r\n")
+
+	err := <-done
+	var statusErr *imap.StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("c.Create() = %v, want *imap.StatusError", err)
+	}
+	if statusErr.Code != imap.CodeOverQuota {
+		t.Errorf("c.Create() code = %v, want %v", statusErr.Code, imap.CodeOverQuota)
+	}
+	if !errors.Is(err, imap.ErrOverQuota) {
+		t.Errorf("errors.Is(%v, imap.ErrOverQuota) = false, want true", err)
+	}
+}
+
 func TestClient_Delete(t *testing.T) {
 	c, s := newTestClient(t)
 	defer s.Close()
@@ -533,3 +622,114 @@ func TestClient_Append_failed(t *testing.T) {
 		t.Fatalf("c.Append() = %v", err)
 	}
 }
+
+func TestClient_Lsub_IMAP4rev2(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	setClientState(c, imap.AuthenticatedState, nil)
+	c.enabled = map[string]bool{"IMAP4REV2": true}
+
+	mailboxes := make(chan *imap.MailboxInfo, 2)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Lsub("", "*", mailboxes)
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if cmd != "LIST (SUBSCRIBED) \"\" \"*\"" {
+		t.Fatalf("client sent command %v, want %v", cmd, "LIST (SUBSCRIBED) \"\" \"*\"")
+	}
+
+	s.WriteString("* LIST (\\Subscribed) \"/\" Drafts\r\n")
+	s.WriteString(tag + " OK LIST completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.Lsub() = %v", err)
+	}
+
+	mbox := <-mailboxes
+	if mbox == nil || mbox.Name != "Drafts" {
+		t.Fatalf("c.Lsub() returned %v, want Drafts", mbox)
+	}
+}
+
+func TestClient_Namespace(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	setClientState(c, imap.AuthenticatedState, nil)
+
+	done := make(chan error, 1)
+	var personal, shared []imap.NamespaceDescriptor
+	go func() {
+		var err error
+		personal, _, shared, err = c.Namespace()
+		done <- err
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if cmd != "NAMESPACE" {
+		t.Fatalf("client sent command %v, want %v", cmd, "NAMESPACE")
+	}
+
+	s.WriteString("* NAMESPACE ((\"\" \"/\")) NIL ((\"Public/\" \"/\"))\r\n")
+	s.WriteString(tag + " OK NAMESPACE completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.Namespace() = %v", err)
+	}
+
+	if want := []imap.NamespaceDescriptor{{Prefix: "", Delimiter: "/"}}; !reflect.DeepEqual(personal, want) {
+		t.Errorf("personal namespace = %v, want %v", personal, want)
+	}
+	if want := []imap.NamespaceDescriptor{{Prefix: "Public/", Delimiter: "/"}}; !reflect.DeepEqual(shared, want) {
+		t.Errorf("shared namespace = %v, want %v", shared, want)
+	}
+}
+
+func TestClient_Compress(t *testing.T) {
+	c, s := newTestClientWithGreeting(t, "* OK [CAPABILITY IMAP4rev1 COMPRESS=DEFLATE] Server ready.\r\n")
+	defer s.Close()
+
+	setClientState(c, imap.AuthenticatedState, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Compress(flate.DefaultCompression)
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if cmd != "COMPRESS DEFLATE" {
+		t.Fatalf("client sent command %v, want %v", cmd, "COMPRESS DEFLATE")
+	}
+	s.WriteString(tag + " OK DEFLATE active\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.Compress() = %v", err)
+	}
+
+	sc, err := imap.NewDeflateConn(s.Conn, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal("cannot create compressed connection:", err)
+	}
+
+	go func() {
+		done <- c.Noop()
+	}()
+
+	tag, cmd = newCmdScanner(sc).ScanCmd()
+	if cmd != "NOOP" {
+		t.Fatalf("client sent command %v, want %v", cmd, "NOOP")
+	}
+	io.WriteString(sc, tag+" OK NOOP completed\r\n")
+	sc.(interface{ Flush() error }).Flush()
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.Noop() = %v", err)
+	}
+
+	if err := c.Compress(flate.DefaultCompression); err != ErrCompressionAlreadyEnabled {
+		t.Fatalf("c.Compress() = %v, want %v", err, ErrCompressionAlreadyEnabled)
+	}
+}
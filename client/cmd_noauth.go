@@ -22,6 +22,9 @@ var (
 	// server has disabled authentication. Most of the time, calling enabling TLS
 	// solves the problem.
 	ErrLoginDisabled = errors.New("Login is disabled in current state")
+	// ErrExternalUnsupported is returned by AuthenticateExternal if the server
+	// doesn't accept the client's TLS certificate for authentication.
+	ErrExternalUnsupported = errors.New("EXTERNAL authentication is not supported by the server")
 )
 
 // SupportStartTLS checks if the server supports STARTTLS.
@@ -135,6 +138,19 @@ func (c *Client) Authenticate(auth sasl.Client) error {
 	return nil
 }
 
+// AuthenticateExternal authenticates with the TLS client certificate, using
+// the EXTERNAL mechanism. identity is the authorization identity, it can be
+// left empty to act as the user associated with the certificate.
+func (c *Client) AuthenticateExternal(identity string) error {
+	if ok, err := c.SupportAuth(sasl.External); err != nil {
+		return err
+	} else if !ok {
+		return ErrExternalUnsupported
+	}
+
+	return c.Authenticate(sasl.NewExternalClient(identity))
+}
+
 // Login identifies the client to the server and carries the plaintext password
 // authenticating this user.
 func (c *Client) Login(username, password string) error {
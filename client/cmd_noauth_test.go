@@ -3,6 +3,7 @@ package client
 import (
 	"crypto/tls"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/linanh/go-imap"
@@ -144,6 +145,104 @@ func TestClient_Authenticate_InitialResponse(t *testing.T) {
 	}
 }
 
+func TestClient_AuthenticateOAuth_XOAuth2(t *testing.T) {
+	c, s := newTestClientWithGreeting(t, "* OK [CAPABILITY IMAP4rev1 SASL-IR AUTH=XOAUTH2] Server ready.\r\n")
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.AuthenticateOAuth("username", "token")
+	}()
+
+	tag, cmd := s.ScanCmd()
+	wantCmd := "AUTHENTICATE XOAUTH2 dXNlcj11c2VybmFtZQFhdXRoPUJlYXJlciB0b2tlbgEB"
+	if cmd != wantCmd {
+		t.Fatalf("client sent command %v, want %v", cmd, wantCmd)
+	}
+
+	s.WriteString(tag + " OK AUTHENTICATE completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.AuthenticateOAuth() = %v", err)
+	}
+
+	if state := c.State(); state != imap.AuthenticatedState {
+		t.Errorf("c.State() = %v, want %v", state, imap.AuthenticatedState)
+	}
+}
+
+func TestClient_AuthenticateOAuth_Error(t *testing.T) {
+	c, s := newTestClientWithGreeting(t, "* OK [CAPABILITY IMAP4rev1 SASL-IR AUTH=OAUTHBEARER AUTH=XOAUTH2] Server ready.\r\n")
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.AuthenticateOAuth("username", "token")
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if !strings.HasPrefix(cmd, "AUTHENTICATE OAUTHBEARER ") {
+		t.Fatalf("client sent command %v, want AUTHENTICATE OAUTHBEARER", cmd)
+	}
+
+	// {"status":"invalid_token","schemes":"bearer","scope":""}
+	s.WriteString("+ eyJzdGF0dXMiOiJpbnZhbGlkX3Rva2VuIiwic2NoZW1lcyI6ImJlYXJlciIsInNjb3BlIjoiIn0=\r\n")
+
+	// The client must acknowledge the error with %x01
+	if line := s.ScanLine(); line != "AQ==" {
+		t.Fatalf("client sent %v, want AQ==", line)
+	}
+
+	s.WriteString(tag + " NO Authentication failed\r\n")
+
+	err := <-done
+	oauthErr, ok := err.(*sasl.OAuthBearerError)
+	if !ok {
+		t.Fatalf("c.AuthenticateOAuth() = %v, want *sasl.OAuthBearerError", err)
+	}
+	if oauthErr.Status != "invalid_token" {
+		t.Errorf("OAuth error status = %v, want invalid_token", oauthErr.Status)
+	}
+
+	if state := c.State(); state != imap.NotAuthenticatedState {
+		t.Errorf("c.State() = %v, want %v", state, imap.NotAuthenticatedState)
+	}
+}
+
+func TestClient_AuthenticateExternal(t *testing.T) {
+	c, s := newTestClientWithGreeting(t, "* OK [CAPABILITY IMAP4rev1 SASL-IR AUTH=EXTERNAL] Server ready.\r\n")
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.AuthenticateExternal("")
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if cmd != "AUTHENTICATE EXTERNAL =" {
+		t.Fatalf("client sent command %v, want AUTHENTICATE EXTERNAL =", cmd)
+	}
+
+	s.WriteString(tag + " OK AUTHENTICATE completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.AuthenticateExternal() = %v", err)
+	}
+
+	if state := c.State(); state != imap.AuthenticatedState {
+		t.Errorf("c.State() = %v, want %v", state, imap.AuthenticatedState)
+	}
+}
+
+func TestClient_AuthenticateExternal_Unsupported(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	if err := c.AuthenticateExternal(""); err != ErrExternalUnsupported {
+		t.Fatalf("c.AuthenticateExternal() = %v, want %v", err, ErrExternalUnsupported)
+	}
+}
+
 func TestClient_Login_Success(t *testing.T) {
 	c, s := newTestClient(t)
 	defer s.Close()
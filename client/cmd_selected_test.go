@@ -632,3 +632,64 @@ func TestClient_Copy_Uid(t *testing.T) {
 		t.Fatalf("c.UidCopy() = %v", err)
 	}
 }
+
+func TestClient_Search_ESearch(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	setClientState(c, imap.SelectedState, nil)
+	c.enabled = map[string]bool{"IMAP4REV2": true}
+
+	criteria := &imap.SearchCriteria{WithFlags: []string{imap.DeletedFlag}}
+
+	done := make(chan error, 1)
+	var results []uint32
+	go func() {
+		var err error
+		results, err = c.UidSearch(criteria)
+		done <- err
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if cmd != "UID SEARCH CHARSET UTF-8 DELETED" {
+		t.Fatalf("client sent command %v, want %v", cmd, "UID SEARCH CHARSET UTF-8 DELETED")
+	}
+
+	s.WriteString("* ESEARCH (TAG \"" + tag + "\") UID ALL 2:4,9\r\n")
+	s.WriteString(tag + " OK UID SEARCH completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.UidSearch() = %v", err)
+	}
+
+	want := []uint32{2, 3, 4, 9}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("c.UidSearch() = %v, want %v", results, want)
+	}
+}
+
+func TestClient_Move(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	setClientState(c, imap.SelectedState, nil)
+
+	seqset, _ := imap.ParseSeqSet("2:3")
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Move(seqset, "Archive")
+	}()
+
+	tag, cmd := s.ScanCmd()
+	if cmd != "MOVE 2:3 \"Archive\"" {
+		t.Fatalf("client sent command %v, want %v", cmd, "MOVE 2:3 \"Archive\"")
+	}
+
+	s.WriteString("* 2 EXPUNGE\r\n")
+	s.WriteString("* 2 EXPUNGE\r\n")
+	s.WriteString(tag + " OK MOVE completed\r\n")
+
+	if err := <-done; err != nil {
+		t.Fatalf("c.Move() = %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/emersion/go-sasl"
+)
+
+// The XOAUTH2 SASL mechanism, as used by Google and Microsoft.
+const XOAuth2 = "XOAUTH2"
+
+// ErrOAuthUnsupported is returned by AuthenticateOAuth if the server supports
+// neither OAUTHBEARER nor XOAUTH2.
+var ErrOAuthUnsupported = errors.New("OAuth authentication is not supported by the server")
+
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return XOAuth2, ir, nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	oauthErr := &sasl.OAuthBearerError{}
+	if err := json.Unmarshal(challenge, oauthErr); err != nil {
+		return nil, err
+	}
+	return nil, oauthErr
+}
+
+// NewXOAuth2Client returns a client for the XOAUTH2 mechanism. On failure,
+// the JSON error sent by the server is returned as a *sasl.OAuthBearerError.
+func NewXOAuth2Client(username, token string) sasl.Client {
+	return &xoauth2Client{username, token}
+}
+
+// oauthErrorClient acknowledges the JSON error challenge sent by the server
+// instead of cancelling the exchange, as required by RFC 7628 section 3.2.3.
+type oauthErrorClient struct {
+	sasl.Client
+	dummy []byte
+	err   *sasl.OAuthBearerError
+}
+
+func (a *oauthErrorClient) Next(challenge []byte) ([]byte, error) {
+	resp, err := a.Client.Next(challenge)
+	if oauthErr, ok := err.(*sasl.OAuthBearerError); ok {
+		a.err = oauthErr
+		return a.dummy, nil
+	}
+	return resp, err
+}
+
+// AuthenticateOAuth authenticates with an OAuth 2.0 bearer token, using
+// OAUTHBEARER (RFC 7628) if the server supports it and XOAUTH2 otherwise. If
+// the server rejects the token, the returned error is a
+// *sasl.OAuthBearerError.
+func (c *Client) AuthenticateOAuth(username, token string) error {
+	var auth *oauthErrorClient
+	if ok, err := c.SupportAuth(sasl.OAuthBearer); err != nil {
+		return err
+	} else if ok {
+		auth = &oauthErrorClient{
+			Client: sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+				Username: username,
+				Token:    token,
+				Host:     c.serverName,
+			}),
+			dummy: []byte{0x01},
+		}
+	} else if ok, err := c.SupportAuth(XOAuth2); err != nil {
+		return err
+	} else if ok {
+		auth = &oauthErrorClient{
+			Client: NewXOAuth2Client(username, token),
+			dummy:  []byte{},
+		}
+	} else {
+		return ErrOAuthUnsupported
+	}
+
+	if err := c.Authenticate(auth); err != nil {
+		if auth.err != nil {
+			return auth.err
+		}
+		return err
+	}
+	return nil
+}
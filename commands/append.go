@@ -2,14 +2,19 @@ package commands
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/linanh/go-imap"
-	"github.com/linanh/go-imap/utf7"
 )
 
 // Append is an APPEND command, as defined in RFC 3501 section 6.3.11.
+//
+// If UTF8 is set, the message is sent with the UTF8 data extension defined in
+// RFC 6855 section 4, so that it can contain UTF-8 headers.
 type Append struct {
+	MailboxEncoding
+
 	Mailbox string
 	Flags   []string
 	Date    time.Time
@@ -19,7 +24,7 @@ type Append struct {
 func (cmd *Append) Command() *imap.Command {
 	var args []interface{}
 
-	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+	mailbox := cmd.encodeMailbox(cmd.Mailbox)
 	args = append(args, imap.FormatMailboxName(mailbox))
 
 	if cmd.Flags != nil {
@@ -34,7 +39,11 @@ func (cmd *Append) Command() *imap.Command {
 		args = append(args, cmd.Date)
 	}
 
-	args = append(args, cmd.Message)
+	if cmd.UTF8 {
+		args = append(args, imap.RawString("UTF8"), []interface{}{imap.Literal8{Literal: cmd.Message}})
+	} else {
+		args = append(args, cmd.Message)
+	}
 
 	return &imap.Command{
 		Name:      "APPEND",
@@ -48,9 +57,7 @@ func (cmd *Append) Parse(fields []interface{}) (err error) {
 	}
 
 	// Parse mailbox name
-	if mailbox, err := imap.ParseString(fields[0]); err != nil {
-		return err
-	} else if mailbox, err = utf7.Encoding.NewDecoder().String(mailbox); err != nil {
+	if mailbox, err := cmd.parseMailbox(fields[0]); err != nil {
 		return err
 	} else {
 		cmd.Mailbox = imap.CanonicalMailboxName(mailbox)
@@ -59,7 +66,22 @@ func (cmd *Append) Parse(fields []interface{}) (err error) {
 	// Parse message literal
 	litIndex := len(fields) - 1
 	var ok bool
-	if cmd.Message, ok = fields[litIndex].(imap.Literal); !ok {
+	if ext, isList := fields[litIndex].([]interface{}); isList && litIndex > 1 {
+		// UTF8 data extension, see RFC 6855 section 4
+		if name, _ := fields[litIndex-1].(string); !strings.EqualFold(name, "UTF8") {
+			return errors.New("Message must be a literal")
+		}
+		if !cmd.UTF8 {
+			return errors.New("UTF8 data extension requires UTF8=ACCEPT to be enabled")
+		}
+		if len(ext) != 1 {
+			return errors.New("UTF8 data extension must contain exactly one literal")
+		}
+		if cmd.Message, ok = ext[0].(imap.Literal); !ok {
+			return errors.New("Message must be a literal")
+		}
+		litIndex--
+	} else if cmd.Message, ok = fields[litIndex].(imap.Literal); !ok {
 		return errors.New("Message must be a literal")
 	}
 
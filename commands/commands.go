@@ -1,2 +1,37 @@
 // Package commands implements IMAP commands defined in RFC 3501.
 package commands
+
+import (
+	"github.com/linanh/go-imap"
+)
+
+// UTF8Setter is implemented by commands carrying mailbox names. SetUTF8
+// switches them from modified UTF-7 to raw UTF-8 mailbox names, as negotiated
+// with ENABLE UTF8=ACCEPT (RFC 6855).
+type UTF8Setter interface {
+	SetUTF8(enabled bool)
+}
+
+// MailboxEncoding is embedded by commands carrying mailbox names to implement
+// UTF8Setter.
+type MailboxEncoding struct {
+	// UTF8 is true if mailbox names are raw UTF-8 instead of modified UTF-7.
+	UTF8 bool
+}
+
+// SetUTF8 implements UTF8Setter.
+func (enc *MailboxEncoding) SetUTF8(enabled bool) {
+	enc.UTF8 = enabled
+}
+
+func (enc *MailboxEncoding) encodeMailbox(name string) string {
+	return imap.EncodeMailboxName(name, enc.UTF8)
+}
+
+func (enc *MailboxEncoding) parseMailbox(f interface{}) (string, error) {
+	name, err := imap.ParseString(f)
+	if err != nil {
+		return "", err
+	}
+	return imap.DecodeMailboxName(name, enc.UTF8)
+}
@@ -0,0 +1,34 @@
+package commands
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/linanh/go-imap"
+)
+
+// Compress is a COMPRESS command, as defined in RFC 4978 section 3.
+type Compress struct {
+	Mechanism string
+}
+
+func (cmd *Compress) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "COMPRESS",
+		Arguments: []interface{}{imap.RawString(cmd.Mechanism)},
+	}
+}
+
+func (cmd *Compress) Parse(fields []interface{}) error {
+	if len(fields) < 1 {
+		return errors.New("No enough arguments")
+	}
+
+	if mech, ok := fields[0].(string); !ok {
+		return errors.New("Compression mechanism must be an atom")
+	} else {
+		cmd.Mechanism = strings.ToUpper(mech)
+	}
+
+	return nil
+}
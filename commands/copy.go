@@ -4,17 +4,18 @@ import (
 	"errors"
 
 	"github.com/linanh/go-imap"
-	"github.com/linanh/go-imap/utf7"
 )
 
 // Copy is a COPY command, as defined in RFC 3501 section 6.4.7.
 type Copy struct {
+	MailboxEncoding
+
 	SeqSet  *imap.SeqSet
 	Mailbox string
 }
 
 func (cmd *Copy) Command() *imap.Command {
-	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+	mailbox := cmd.encodeMailbox(cmd.Mailbox)
 
 	return &imap.Command{
 		Name:      "COPY",
@@ -35,9 +36,7 @@ func (cmd *Copy) Parse(fields []interface{}) error {
 		cmd.SeqSet = seqSet
 	}
 
-	if mailbox, err := imap.ParseString(fields[1]); err != nil {
-		return err
-	} else if mailbox, err := utf7.Encoding.NewDecoder().String(mailbox); err != nil {
+	if mailbox, err := cmd.parseMailbox(fields[1]); err != nil {
 		return err
 	} else {
 		cmd.Mailbox = imap.CanonicalMailboxName(mailbox)
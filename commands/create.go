@@ -4,16 +4,17 @@ import (
 	"errors"
 
 	"github.com/linanh/go-imap"
-	"github.com/linanh/go-imap/utf7"
 )
 
 // Create is a CREATE command, as defined in RFC 3501 section 6.3.3.
 type Create struct {
+	MailboxEncoding
+
 	Mailbox string
 }
 
 func (cmd *Create) Command() *imap.Command {
-	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+	mailbox := cmd.encodeMailbox(cmd.Mailbox)
 
 	return &imap.Command{
 		Name:      "CREATE",
@@ -26,9 +27,7 @@ func (cmd *Create) Parse(fields []interface{}) error {
 		return errors.New("No enough arguments")
 	}
 
-	if mailbox, err := imap.ParseString(fields[0]); err != nil {
-		return err
-	} else if mailbox, err := utf7.Encoding.NewDecoder().String(mailbox); err != nil {
+	if mailbox, err := cmd.parseMailbox(fields[0]); err != nil {
 		return err
 	} else {
 		cmd.Mailbox = imap.CanonicalMailboxName(mailbox)
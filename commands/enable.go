@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/linanh/go-imap"
+)
+
+// Enable is an ENABLE command, as defined in RFC 5161 section 3.1.
+type Enable struct {
+	Caps []string
+}
+
+func (cmd *Enable) Command() *imap.Command {
+	args := make([]interface{}, len(cmd.Caps))
+	for i, c := range cmd.Caps {
+		args[i] = imap.RawString(c)
+	}
+
+	return &imap.Command{
+		Name:      "ENABLE",
+		Arguments: args,
+	}
+}
+
+func (cmd *Enable) Parse(fields []interface{}) error {
+	if len(fields) < 1 {
+		return errors.New("No enough arguments")
+	}
+
+	cmd.Caps = make([]string, len(fields))
+	for i, f := range fields {
+		c, ok := f.(string)
+		if !ok {
+			return errors.New("Capability must be an atom")
+		}
+		cmd.Caps[i] = strings.ToUpper(c)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package commands
+
+import (
+	"errors"
+
+	"github.com/linanh/go-imap"
+)
+
+// ID is an ID command, as defined in RFC 2971 section 3.1.
+type ID struct {
+	// The client identification. If nil, NIL is sent.
+	Params map[string]string
+}
+
+func (cmd *ID) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "ID",
+		Arguments: []interface{}{imap.FormatID(cmd.Params)},
+	}
+}
+
+func (cmd *ID) Parse(fields []interface{}) error {
+	if len(fields) < 1 {
+		return errors.New("No enough arguments")
+	}
+
+	id, err := imap.ParseID(fields[0])
+	if err != nil {
+		return err
+	}
+	cmd.Params = id
+	return nil
+}
@@ -2,18 +2,31 @@ package commands
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/linanh/go-imap"
-	"github.com/linanh/go-imap/utf7"
 )
 
 // List is a LIST command, as defined in RFC 3501 section 6.3.8. If Subscribed
 // is set to true, LSUB will be used instead.
+//
+// Selection and return options are defined in RFC 5258 (LIST-EXTENDED). The
+// STATUS return option is defined in RFC 5819 (LIST-STATUS).
 type List struct {
+	MailboxEncoding
+
 	Reference string
 	Mailbox   string
 
 	Subscribed bool
+
+	// Selection options, e.g. SUBSCRIBED.
+	SelectOpts []string
+	// Return options, e.g. SUBSCRIBED or CHILDREN. The STATUS return option is
+	// stored in ReturnStatus.
+	ReturnOpts []string
+	// Status items requested with the STATUS return option.
+	ReturnStatus []imap.StatusItem
 }
 
 func (cmd *List) Command() *imap.Command {
@@ -22,39 +35,122 @@ func (cmd *List) Command() *imap.Command {
 		name = "LSUB"
 	}
 
-	enc := utf7.Encoding.NewEncoder()
-	ref, _ := enc.String(cmd.Reference)
-	mailbox, _ := enc.String(cmd.Mailbox)
+	ref := cmd.encodeMailbox(cmd.Reference)
+	mailbox := cmd.encodeMailbox(cmd.Mailbox)
+
+	var args []interface{}
+	if len(cmd.SelectOpts) > 0 {
+		opts := make([]interface{}, len(cmd.SelectOpts))
+		for i, opt := range cmd.SelectOpts {
+			opts[i] = imap.RawString(opt)
+		}
+		args = append(args, opts)
+	}
+
+	args = append(args, ref, mailbox)
+
+	if len(cmd.ReturnOpts) > 0 || len(cmd.ReturnStatus) > 0 {
+		var opts []interface{}
+		for _, opt := range cmd.ReturnOpts {
+			opts = append(opts, imap.RawString(opt))
+		}
+		if len(cmd.ReturnStatus) > 0 {
+			items := make([]interface{}, len(cmd.ReturnStatus))
+			for i, item := range cmd.ReturnStatus {
+				items[i] = imap.RawString(item)
+			}
+			opts = append(opts, imap.RawString("STATUS"), items)
+		}
+		args = append(args, imap.RawString("RETURN"), opts)
+	}
 
 	return &imap.Command{
 		Name:      name,
-		Arguments: []interface{}{ref, mailbox},
+		Arguments: args,
 	}
 }
 
+func parseListOpts(fields []interface{}) ([]string, error) {
+	opts := make([]string, len(fields))
+	for i, f := range fields {
+		if s, ok := f.(string); !ok {
+			return nil, errors.New("LIST option must be an atom")
+		} else {
+			opts[i] = strings.ToUpper(s)
+		}
+	}
+	return opts, nil
+}
+
 func (cmd *List) Parse(fields []interface{}) error {
+	// Parse selection options
+	if len(fields) > 0 && !cmd.Subscribed {
+		if opts, ok := fields[0].([]interface{}); ok {
+			var err error
+			if cmd.SelectOpts, err = parseListOpts(opts); err != nil {
+				return err
+			}
+			fields = fields[1:]
+		}
+	}
+
 	if len(fields) < 2 {
 		return errors.New("No enough arguments")
 	}
 
-	dec := utf7.Encoding.NewDecoder()
-
-	if mailbox, err := imap.ParseString(fields[0]); err != nil {
-		return err
-	} else if mailbox, err := dec.String(mailbox); err != nil {
+	if mailbox, err := cmd.parseMailbox(fields[0]); err != nil {
 		return err
 	} else {
 		// TODO: canonical mailbox path
 		cmd.Reference = imap.CanonicalMailboxName(mailbox)
 	}
 
-	if mailbox, err := imap.ParseString(fields[1]); err != nil {
-		return err
-	} else if mailbox, err := dec.String(mailbox); err != nil {
+	if mailbox, err := cmd.parseMailbox(fields[1]); err != nil {
 		return err
 	} else {
 		cmd.Mailbox = imap.CanonicalMailboxName(mailbox)
 	}
 
+	// Parse return options
+	fields = fields[2:]
+	if len(fields) == 0 || cmd.Subscribed {
+		return nil
+	}
+	if f, ok := fields[0].(string); !ok || !strings.EqualFold(f, "RETURN") || len(fields) < 2 {
+		return errors.New("Invalid LIST return options")
+	}
+	opts, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("LIST return options must be a list")
+	}
+	for i := 0; i < len(opts); i++ {
+		opt, ok := opts[i].(string)
+		if !ok {
+			return errors.New("LIST option must be an atom")
+		}
+		opt = strings.ToUpper(opt)
+
+		if opt != "STATUS" {
+			cmd.ReturnOpts = append(cmd.ReturnOpts, opt)
+			continue
+		}
+
+		i++
+		if i >= len(opts) {
+			return errors.New("Missing STATUS return option items")
+		}
+		items, ok := opts[i].([]interface{})
+		if !ok {
+			return errors.New("STATUS return option items must be a list")
+		}
+		for _, item := range items {
+			if s, ok := item.(string); !ok {
+				return errors.New("Got a non-string field in STATUS return option")
+			} else {
+				cmd.ReturnStatus = append(cmd.ReturnStatus, imap.StatusItem(strings.ToUpper(s)))
+			}
+		}
+	}
+
 	return nil
 }
@@ -4,19 +4,19 @@ import (
 	"errors"
 
 	"github.com/linanh/go-imap"
-	"github.com/linanh/go-imap/utf7"
 )
 
 // Rename is a RENAME command, as defined in RFC 3501 section 6.3.5.
 type Rename struct {
+	MailboxEncoding
+
 	Existing string
 	New      string
 }
 
 func (cmd *Rename) Command() *imap.Command {
-	enc := utf7.Encoding.NewEncoder()
-	existingName, _ := enc.String(cmd.Existing)
-	newName, _ := enc.String(cmd.New)
+	existingName := cmd.encodeMailbox(cmd.Existing)
+	newName := cmd.encodeMailbox(cmd.New)
 
 	return &imap.Command{
 		Name:      "RENAME",
@@ -29,19 +29,13 @@ func (cmd *Rename) Parse(fields []interface{}) error {
 		return errors.New("No enough arguments")
 	}
 
-	dec := utf7.Encoding.NewDecoder()
-
-	if existingName, err := imap.ParseString(fields[0]); err != nil {
-		return err
-	} else if existingName, err := dec.String(existingName); err != nil {
+	if existingName, err := cmd.parseMailbox(fields[0]); err != nil {
 		return err
 	} else {
 		cmd.Existing = imap.CanonicalMailboxName(existingName)
 	}
 
-	if newName, err := imap.ParseString(fields[1]); err != nil {
-		return err
-	} else if newName, err := dec.String(newName); err != nil {
+	if newName, err := cmd.parseMailbox(fields[1]); err != nil {
 		return err
 	} else {
 		cmd.New = imap.CanonicalMailboxName(newName)
@@ -10,12 +10,22 @@ import (
 
 // Search is a SEARCH command, as defined in RFC 3501 section 6.4.4.
 type Search struct {
+	// Return options, as defined in RFC 4731 section 3.1. If non-nil, results
+	// are returned in an ESEARCH response. An empty list is equivalent to ALL.
+	Return   []string
 	Charset  string
 	Criteria *imap.SearchCriteria
 }
 
 func (cmd *Search) Command() *imap.Command {
 	var args []interface{}
+	if cmd.Return != nil {
+		opts := make([]interface{}, len(cmd.Return))
+		for i, opt := range cmd.Return {
+			opts[i] = imap.RawString(opt)
+		}
+		args = append(args, imap.RawString("RETURN"), opts)
+	}
 	if cmd.Charset != "" {
 		args = append(args, imap.RawString("CHARSET"), imap.RawString(cmd.Charset))
 	}
@@ -32,6 +42,26 @@ func (cmd *Search) Parse(fields []interface{}) error {
 		return errors.New("Missing search criteria")
 	}
 
+	// Parse return options
+	if f, ok := fields[0].(string); ok && strings.EqualFold(f, "RETURN") {
+		if len(fields) < 2 {
+			return errors.New("Missing RETURN options")
+		}
+		opts, ok := fields[1].([]interface{})
+		if !ok {
+			return errors.New("RETURN options must be a list")
+		}
+		cmd.Return = make([]string, len(opts))
+		for i, opt := range opts {
+			if s, ok := opt.(string); !ok {
+				return errors.New("RETURN option must be an atom")
+			} else {
+				cmd.Return[i] = strings.ToUpper(s)
+			}
+		}
+		fields = fields[2:]
+	}
+
 	// Parse charset
 	if f, ok := fields[0].(string); ok && strings.EqualFold(f, "CHARSET") {
 		if len(fields) < 2 {
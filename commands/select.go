@@ -4,12 +4,13 @@ import (
 	"errors"
 
 	"github.com/linanh/go-imap"
-	"github.com/linanh/go-imap/utf7"
 )
 
 // Select is a SELECT command, as defined in RFC 3501 section 6.3.1. If ReadOnly
 // is set to true, the EXAMINE command will be used instead.
 type Select struct {
+	MailboxEncoding
+
 	Mailbox  string
 	ReadOnly bool
 }
@@ -20,7 +21,7 @@ func (cmd *Select) Command() *imap.Command {
 		name = "EXAMINE"
 	}
 
-	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+	mailbox := cmd.encodeMailbox(cmd.Mailbox)
 
 	return &imap.Command{
 		Name:      name,
@@ -33,9 +34,7 @@ func (cmd *Select) Parse(fields []interface{}) error {
 		return errors.New("No enough arguments")
 	}
 
-	if mailbox, err := imap.ParseString(fields[0]); err != nil {
-		return err
-	} else if mailbox, err := utf7.Encoding.NewDecoder().String(mailbox); err != nil {
+	if mailbox, err := cmd.parseMailbox(fields[0]); err != nil {
 		return err
 	} else {
 		cmd.Mailbox = imap.CanonicalMailboxName(mailbox)
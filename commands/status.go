@@ -5,17 +5,18 @@ import (
 	"strings"
 
 	"github.com/linanh/go-imap"
-	"github.com/linanh/go-imap/utf7"
 )
 
 // Status is a STATUS command, as defined in RFC 3501 section 6.3.10.
 type Status struct {
+	MailboxEncoding
+
 	Mailbox string
 	Items   []imap.StatusItem
 }
 
 func (cmd *Status) Command() *imap.Command {
-	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+	mailbox := cmd.encodeMailbox(cmd.Mailbox)
 
 	items := make([]interface{}, len(cmd.Items))
 	for i, item := range cmd.Items {
@@ -33,9 +34,7 @@ func (cmd *Status) Parse(fields []interface{}) error {
 		return errors.New("No enough arguments")
 	}
 
-	if mailbox, err := imap.ParseString(fields[0]); err != nil {
-		return err
-	} else if mailbox, err := utf7.Encoding.NewDecoder().String(mailbox); err != nil {
+	if mailbox, err := cmd.parseMailbox(fields[0]); err != nil {
 		return err
 	} else {
 		cmd.Mailbox = imap.CanonicalMailboxName(mailbox)
@@ -4,16 +4,17 @@ import (
 	"errors"
 
 	"github.com/linanh/go-imap"
-	"github.com/linanh/go-imap/utf7"
 )
 
 // Subscribe is a SUBSCRIBE command, as defined in RFC 3501 section 6.3.6.
 type Subscribe struct {
+	MailboxEncoding
+
 	Mailbox string
 }
 
 func (cmd *Subscribe) Command() *imap.Command {
-	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+	mailbox := cmd.encodeMailbox(cmd.Mailbox)
 
 	return &imap.Command{
 		Name:      "SUBSCRIBE",
@@ -26,22 +27,21 @@ func (cmd *Subscribe) Parse(fields []interface{}) error {
 		return errors.New("No enough arguments")
 	}
 
-	if mailbox, err := imap.ParseString(fields[0]); err != nil {
-		return err
-	} else if cmd.Mailbox, err = utf7.Encoding.NewDecoder().String(mailbox); err != nil {
-		return err
-	}
-	return nil
+	var err error
+	cmd.Mailbox, err = cmd.parseMailbox(fields[0])
+	return err
 }
 
 // An UNSUBSCRIBE command.
 // See RFC 3501 section 6.3.7
 type Unsubscribe struct {
+	MailboxEncoding
+
 	Mailbox string
 }
 
 func (cmd *Unsubscribe) Command() *imap.Command {
-	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+	mailbox := cmd.encodeMailbox(cmd.Mailbox)
 
 	return &imap.Command{
 		Name:      "UNSUBSCRIBE",
@@ -54,10 +54,7 @@ func (cmd *Unsubscribe) Parse(fields []interface{}) error {
 		return errors.New("No enogh arguments")
 	}
 
-	if mailbox, err := imap.ParseString(fields[0]); err != nil {
-		return err
-	} else if cmd.Mailbox, err = utf7.Encoding.NewDecoder().String(mailbox); err != nil {
-		return err
-	}
-	return nil
+	var err error
+	cmd.Mailbox, err = cmd.parseMailbox(fields[0])
+	return err
 }
@@ -0,0 +1,71 @@
+package imap
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+)
+
+// The DEFLATE compression mechanism, as defined in RFC 4978.
+const CompressDeflate = "DEFLATE"
+
+type deflateConn struct {
+	net.Conn
+
+	r io.ReadCloser
+
+	// Protects w, which may be closed while being written to
+	locker sync.Mutex
+	w      *flate.Writer
+}
+
+// NewDeflateConn wraps conn with DEFLATE compression, as defined in RFC 4978.
+// level is the compression level, see compress/flate.
+//
+// Each call to Flush performs a sync flush, so that responses and commands are
+// sent in full as soon as the IMAP writer is flushed.
+func NewDeflateConn(conn net.Conn, level int) (net.Conn, error) {
+	w, err := flate.NewWriter(conn, level)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deflateConn{
+		Conn: conn,
+		r:    flate.NewReader(conn),
+		w:    w,
+	}, nil
+}
+
+func (c *deflateConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *deflateConn) Write(b []byte) (int, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.w.Write(b)
+}
+
+func (c *deflateConn) Flush() error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.w.Flush()
+}
+
+func (c *deflateConn) Close() error {
+	// Close the underlying connection first, to unblock pending writes
+	err := c.Conn.Close()
+
+	c.locker.Lock()
+	c.w.Close()
+	c.locker.Unlock()
+	return err
+}
+
+// IsCompressed checks if this connection has compression enabled.
+func (c *Conn) IsCompressed() bool {
+	_, ok := c.Conn.(*deflateConn)
+	return ok
+}
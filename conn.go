@@ -143,6 +143,12 @@ type ConnInfo struct {
 
 	// nil if connection is not using TLS.
 	TLS *tls.ConnectionState
+	// True if TLS has been terminated by a proxy the client has connected to,
+	// e.g. as reported by the PROXY protocol. TLS is nil in this case.
+	TLSTerminated bool
+	// The server name requested by the client with TLS Server Name Indication,
+	// empty if none. It can be used to serve several domains.
+	ServerName string
 }
 
 // An IMAP connection.
@@ -158,6 +164,8 @@ type Conn struct {
 
 	// Print all commands and responses to this io.Writer.
 	debug io.Writer
+	// Data removed from debug output.
+	redaction DebugRedaction
 }
 
 // NewConn creates a new IMAP connection.
@@ -189,6 +197,13 @@ func (c *Conn) init() {
 			localDebug = NewLockedWriter(localDebug)
 			remoteDebug = localDebug
 		}
+		// Each direction is parsed separately
+		if c.redaction != 0 && localDebug != nil {
+			localDebug = NewRedactWriter(localDebug, c.redaction)
+		}
+		if c.redaction != 0 && remoteDebug != nil {
+			remoteDebug = NewRedactWriter(remoteDebug, c.redaction)
+		}
 
 		if localDebug != nil {
 			w = io.MultiWriter(c.Conn, localDebug)
@@ -229,10 +244,16 @@ func (c *Conn) Info() *ConnInfo {
 		LocalAddr:  c.LocalAddr(),
 	}
 
-	tlsConn, ok := c.Conn.(*tls.Conn)
+	conn := c.Conn
+	if dc, ok := conn.(*deflateConn); ok {
+		conn = dc.Conn
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
 	if ok {
 		state := tlsConn.ConnectionState()
 		info.TLS = &state
+		info.ServerName = state.ServerName
 	}
 
 	return info
@@ -282,3 +303,9 @@ func (c *Conn) SetDebug(w io.Writer) {
 	c.debug = w
 	c.init()
 }
+
+// SetDebugRedaction defines the data removed from debug output. It applies to
+// the io.Writer defined by the next call to SetDebug.
+func (c *Conn) SetDebugRedaction(redaction DebugRedaction) {
+	c.redaction = redaction
+}
@@ -0,0 +1,91 @@
+package imap
+
+import (
+	"errors"
+	"sort"
+)
+
+// ID fields defined in RFC 2971 section 3.3.
+const (
+	IDName        = "name"
+	IDVersion     = "version"
+	IDOS          = "os"
+	IDOSVersion   = "os-version"
+	IDVendor      = "vendor"
+	IDSupportURL  = "support-url"
+	IDAddress     = "address"
+	IDDate        = "date"
+	IDCommand     = "command"
+	IDArguments   = "arguments"
+	IDEnvironment = "environment"
+)
+
+// Limits defined in RFC 2971 section 3.3.
+const (
+	idMaxFields      = 30
+	idMaxFieldLength = 30
+	idMaxValueLength = 1024
+)
+
+// ParseID parses an ID parameter list, as defined in RFC 2971 section 4. NIL
+// is parsed as a nil map. Fields with a NIL value are ignored.
+func ParseID(f interface{}) (map[string]string, error) {
+	if f == nil {
+		return nil, nil
+	}
+
+	fields, ok := f.([]interface{})
+	if !ok {
+		return nil, errors.New("ID parameter list must be a list or NIL")
+	}
+	if len(fields)%2 != 0 {
+		return nil, errors.New("ID parameter list contains a field without a value")
+	}
+	if len(fields)/2 > idMaxFields {
+		return nil, errors.New("ID parameter list contains too many fields")
+	}
+
+	id := make(map[string]string, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		k, err := ParseString(fields[i])
+		if err != nil {
+			return nil, errors.New("ID field must be a string: " + err.Error())
+		}
+		if len(k) > idMaxFieldLength {
+			return nil, errors.New("ID field is too long")
+		}
+
+		if fields[i+1] == nil {
+			continue
+		}
+		v, err := ParseString(fields[i+1])
+		if err != nil {
+			return nil, errors.New("ID value must be a string or NIL: " + err.Error())
+		}
+		if len(v) > idMaxValueLength {
+			return nil, errors.New("ID value is too long")
+		}
+
+		id[k] = v
+	}
+	return id, nil
+}
+
+// FormatID formats an ID parameter list. A nil map is formatted as NIL.
+func FormatID(id map[string]string) interface{} {
+	if id == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(id))
+	for k := range id {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := make([]interface{}, 0, 2*len(keys))
+	for _, k := range keys {
+		fields = append(fields, k, id[k])
+	}
+	return fields
+}
@@ -11,3 +11,10 @@ type Literal interface {
 	// Len returns the number of bytes of the literal.
 	Len() int
 }
+
+// A literal8, as defined in RFC 3516 section 4.3. It is sent as ~{n} and may
+// contain any octet except NUL; RFC 6855 uses it to APPEND messages with UTF-8
+// headers.
+type Literal8 struct {
+	Literal
+}
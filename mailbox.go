@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/linanh/go-imap/utf7"
 )
@@ -68,6 +69,16 @@ const (
 	HasNoChildrenAttr = "\\HasNoChildren"
 )
 
+// Mailbox attributes defined in RFC 5258 (LIST-EXTENDED)
+const (
+	// The mailbox doesn't exist.
+	NonExistentAttr = "\\NonExistent"
+	// The mailbox is subscribed to.
+	SubscribedAttr = "\\Subscribed"
+	// The mailbox is a remote mailbox.
+	RemoteAttr = "\\Remote"
+)
+
 // This mailbox attribute is a signal that the mailbox contains messages that
 // are likely important to the user. This attribute is defined in RFC 8457
 // section 3.
@@ -85,6 +96,16 @@ type MailboxInfo struct {
 
 // Parse mailbox info from fields.
 func (info *MailboxInfo) Parse(fields []interface{}) error {
+	return info.parse(fields, false)
+}
+
+// ParseUTF8 is like Parse, but the mailbox name is expected to be raw UTF-8
+// (see RFC 6855).
+func (info *MailboxInfo) ParseUTF8(fields []interface{}) error {
+	return info.parse(fields, true)
+}
+
+func (info *MailboxInfo) parse(fields []interface{}, acceptUTF8 bool) error {
 	if len(fields) < 3 {
 		return errors.New("Mailbox info needs at least 3 fields")
 	}
@@ -105,7 +126,7 @@ func (info *MailboxInfo) Parse(fields []interface{}) error {
 
 	if name, err := ParseString(fields[2]); err != nil {
 		return err
-	} else if name, err := utf7.Encoding.NewDecoder().String(name); err != nil {
+	} else if name, err := DecodeMailboxName(name, acceptUTF8); err != nil {
 		return err
 	} else {
 		info.Name = CanonicalMailboxName(name)
@@ -116,7 +137,17 @@ func (info *MailboxInfo) Parse(fields []interface{}) error {
 
 // Format mailbox info to fields.
 func (info *MailboxInfo) Format() []interface{} {
-	name, _ := utf7.Encoding.NewEncoder().String(info.Name)
+	return info.format(false)
+}
+
+// FormatUTF8 is like Format, but the mailbox name is left as raw UTF-8 (see
+// RFC 6855).
+func (info *MailboxInfo) FormatUTF8() []interface{} {
+	return info.format(true)
+}
+
+func (info *MailboxInfo) format(acceptUTF8 bool) []interface{} {
+	name := EncodeMailboxName(info.Name, acceptUTF8)
 	attrs := make([]interface{}, len(info.Attributes))
 	for i, attr := range info.Attributes {
 		attrs[i] = RawString(attr)
@@ -304,6 +335,30 @@ func (status *MailboxStatus) Format() []interface{} {
 	return fields
 }
 
+// EncodeMailboxName encodes a mailbox name before sending it on the wire.
+// Mailbox names are encoded in modified UTF-7, unless acceptUTF8 is set
+// because UTF8=ACCEPT has been enabled, in which case they are sent as-is (see
+// RFC 6855 section 3).
+func EncodeMailboxName(name string, acceptUTF8 bool) string {
+	if acceptUTF8 {
+		return name
+	}
+	encoded, _ := utf7.Encoding.NewEncoder().String(name)
+	return encoded
+}
+
+// DecodeMailboxName decodes a mailbox name received on the wire. See
+// EncodeMailboxName.
+func DecodeMailboxName(name string, acceptUTF8 bool) (string, error) {
+	if acceptUTF8 {
+		if !utf8.ValidString(name) {
+			return "", errors.New("Mailbox name is not valid UTF-8")
+		}
+		return name, nil
+	}
+	return utf7.Encoding.NewDecoder().String(name)
+}
+
 func FormatMailboxName(name string) interface{} {
 	// Some e-mails servers don't handle quoted INBOX names correctly so we special-case it.
 	if strings.EqualFold(name, "INBOX") {
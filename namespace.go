@@ -0,0 +1,9 @@
+package imap
+
+// A namespace descriptor, as defined in RFC 2342 section 5.
+type NamespaceDescriptor struct {
+	// The prefix of mailboxes in this namespace.
+	Prefix string
+	// The hierarchy delimiter. Empty if there is no hierarchy.
+	Delimiter string
+}
@@ -14,6 +14,7 @@ const (
 	lf            = '\n'
 	dquote        = '"'
 	literalStart  = '{'
+	literal8Start = '~'
 	literalEnd    = '}'
 	listStart     = '('
 	listEnd       = ')'
@@ -297,6 +298,44 @@ func (r *Reader) ReadLiteral() (Literal, error) {
 	return NewCombinedBuf(r, int64(n))
 }
 
+// ReadLiteral8 reads a literal8, as defined in RFC 3516 section 4.3.
+func (r *Reader) ReadLiteral8() (Literal, error) {
+	char, _, err := r.ReadRune()
+	if err != nil {
+		return nil, err
+	} else if char != literal8Start {
+		return nil, newParseError("literal8 string doesn't start with a tilde")
+	}
+
+	return r.ReadLiteral()
+}
+
+// readLiteral8OrAtom reads either a literal8 or an atom starting with a tilde.
+func (r *Reader) readLiteral8OrAtom() (interface{}, error) {
+	if _, _, err := r.ReadRune(); err != nil {
+		return nil, err
+	}
+
+	char, _, err := r.ReadRune()
+	if err != nil {
+		return nil, err
+	}
+	r.UnreadRune()
+
+	if char == literalStart {
+		return r.ReadLiteral()
+	}
+
+	atom, err := r.ReadAtom()
+	if err != nil {
+		return nil, err
+	}
+	if atom == nil {
+		return string(literal8Start) + nilAtom, nil
+	}
+	return string(literal8Start) + atom.(string), nil
+}
+
 func (r *Reader) ReadQuotedString() (string, error) {
 	if char, _, err := r.ReadRune(); err != nil {
 		return "", err
@@ -350,6 +389,8 @@ func (r *Reader) ReadFields() (fields []interface{}, err error) {
 		switch char {
 		case literalStart:
 			field, err = r.ReadLiteral()
+		case literal8Start:
+			field, err = r.readLiteral8OrAtom()
 		case dquote:
 			field, err = r.ReadQuotedString()
 		case listStart:
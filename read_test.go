@@ -318,6 +318,24 @@ func TestReader_ReadLiteral(t *testing.T) {
 	}
 }
 
+func TestReader_ReadLiteral8(t *testing.T) {
+	b, r := newReader("~{7}\r\nabcdefg")
+	if literal, err := r.ReadLiteral8(); err != nil {
+		t.Error(err)
+	} else if contents, err := ioutil.ReadAll(literal); err != nil {
+		t.Error(err)
+	} else if string(contents) != "abcdefg" {
+		t.Error("Literal8 has not the expected value:", string(contents))
+	} else if b.Len() > 0 {
+		t.Error("Buffer is not empty after read")
+	}
+
+	_, r = newReader("{7}\r\nabcdefg")
+	if _, err := r.ReadLiteral8(); err == nil {
+		t.Error("Invalid read didn't fail")
+	}
+}
+
 func TestReader_ReadQuotedString(t *testing.T) {
 	b, r := newReader("\"hello gopher\"\r\n")
 	if s, err := r.ReadQuotedString(); err != nil {
@@ -380,6 +398,19 @@ func TestReader_ReadFields(t *testing.T) {
 		}
 	}
 
+	_, r = newReader("UTF8 (~{3}\r\nabc) ~user\r\n")
+	if fields, err := r.ReadFields(); err != nil {
+		t.Error(err)
+	} else if len(fields) != 3 {
+		t.Error("Expected 3 fields, but got", len(fields))
+	} else if list, ok := fields[1].([]interface{}); !ok || len(list) != 1 {
+		t.Error("Field 2 has not the expected value:", fields[1])
+	} else if _, ok := list[0].(imap.Literal); !ok {
+		t.Error("Field 2 does not contain a literal:", list[0])
+	} else if s, ok := fields[2].(string); !ok || s != "~user" {
+		t.Error("Field 3 has not the expected value:", fields[2])
+	}
+
 	_, r = newReader("")
 	if _, err := r.ReadFields(); err == nil {
 		t.Error("Invalid read didn't fail")
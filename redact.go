@@ -0,0 +1,344 @@
+package imap
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// DebugRedaction selects the data removed from debug output.
+type DebugRedaction int
+
+const (
+	// RedactCredentials removes LOGIN passwords and AUTHENTICATE responses.
+	RedactCredentials DebugRedaction = 1 << iota
+	// RedactBodies removes literals of APPEND commands and FETCH responses,
+	// which contain messages.
+	RedactBodies
+)
+
+// The text replacing redacted data.
+const redactedText = "[redacted]"
+
+// maxRedactLine is the maximum size of a line buffered by a redactWriter.
+// Longer lines are written unmodified.
+const maxRedactLine = 64 * 1024
+
+// A RedactWriter removes sensitive data from one direction of a debug stream.
+// It buffers lines to parse them, and streams literals.
+//
+// A RedactWriter can be paused, e.g. while the stream isn't captured. It then
+// follows commands and responses without parsing nor writing them, and output
+// resumes with the next command or response.
+type RedactWriter struct {
+	w         io.Writer
+	redaction DebugRedaction
+
+	line     []byte
+	out      []byte
+	overflow bool
+
+	// The command or response being written, which spans several lines if it
+	// contains literals.
+	continued bool
+	name      string
+	args      int
+
+	// The client is sending SASL responses.
+	authenticating bool
+
+	literal       int64
+	redactLiteral bool
+
+	// Output is paused, or will resume with the next command or response.
+	paused   bool
+	skipping bool
+}
+
+// NewRedactWriter creates a RedactWriter which removes the data selected by
+// redaction from one direction of a debug stream, and writes the rest to w.
+// The stream must start with a command or a response.
+func NewRedactWriter(w io.Writer, redaction DebugRedaction) *RedactWriter {
+	return &RedactWriter{w: w, redaction: redaction}
+}
+
+// SetPaused pauses or resumes output.
+func (w *RedactWriter) SetPaused(paused bool) {
+	w.paused = paused
+	if paused {
+		w.skipping = true
+	}
+}
+
+func (w *RedactWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if w.literal > 0 {
+			k := len(b)
+			if int64(k) > w.literal {
+				k = int(w.literal)
+			}
+			if !w.redactLiteral && !w.skipping {
+				if _, err := w.w.Write(b[:k]); err != nil {
+					return 0, err
+				}
+			}
+			w.literal -= int64(k)
+			b = b[k:]
+			continue
+		}
+
+		if len(w.line) == 0 && !w.continued && !w.overflow {
+			// A command or response starts
+			w.skipping = w.paused
+		}
+
+		i := bytes.IndexByte(b, '\n')
+		if w.overflow {
+			// Too long to be parsed: write the line as is
+			end := len(b)
+			if i >= 0 {
+				end = i + 1
+				w.overflow = false
+				w.continued = false
+			}
+			if !w.skipping {
+				if _, err := w.w.Write(b[:end]); err != nil {
+					return 0, err
+				}
+			}
+			b = b[end:]
+			continue
+		}
+		if i < 0 {
+			w.line = append(w.line, b...)
+			if len(w.line) > maxRedactLine {
+				w.overflow = true
+				var err error
+				if !w.skipping {
+					_, err = w.w.Write(w.line)
+				}
+				w.line = w.line[:0]
+				if err != nil {
+					return 0, err
+				}
+			}
+			break
+		}
+
+		w.line = append(w.line, b[:i+1]...)
+		b = b[i+1:]
+		if w.skipping {
+			w.skipLine()
+		} else if err := w.writeLine(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// redactArg checks if the argument at index i of the current command contains
+// credentials.
+func (w *RedactWriter) redactArg(i int) bool {
+	if w.redaction&RedactCredentials == 0 {
+		return false
+	}
+	return (w.name == "LOGIN" || w.name == "AUTHENTICATE") && i == 1
+}
+
+// redactBody checks if a literal at argument index i of the current command or
+// response contains a message.
+func (w *RedactWriter) redactBody(i int) bool {
+	if w.redaction&RedactBodies == 0 {
+		return false
+	}
+	return (w.name == "APPEND" && i >= 1) || w.name == "* FETCH"
+}
+
+func (w *RedactWriter) writeLine() error {
+	line := w.line
+	w.line = w.line[:0]
+
+	body := trimCRLF(line)
+	crlf := line[len(body):]
+
+	tokens := splitTokens(body)
+	out := w.out[:0]
+
+	i := 0
+	if !w.continued {
+		w.name, w.args = "", 0
+
+		if w.authenticating {
+			if bytes.IndexByte(body, ' ') < 0 {
+				// A SASL response
+				out = append(out, redactedText...)
+				out = append(out, crlf...)
+				w.out = out
+				_, err := w.w.Write(out)
+				return err
+			}
+			w.authenticating = false
+		}
+
+		if len(tokens) >= 3 && string(body[tokens[0][0]:tokens[0][1]]) == "*" &&
+			bytes.EqualFold(body[tokens[2][0]:tokens[2][1]], []byte("FETCH")) {
+			w.name, i = "* FETCH", 3
+		} else if len(tokens) >= 2 {
+			tag := string(body[tokens[0][0]:tokens[0][1]])
+			if tag != "*" && tag != "+" {
+				w.name, i = string(bytes.ToUpper(body[tokens[1][0]:tokens[1][1]])), 2
+				if w.name == "UID" && len(tokens) >= 3 {
+					w.name, i = string(bytes.ToUpper(body[tokens[2][0]:tokens[2][1]])), 3
+				}
+			}
+		}
+	}
+
+	literal := lineLiteral(body)
+
+	written := 0
+	redactLiteral := false
+	for ; i < len(tokens); i++ {
+		tok := tokens[i]
+		isLiteral := literal >= 0 && i == len(tokens)-1 && tok[1] == len(body)
+		if isLiteral {
+			redactLiteral = w.redactArg(w.args) || w.redactBody(w.args)
+		} else if w.redactArg(w.args) {
+			out = append(out, body[written:tok[0]]...)
+			out = append(out, redactedText...)
+			written = tok[1]
+		}
+		w.args++
+	}
+	if literal >= 0 && !redactLiteral && w.redactBody(w.args) {
+		// A literal nested in a list, e.g. in a FETCH response
+		redactLiteral = true
+	}
+	out = append(out, body[written:]...)
+	out = append(out, crlf...)
+
+	if literal >= 0 {
+		w.continued = true
+		w.literal = literal
+		w.redactLiteral = redactLiteral
+		if redactLiteral && literal > 0 {
+			out = append(out, redactedText...)
+		}
+	} else {
+		w.continued = false
+		if w.name == "AUTHENTICATE" && w.redaction&RedactCredentials != 0 {
+			w.authenticating = true
+		}
+	}
+
+	w.out = out
+	_, err := w.w.Write(out)
+	return err
+}
+
+// skipLine follows the current line without parsing nor writing it.
+func (w *RedactWriter) skipLine() {
+	body := trimCRLF(w.line)
+	w.line = w.line[:0]
+
+	if !w.continued {
+		w.name = ""
+		if w.authenticating {
+			if bytes.IndexByte(body, ' ') < 0 {
+				// A SASL response
+				return
+			}
+			w.authenticating = false
+		}
+
+		// Only commands starting authentication change the state
+		if i := bytes.IndexByte(body, ' '); i >= 0 {
+			name := body[i+1:]
+			if j := bytes.IndexByte(name, ' '); j >= 0 {
+				name = name[:j]
+			}
+			if bytes.EqualFold(name, []byte("AUTHENTICATE")) {
+				w.name = "AUTHENTICATE"
+			}
+		}
+	}
+
+	if literal := lineLiteral(body); literal >= 0 {
+		w.continued = true
+		w.literal = literal
+		w.redactLiteral = true
+	} else {
+		w.continued = false
+		if w.name == "AUTHENTICATE" && w.redaction&RedactCredentials != 0 {
+			w.authenticating = true
+		}
+	}
+}
+
+// trimCRLF removes the line ending of a line.
+func trimCRLF(line []byte) []byte {
+	end := len(line)
+	for end > 0 && (line[end-1] == '\n' || line[end-1] == '\r') {
+		end--
+	}
+	return line[:end]
+}
+
+// lineLiteral returns the size of a literal ending a line, possibly nested in
+// a list, or -1 if there is none.
+func lineLiteral(body []byte) int64 {
+	start := bytes.LastIndexByte(body, '{')
+	if start < 0 || body[len(body)-1] != '}' {
+		return -1
+	}
+	s := string(body[start+1 : len(body)-1])
+	if len(s) > 0 && s[len(s)-1] == '+' {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return -1
+	}
+	return int64(n)
+}
+
+// splitTokens returns the bounds of the space-separated tokens of a line.
+// Quoted strings and parenthesized lists are single tokens.
+func splitTokens(b []byte) [][2]int {
+	var tokens [][2]int
+	i := 0
+	for i < len(b) {
+		if b[i] == ' ' {
+			i++
+			continue
+		}
+
+		start := i
+		depth := 0
+		quoted := false
+	loop:
+		for ; i < len(b); i++ {
+			switch c := b[i]; {
+			case quoted && c == '\\':
+				i++
+			case c == '"':
+				quoted = !quoted
+			case quoted:
+			case c == '(':
+				depth++
+			case c == ')':
+				if depth > 0 {
+					depth--
+				}
+			case c == ' ' && depth == 0:
+				break loop
+			}
+		}
+		if i > len(b) {
+			i = len(b)
+		}
+		tokens = append(tokens, [2]int{start, i})
+	}
+	return tokens
+}
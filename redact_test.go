@@ -0,0 +1,115 @@
+package imap
+
+import (
+	"bytes"
+	"testing"
+)
+
+var redactTests = []struct {
+	redaction DebugRedaction
+	in        string
+	out       string
+}{
+	{
+		redaction: RedactCredentials,
+		in:        "a001 LOGIN username password\r\n",
+		out:       "a001 LOGIN username [redacted]\r\n",
+	},
+	{
+		redaction: RedactCredentials,
+		in:        "a001 login \"user name\" \"pass \\\" word\"\r\na002 NOOP\r\n",
+		out:       "a001 login \"user name\" [redacted]\r\na002 NOOP\r\n",
+	},
+	{
+		redaction: RedactCredentials,
+		in:        "a001 LOGIN {8}\r\nusername {8}\r\npassword\r\n",
+		out:       "a001 LOGIN {8}\r\nusername {8}\r\n[redacted]\r\n",
+	},
+	{
+		redaction: RedactCredentials,
+		in:        "a001 AUTHENTICATE PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n",
+		out:       "a001 AUTHENTICATE PLAIN [redacted]\r\n",
+	},
+	{
+		redaction: RedactCredentials,
+		in:        "a001 AUTHENTICATE PLAIN\r\nAHVzZXJuYW1lAHBhc3N3b3Jk\r\na002 SELECT INBOX\r\n",
+		out:       "a001 AUTHENTICATE PLAIN\r\n[redacted]\r\na002 SELECT INBOX\r\n",
+	},
+	{
+		redaction: RedactCredentials,
+		in:        "a001 APPEND INBOX {11}\r\nHello World\r\n",
+		out:       "a001 APPEND INBOX {11}\r\nHello World\r\n",
+	},
+	{
+		redaction: RedactBodies,
+		in:        "a001 APPEND INBOX (\\Seen) {11+}\r\nHello World\r\na002 LOGIN username password\r\n",
+		out:       "a001 APPEND INBOX (\\Seen) {11+}\r\n[redacted]\r\na002 LOGIN username password\r\n",
+	},
+	{
+		redaction: RedactBodies,
+		in:        "* 1 FETCH (UID 6 BODY[] {11}\r\nHello World BODY[HEADER.FIELDS (FROM)] {4}\r\nFrom)\r\n* 2 EXISTS\r\n",
+		out:       "* 1 FETCH (UID 6 BODY[] {11}\r\n[redacted] BODY[HEADER.FIELDS (FROM)] {4}\r\n[redacted])\r\n* 2 EXISTS\r\n",
+	},
+	{
+		redaction: RedactCredentials | RedactBodies,
+		in:        "* OK [CAPABILITY IMAP4rev1 AUTH=PLAIN] Ready\r\n+ \r\n",
+		out:       "* OK [CAPABILITY IMAP4rev1 AUTH=PLAIN] Ready\r\n+ \r\n",
+	},
+}
+
+func TestRedactWriter(t *testing.T) {
+	for _, test := range redactTests {
+		var b bytes.Buffer
+		w := NewRedactWriter(&b, test.redaction)
+		if _, err := w.Write([]byte(test.in)); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.out {
+			t.Errorf("Redacting %q: expected %q, got %q", test.in, test.out, b.String())
+		}
+
+		// Data can be written in any chunks
+		b.Reset()
+		w = NewRedactWriter(&b, test.redaction)
+		for i := 0; i < len(test.in); i++ {
+			w.Write([]byte{test.in[i]})
+		}
+		if b.String() != test.out {
+			t.Errorf("Redacting %q byte by byte: expected %q, got %q", test.in, test.out, b.String())
+		}
+	}
+}
+
+func TestRedactWriter_Paused(t *testing.T) {
+	tests := []struct {
+		paused, resumed, out string
+	}{
+		{
+			paused:  "a001 LOGIN {8}\r\nusername {8}\r\n",
+			resumed: "password\r\na002 NOOP\r\n",
+			out:     "a002 NOOP\r\n",
+		},
+		{
+			paused:  "a001 AUTHENTICATE PLAIN\r\n",
+			resumed: "AHVzZXJuYW1lAHBhc3N3b3Jk\r\na002 SELECT INBOX\r\n",
+			out:     "[redacted]\r\na002 SELECT INBOX\r\n",
+		},
+		{
+			paused:  "a001 NO",
+			resumed: "OP\r\na002 CHECK\r\n",
+			out:     "a002 CHECK\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		var b bytes.Buffer
+		w := NewRedactWriter(&b, RedactCredentials)
+		w.SetPaused(true)
+		w.Write([]byte(test.paused))
+		w.SetPaused(false)
+		w.Write([]byte(test.resumed))
+		if b.String() != test.out {
+			t.Errorf("Resuming with %q after %q: expected %q, got %q", test.resumed, test.paused, test.out, b.String())
+		}
+	}
+}
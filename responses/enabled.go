@@ -0,0 +1,37 @@
+package responses
+
+import (
+	"github.com/linanh/go-imap"
+)
+
+const enabledName = "ENABLED"
+
+// An ENABLED response.
+// See RFC 5161 section 3.2
+type Enabled struct {
+	Caps []string
+}
+
+func (r *Enabled) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != enabledName {
+		return ErrUnhandled
+	}
+
+	for _, f := range fields {
+		if c, ok := f.(string); ok {
+			r.Caps = append(r.Caps, c)
+		}
+	}
+
+	return nil
+}
+
+func (r *Enabled) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString(enabledName)}
+	for _, c := range r.Caps {
+		fields = append(fields, imap.RawString(c))
+	}
+
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
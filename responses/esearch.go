@@ -0,0 +1,142 @@
+package responses
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/linanh/go-imap"
+)
+
+const esearchName = "ESEARCH"
+
+// An ESEARCH response.
+// See RFC 4731 section 3.1
+type ESearch struct {
+	// The tag of the command this response is associated with.
+	Tag string
+	// Whether the results are UIDs instead of sequence numbers.
+	Uid bool
+	// The requested return options. If empty, only ALL is returned. This is only
+	// used when writing the response.
+	Return []string
+
+	Min, Max, Count uint32
+	All             *imap.SeqSet
+}
+
+// Ids returns the list of message IDs included in the ALL result.
+func (r *ESearch) Ids() []uint32 {
+	if r.All == nil {
+		return nil
+	}
+
+	var ids []uint32
+	for _, seq := range r.All.Set {
+		for id := seq.Start; id <= seq.Stop && id != 0; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (r *ESearch) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != esearchName {
+		return ErrUnhandled
+	}
+
+	// Parse search correlator
+	if len(fields) > 0 {
+		if list, ok := fields[0].([]interface{}); ok {
+			if len(list) != 2 {
+				return errors.New("Invalid ESEARCH correlator")
+			}
+			if tag, err := imap.ParseString(list[1]); err != nil {
+				return err
+			} else {
+				r.Tag = tag
+			}
+			fields = fields[1:]
+		}
+	}
+
+	if len(fields) > 0 {
+		if s, ok := fields[0].(string); ok && strings.EqualFold(s, "UID") {
+			r.Uid = true
+			fields = fields[1:]
+		}
+	}
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		key, ok := fields[i].(string)
+		if !ok {
+			return errors.New("ESEARCH return data name must be an atom")
+		}
+
+		switch strings.ToUpper(key) {
+		case "MIN", "MAX", "COUNT":
+			n, err := imap.ParseNumber(fields[i+1])
+			if err != nil {
+				return err
+			}
+			switch strings.ToUpper(key) {
+			case "MIN":
+				r.Min = n
+			case "MAX":
+				r.Max = n
+			case "COUNT":
+				r.Count = n
+			}
+		case "ALL":
+			s, ok := fields[i+1].(string)
+			if !ok {
+				return errors.New("ESEARCH ALL must be a sequence set")
+			}
+			seqSet, err := imap.ParseSeqSet(s)
+			if err != nil {
+				return err
+			}
+			r.All = seqSet
+		}
+	}
+
+	return nil
+}
+
+func (r *ESearch) returns(opt string) bool {
+	if len(r.Return) == 0 {
+		return opt == "ALL"
+	}
+	for _, o := range r.Return {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ESearch) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString(esearchName)}
+	if r.Tag != "" {
+		fields = append(fields, []interface{}{imap.RawString("TAG"), r.Tag})
+	}
+	if r.Uid {
+		fields = append(fields, imap.RawString("UID"))
+	}
+
+	empty := r.All == nil || r.All.Empty()
+	if r.returns("MIN") && !empty {
+		fields = append(fields, imap.RawString("MIN"), r.Min)
+	}
+	if r.returns("MAX") && !empty {
+		fields = append(fields, imap.RawString("MAX"), r.Max)
+	}
+	if r.returns("ALL") && !empty {
+		fields = append(fields, imap.RawString("ALL"), r.All)
+	}
+	if r.returns("COUNT") {
+		fields = append(fields, imap.RawString("COUNT"), r.Count)
+	}
+
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
@@ -0,0 +1,35 @@
+package responses
+
+import (
+	"github.com/linanh/go-imap"
+)
+
+const idName = "ID"
+
+// An ID response.
+// See RFC 2971 section 3.2
+type ID struct {
+	// The server identification. If nil, NIL is sent.
+	Params map[string]string
+}
+
+func (r *ID) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != idName {
+		return ErrUnhandled
+	} else if len(fields) < 1 {
+		return errNotEnoughFields
+	}
+
+	id, err := imap.ParseID(fields[0])
+	if err != nil {
+		return err
+	}
+	r.Params = id
+	return nil
+}
+
+func (r *ID) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString(idName), imap.FormatID(r.Params)}
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
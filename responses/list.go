@@ -12,9 +12,13 @@ const (
 // A LIST response.
 // If Subscribed is set to true, LSUB will be used instead.
 // See RFC 3501 section 7.2.2
+//
+// If UTF8 is set, mailbox names are raw UTF-8 instead of modified UTF-7 (see
+// RFC 6855).
 type List struct {
 	Mailboxes  chan *imap.MailboxInfo
 	Subscribed bool
+	UTF8       bool
 }
 
 func (r *List) Name() string {
@@ -32,7 +36,13 @@ func (r *List) Handle(resp imap.Resp) error {
 	}
 
 	mbox := &imap.MailboxInfo{}
-	if err := mbox.Parse(fields); err != nil {
+	var err error
+	if r.UTF8 {
+		err = mbox.ParseUTF8(fields)
+	} else {
+		err = mbox.Parse(fields)
+	}
+	if err != nil {
 		return err
 	}
 
@@ -45,7 +55,11 @@ func (r *List) WriteTo(w *imap.Writer) error {
 
 	for mbox := range r.Mailboxes {
 		fields := []interface{}{imap.RawString(respName)}
-		fields = append(fields, mbox.Format()...)
+		if r.UTF8 {
+			fields = append(fields, mbox.FormatUTF8()...)
+		} else {
+			fields = append(fields, mbox.Format()...)
+		}
 
 		resp := imap.NewUntaggedResp(fields)
 		if err := resp.WriteTo(w); err != nil {
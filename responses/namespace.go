@@ -0,0 +1,96 @@
+package responses
+
+import (
+	"errors"
+
+	"github.com/linanh/go-imap"
+)
+
+const namespaceName = "NAMESPACE"
+
+// A NAMESPACE response.
+// See RFC 2342 section 5
+type Namespace struct {
+	Personal []imap.NamespaceDescriptor
+	Other    []imap.NamespaceDescriptor
+	Shared   []imap.NamespaceDescriptor
+}
+
+func parseNamespace(f interface{}) ([]imap.NamespaceDescriptor, error) {
+	if f == nil {
+		return nil, nil
+	}
+
+	list, ok := f.([]interface{})
+	if !ok {
+		return nil, errors.New("Namespace must be a list or NIL")
+	}
+
+	descs := make([]imap.NamespaceDescriptor, 0, len(list))
+	for _, item := range list {
+		fields, ok := item.([]interface{})
+		if !ok || len(fields) < 2 {
+			return nil, errors.New("Invalid namespace descriptor")
+		}
+
+		var desc imap.NamespaceDescriptor
+		var err error
+		if desc.Prefix, err = imap.ParseString(fields[0]); err != nil {
+			return nil, err
+		}
+		if fields[1] != nil {
+			if desc.Delimiter, err = imap.ParseString(fields[1]); err != nil {
+				return nil, err
+			}
+		}
+		descs = append(descs, desc)
+	}
+	return descs, nil
+}
+
+func formatNamespace(descs []imap.NamespaceDescriptor) interface{} {
+	if len(descs) == 0 {
+		return nil
+	}
+
+	fields := make([]interface{}, len(descs))
+	for i, desc := range descs {
+		var delim interface{}
+		if desc.Delimiter != "" {
+			delim = desc.Delimiter
+		}
+		fields[i] = []interface{}{desc.Prefix, delim}
+	}
+	return fields
+}
+
+func (r *Namespace) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != namespaceName {
+		return ErrUnhandled
+	} else if len(fields) < 3 {
+		return errNotEnoughFields
+	}
+
+	var err error
+	if r.Personal, err = parseNamespace(fields[0]); err != nil {
+		return err
+	}
+	if r.Other, err = parseNamespace(fields[1]); err != nil {
+		return err
+	}
+	if r.Shared, err = parseNamespace(fields[2]); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *Namespace) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{
+		imap.RawString(namespaceName),
+		formatNamespace(r.Personal),
+		formatNamespace(r.Other),
+		formatNamespace(r.Shared),
+	}
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
@@ -8,12 +8,23 @@ const searchName = "SEARCH"
 
 // A SEARCH response.
 // See RFC 3501 section 7.2.5
+//
+// ESEARCH responses (see RFC 4731) are also handled, so that results returned
+// by IMAP4rev2 servers are collected in Ids.
 type Search struct {
 	Ids []uint32
 }
 
 func (r *Search) Handle(resp imap.Resp) error {
 	name, fields, ok := imap.ParseNamedResp(resp)
+	if ok && name == esearchName {
+		res := &ESearch{}
+		if err := res.Handle(resp); err != nil {
+			return err
+		}
+		r.Ids = res.Ids()
+		return nil
+	}
 	if !ok || name != searchName {
 		return ErrUnhandled
 	}
@@ -4,15 +4,18 @@ import (
 	"errors"
 
 	"github.com/linanh/go-imap"
-	"github.com/linanh/go-imap/utf7"
 )
 
 const statusName = "STATUS"
 
 // A STATUS response.
 // See RFC 3501 section 7.2.4
+//
+// If UTF8 is set, the mailbox name is raw UTF-8 instead of modified UTF-7 (see
+// RFC 6855).
 type Status struct {
 	Mailbox *imap.MailboxStatus
+	UTF8    bool
 }
 
 func (r *Status) Handle(resp imap.Resp) error {
@@ -30,7 +33,7 @@ func (r *Status) Handle(resp imap.Resp) error {
 
 	if name, err := imap.ParseString(fields[0]); err != nil {
 		return err
-	} else if name, err := utf7.Encoding.NewDecoder().String(name); err != nil {
+	} else if name, err := imap.DecodeMailboxName(name, r.UTF8); err != nil {
 		return err
 	} else {
 		mbox.Name = imap.CanonicalMailboxName(name)
@@ -47,7 +50,7 @@ func (r *Status) Handle(resp imap.Resp) error {
 
 func (r *Status) WriteTo(w *imap.Writer) error {
 	mbox := r.Mailbox
-	name, _ := utf7.Encoding.NewEncoder().String(mbox.Name)
+	name := imap.EncodeMailboxName(mbox.Name, r.UTF8)
 	fields := []interface{}{imap.RawString(statusName), imap.FormatMailboxName(name), mbox.Format()}
 	return imap.NewUntaggedResp(fields).WriteTo(w)
 }
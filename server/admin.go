@@ -0,0 +1,262 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+)
+
+// SessionInfo describes a connection to the server.
+type SessionInfo struct {
+	// The connection, e.g. to close it.
+	Conn Conn
+	// The authenticated user, empty if the client hasn't authenticated yet.
+	Username string
+	// The client's address.
+	RemoteAddr net.Addr
+	// The connection state.
+	State imap.ConnState
+	// The selected mailbox, empty if none.
+	Mailbox string
+	// The time the connection has been accepted.
+	Started time.Time
+	// The time elapsed since the last command, or since the connection has been
+	// accepted if the client hasn't sent any command.
+	Idle time.Duration
+	// The TLS connection state, nil if the connection isn't encrypted.
+	TLS *tls.ConnectionState
+	// The name of the listener the connection has been accepted on.
+	Listener string
+	// The domain of the tenant the client has authenticated to, empty if none.
+	Tenant string
+}
+
+// session is a snapshot of the state of a connection. The Context of a
+// connection may only be accessed by its goroutine, other goroutines read the
+// snapshot instead.
+type session struct {
+	State    imap.ConnState
+	Username string
+	Mailbox  string
+	Tenant   *Tenant
+	Info     *imap.ConnInfo
+}
+
+// sessionSnapshot holds the last snapshot of a connection's state.
+type sessionSnapshot struct {
+	locker sync.Mutex
+	s      session
+}
+
+func (ss *sessionSnapshot) load() session {
+	ss.locker.Lock()
+	defer ss.locker.Unlock()
+	return ss.s
+}
+
+func (ss *sessionSnapshot) store(s session) {
+	ss.locker.Lock()
+	ss.s = s
+	ss.locker.Unlock()
+}
+
+// updateSession updates the snapshot of the connection's state. It must be
+// called by the connection's goroutine after the state has changed.
+func (c *conn) updateSession() {
+	s := session{
+		State:  c.ctx.State,
+		Tenant: c.ctx.Tenant,
+		Info:   c.Info(),
+	}
+	if c.ctx.User != nil {
+		s.Username = c.ctx.User.Username()
+	}
+	if c.ctx.Mailbox != nil {
+		s.Mailbox = c.ctx.Mailbox.Name()
+		if s.State == imap.AuthenticatedState {
+			s.State = imap.SelectedState
+		}
+	}
+	c.snapshot.store(s)
+	c.updateDebugUser(s.Username)
+}
+
+func (c *conn) session() session {
+	return c.snapshot.load()
+}
+
+// activity records the time of the last command of a connection, and whether
+// a command is being received or handled.
+type activity struct {
+	started time.Time
+
+	// Accessed atomically
+	last      int64 // Unix time in nanoseconds
+	handling  int32
+	receiving int32
+	waiting   int32
+}
+
+// begin is called when a command has been read.
+func (a *activity) begin() {
+	atomic.AddInt32(&a.handling, 1)
+	atomic.StoreInt32(&a.receiving, 0)
+	atomic.StoreInt32(&a.waiting, 0)
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// end is called when a command has been handled.
+func (a *activity) end() {
+	atomic.AddInt32(&a.handling, -1)
+	atomic.StoreInt32(&a.waiting, 0)
+}
+
+// receive is called when data is read from the connection.
+func (a *activity) receive() {
+	atomic.StoreInt32(&a.receiving, 1)
+	atomic.StoreInt32(&a.waiting, 0)
+}
+
+// wait is called when a command handler sends a continuation request, e.g.
+// IDLE. The command then waits for the client, which may take a long time.
+func (a *activity) wait() {
+	atomic.StoreInt32(&a.waiting, 1)
+}
+
+// busy checks if a command is being received or handled. A command waiting for
+// the client isn't busy.
+func (a *activity) busy() bool {
+	if a.waitingClient() {
+		return false
+	}
+	return atomic.LoadInt32(&a.handling) > 0 || atomic.LoadInt32(&a.receiving) > 0
+}
+
+// waitingClient checks if a command handler is waiting for the client.
+func (a *activity) waitingClient() bool {
+	return atomic.LoadInt32(&a.waiting) > 0 && atomic.LoadInt32(&a.handling) > 0
+}
+
+func (a *activity) idle(now time.Time) time.Duration {
+	last := atomic.LoadInt64(&a.last)
+	if last == 0 {
+		return now.Sub(a.started)
+	}
+	return now.Sub(time.Unix(0, last))
+}
+
+// Sessions returns information about the connections to the server.
+func (s *Server) Sessions() []SessionInfo {
+	now := time.Now()
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(s.conns))
+	for conn := range s.conns {
+		snapshot := conn.session()
+		a := conn.activity()
+
+		session := SessionInfo{
+			Conn:     conn,
+			Username: snapshot.Username,
+			State:    snapshot.State,
+			Mailbox:  snapshot.Mailbox,
+			Started:  a.started,
+			Idle:     a.idle(now),
+			Listener: conn.ListenerConfig().Name,
+		}
+		if snapshot.Info != nil {
+			session.RemoteAddr = snapshot.Info.RemoteAddr
+			session.TLS = snapshot.Info.TLS
+		}
+		if snapshot.Tenant != nil {
+			session.Tenant = snapshot.Tenant.Domain()
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// userConns returns the connections of a user, or all connections if username
+// is empty. The server must be locked.
+func (s *Server) userConns(username string) []Conn {
+	var conns []Conn
+	for conn := range s.conns {
+		if username != "" && conn.session().Username != username {
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Alert sends an [ALERT] response to the connections of a user, or to all
+// connections if username is empty. It returns the number of connections the
+// alert has been sent to.
+func (s *Server) Alert(username, text string) int {
+	max := s.MaxQueuedUpdates
+	if max <= 0 {
+		max = DefaultMaxQueuedUpdates
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	n := 0
+	for _, conn := range s.userConns(username) {
+		update := &backend.StatusUpdate{
+			Update: backend.NewUpdate(username, ""),
+			StatusResp: &imap.StatusResp{
+				Type: imap.StatusRespOk,
+				Code: imap.CodeAlert,
+				Info: text,
+			},
+		}
+		// Alerts are queued like updates, to be written between responses
+		_, ok, overflowed := conn.updateQueue().push(conn, update, nil, max)
+		if overflowed {
+			s.queueStats.Overflows++
+			go closeWithBye(conn, "Too many pending updates, closing connection")
+		}
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Logout closes the connections of a user, or all connections if username is
+// empty, after sending a BYE response with reason. It returns the number of
+// closed connections.
+func (s *Server) Logout(username, reason string) int {
+	s.locker.Lock()
+	conns := s.userConns(username)
+	s.locker.Unlock()
+
+	for _, conn := range conns {
+		go closeWithBye(conn, reason)
+	}
+	return len(conns)
+}
+
+// SetDraining enables or disables drain mode. In drain mode, LOGIN and
+// AUTHENTICATE fail with ErrServerDraining, while authenticated connections
+// are left open.
+func (s *Server) SetDraining(draining bool) {
+	s.locker.Lock()
+	s.draining = draining
+	s.locker.Unlock()
+}
+
+// Draining checks if the server is in drain mode.
+func (s *Server) Draining() bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.draining
+}
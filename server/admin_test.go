@@ -0,0 +1,117 @@
+package server_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/linanh/go-imap"
+)
+
+func TestServer_Admin(t *testing.T) {
+	s, c := testServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	expectTagged(t, scanner, "a002")
+
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan() // Greeting
+
+	sessions := s.Sessions()
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %v", len(sessions))
+	}
+	for _, session := range sessions {
+		if session.Started.IsZero() || session.Idle <= 0 || session.TLS != nil {
+			t.Errorf("Invalid session: %+v", session)
+		}
+		if session.Username == "" {
+			if session.State != imap.NotAuthenticatedState {
+				t.Errorf("Invalid state for an unauthenticated session: %v", session.State)
+			}
+			continue
+		}
+		if session.Username != "username" || session.State != imap.SelectedState || session.Mailbox != "INBOX" {
+			t.Errorf("Invalid authenticated session: %+v", session)
+		}
+	}
+
+	if n := s.Alert("username", "Maintenance in 5 minutes"); n != 1 {
+		t.Fatalf("Expected the alert to be sent to 1 session, got %v", n)
+	}
+	expectLines(t, scanner, "* OK [ALERT] Maintenance in 5 minutes")
+
+	s.SetDraining(true)
+	io.WriteString(c2, "b001 LOGIN username password\r\n")
+	expectLines(t, scanner2, "b001 NO [UNAVAILABLE] Server is shutting down, try again later")
+
+	// Existing sessions continue
+	io.WriteString(c, "a003 NOOP\r\n")
+	expectLines(t, scanner, "a003 OK NOOP completed")
+
+	if n := s.Logout("username", "Logged out by an administrator"); n != 1 {
+		t.Fatalf("Expected 1 session to be logged out, got %v", n)
+	}
+	expectLines(t, scanner, "* BYE Logged out by an administrator")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if scanner.Scan() {
+		t.Fatalf("Expected the connection to be closed, got %q", scanner.Text())
+	}
+}
+
+func TestServer_SessionsWhileLoggingIn(t *testing.T) {
+	s, c := testServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(c)
+		scanner.Scan() // Greeting
+		io.WriteString(c, "a001 LOGIN username password\r\n")
+		expectTagged(t, scanner, "a001")
+		io.WriteString(c, "a002 SELECT INBOX\r\n")
+		expectTagged(t, scanner, "a002")
+		io.WriteString(c, "a003 UNSELECT\r\n")
+		expectTagged(t, scanner, "a003")
+	}()
+
+	// Sessions may be listed while the connection changes state
+	for {
+		for _, session := range s.Sessions() {
+			if session.Username != "" && session.Username != "username" {
+				t.Errorf("Invalid session: %+v", session)
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
+
+func expectTagged(t *testing.T, scanner *bufio.Scanner, tag string) {
+	t.Helper()
+	for scanner.Scan() {
+		if len(scanner.Text()) > len(tag) && scanner.Text()[:len(tag)+1] == tag+" " {
+			return
+		}
+	}
+	t.Fatalf("No response for %v", tag)
+}
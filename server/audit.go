@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/linanh/go-imap"
+)
+
+// An AuditEvent records an operation on mailboxes or messages.
+type AuditEvent struct {
+	// The time the command has been received.
+	Time time.Time `json:"time"`
+	// The authenticated user.
+	Username string `json:"username,omitempty"`
+	// The client's address.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// The command name, e.g. STORE or UID STORE.
+	Command string `json:"command"`
+	// The mailbox the command operates on: the selected mailbox, or the mailbox
+	// argument of SELECT, APPEND, CREATE, DELETE and RENAME.
+	Mailbox string `json:"mailbox,omitempty"`
+	// The destination mailbox of COPY, MOVE and RENAME.
+	Target string `json:"target,omitempty"`
+	// The UIDs of the affected messages. For APPEND, it is only known if the
+	// backend returns the UID of the new message.
+	Uids []uint32 `json:"uids,omitempty"`
+	// The type of the tagged response, e.g. OK or NO.
+	Result imap.StatusRespType `json:"result"`
+	// The error returned by the command, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// An AuditSink records audit events. Audit is called concurrently, after each
+// audited command: SELECT, EXAMINE, FETCH of message bodies, STORE, COPY,
+// MOVE, EXPUNGE, CLOSE, APPEND, CREATE, DELETE and RENAME.
+type AuditSink interface {
+	Audit(ev *AuditEvent) error
+}
+
+// JSONAuditLog is an AuditSink writing events as JSON objects, one per line.
+type JSONAuditLog struct {
+	locker sync.Mutex
+	w      io.Writer
+	enc    *json.Encoder
+}
+
+// NewJSONAuditLog creates an audit log writing to w.
+func NewJSONAuditLog(w io.Writer) *JSONAuditLog {
+	return &JSONAuditLog{w: w, enc: json.NewEncoder(w)}
+}
+
+// OpenJSONAuditLog opens an audit log file. Events are appended to the file if
+// it already exists.
+func OpenJSONAuditLog(path string) (*JSONAuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONAuditLog(f), nil
+}
+
+func (l *JSONAuditLog) Audit(ev *AuditEvent) error {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	return l.enc.Encode(ev)
+}
+
+// Close closes the underlying writer, if it implements io.Closer.
+func (l *JSONAuditLog) Close() error {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	if closer, ok := l.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// auditEvent returns the audit event of a command about to be handled, or nil
+// if the command isn't audited. UIDs of the affected messages are resolved
+// before the command changes them.
+func (c *conn) auditEvent(cmd *imap.Command, hdlr Handler) *AuditEvent {
+	ctx := c.Context()
+
+	ev := &AuditEvent{
+		Time:    time.Now(),
+		Command: cmd.Name,
+	}
+	if ctx.User != nil {
+		ev.Username = ctx.User.Username()
+	}
+	if addr := c.Info().RemoteAddr; addr != nil {
+		ev.RemoteAddr = addr.String()
+	}
+	if ctx.Mailbox != nil {
+		ev.Mailbox = ctx.Mailbox.Name()
+	}
+
+	uid := false
+	if u, ok := hdlr.(*Uid); ok {
+		inner := u.Cmd.Command()
+		var err error
+		if hdlr, err = c.commandHandler(inner); err != nil {
+			return nil
+		}
+		uid = true
+		ev.Command = "UID " + inner.Name
+	}
+
+	switch hdlr := hdlr.(type) {
+	case *Select:
+		ev.Mailbox = hdlr.Mailbox
+	case *Fetch:
+		if !fetchesBody(hdlr.Items) {
+			return nil
+		}
+		ev.Uids = c.auditUids(uid, hdlr.SeqSet, nil)
+	case *Store:
+		ev.Uids = c.auditUids(uid, hdlr.SeqSet, nil)
+	case *Copy:
+		ev.Target = hdlr.Mailbox
+		ev.Uids = c.auditUids(uid, hdlr.SeqSet, nil)
+	case *Move:
+		ev.Target = hdlr.Mailbox
+		ev.Uids = c.auditUids(uid, hdlr.SeqSet, nil)
+	case *Expunge:
+		seqset := hdlr.SeqSet
+		if seqset == nil {
+			seqset, _ = imap.ParseSeqSet("1:*")
+		}
+		ev.Uids = c.auditUids(uid, seqset, []string{imap.DeletedFlag})
+	case *Close:
+		// CLOSE expunges deleted messages
+		seqset, _ := imap.ParseSeqSet("1:*")
+		ev.Uids = c.auditUids(false, seqset, []string{imap.DeletedFlag})
+	case *Append:
+		ev.Mailbox = hdlr.Mailbox
+	case *Create:
+		ev.Mailbox = hdlr.Mailbox
+	case *Delete:
+		ev.Mailbox = hdlr.Mailbox
+	case *Rename:
+		ev.Mailbox = hdlr.Existing
+		ev.Target = hdlr.New
+	default:
+		return nil
+	}
+	return ev
+}
+
+// auditUids returns the UIDs of the messages of the selected mailbox in seqset
+// having all of flags.
+func (c *conn) auditUids(uid bool, seqset *imap.SeqSet, flags []string) []uint32 {
+	ctx := c.Context()
+	if ctx.Mailbox == nil || seqset == nil {
+		return nil
+	}
+
+	uid, seqset = sessionSeqSet(c.conn, uid, seqset)
+	criteria := &imap.SearchCriteria{WithFlags: flags}
+	if uid {
+		criteria.Uid = seqset
+	} else {
+		criteria.SeqNum = seqset
+	}
+
+	uids, _, err := ctx.Mailbox.SearchMessages(true, criteria, nil)
+	if err != nil {
+		c.s.ErrorLog.Println("cannot resolve UIDs for audit event:", err)
+		return nil
+	}
+	return uids
+}
+
+// fetchesBody checks if FETCH items access message contents.
+func fetchesBody(items []imap.FetchItem) bool {
+	for _, item := range items {
+		// Also matches RFC822, RFC822.HEADER and RFC822.TEXT
+		if _, err := imap.ParseBodySectionName(item); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// audit completes an audit event with the result of its command, and sends it
+// to the server's AuditSink.
+func (c *conn) audit(ev *AuditEvent, res *imap.StatusResp, err error) {
+	if res != nil {
+		ev.Result = res.Type
+		if res.Code == "APPENDUID" && len(res.Arguments) == 2 {
+			if uid, ok := res.Arguments[1].(uint32); ok {
+				ev.Uids = []uint32{uid}
+			}
+		}
+	}
+	if err != nil && (res == nil || res.Type != imap.StatusRespOk) {
+		ev.Error = err.Error()
+	}
+
+	if err := c.s.Audit.Audit(ev); err != nil {
+		c.s.ErrorLog.Println("cannot write audit event:", err)
+	}
+}
@@ -0,0 +1,97 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/server"
+)
+
+type lockedBuffer struct {
+	locker sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return b.buf.String()
+}
+
+func TestJSONAuditLog(t *testing.T) {
+	var b lockedBuffer
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.Audit = server.NewJSONAuditLog(&b)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	for _, cmd := range []string{
+		"LOGIN username password",
+		"CREATE Archive",
+		"SELECT INBOX",
+		"FETCH 1 (FLAGS)",
+		"FETCH 1 (BODY.PEEK[])",
+		"UID COPY 6 Archive",
+		"STORE 1 +FLAGS (\\Deleted)",
+		"EXPUNGE",
+		"SELECT Archive",
+		"STORE 1 +FLAGS (\\Deleted)",
+		"CLOSE",
+		"RENAME Archive Old",
+		"DELETE idontexist",
+	} {
+		io.WriteString(c, "a "+cmd+"\r\n")
+		for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "a ") {
+		}
+	}
+
+	expected := []server.AuditEvent{
+		{Command: "CREATE", Mailbox: "Archive", Result: imap.StatusRespOk},
+		{Command: "SELECT", Mailbox: "INBOX", Result: imap.StatusRespOk},
+		{Command: "FETCH", Mailbox: "INBOX", Uids: []uint32{6}, Result: imap.StatusRespOk},
+		{Command: "UID COPY", Mailbox: "INBOX", Target: "Archive", Uids: []uint32{6}, Result: imap.StatusRespOk},
+		{Command: "STORE", Mailbox: "INBOX", Uids: []uint32{6}, Result: imap.StatusRespOk},
+		{Command: "EXPUNGE", Mailbox: "INBOX", Uids: []uint32{6}, Result: imap.StatusRespOk},
+		{Command: "SELECT", Mailbox: "Archive", Result: imap.StatusRespOk},
+		{Command: "STORE", Mailbox: "Archive", Uids: []uint32{1}, Result: imap.StatusRespOk},
+		{Command: "CLOSE", Mailbox: "Archive", Uids: []uint32{1}, Result: imap.StatusRespOk},
+		{Command: "RENAME", Mailbox: "Archive", Target: "Old", Result: imap.StatusRespOk},
+		{Command: "DELETE", Mailbox: "idontexist", Result: imap.StatusRespNo, Error: "No such mailbox"},
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %v events, got:\n%v", len(expected), b.String())
+	}
+	for i, line := range lines {
+		var ev server.AuditEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("Invalid event %q: %v", line, err)
+		}
+		if ev.Username != "username" || !strings.HasPrefix(ev.RemoteAddr, "127.0.0.1:") || ev.Time.IsZero() {
+			t.Errorf("Invalid event %q", line)
+		}
+		ev.Username, ev.RemoteAddr, ev.Time = "", "", expected[i].Time
+		if !reflect.DeepEqual(ev, expected[i]) {
+			t.Errorf("Expected event %+v, got %+v", expected[i], ev)
+		}
+	}
+}
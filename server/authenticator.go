@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+)
+
+// An Authenticator checks a username and a password. It decouples the
+// authentication policy from the mail storage: once a user is authenticated,
+// the backend only needs to look it up by name (see backend.UserGetter).
+type Authenticator interface {
+	// Authenticate checks the credentials of a user and returns the name of
+	// the authenticated user, which may differ from username (e.g. with
+	// master users). If the credentials are incorrect, it returns
+	// backend.ErrInvalidCredentials.
+	Authenticate(conn Conn, username, password string) (string, error)
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as
+// Authenticator.
+type AuthenticatorFunc func(conn Conn, username, password string) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(conn Conn, username, password string) (string, error) {
+	return f(conn, username, password)
+}
+
+// AuthenticatorChain tries each Authenticator in order, until one of them
+// accepts the credentials. An error other than backend.ErrInvalidCredentials
+// stops the chain.
+type AuthenticatorChain []Authenticator
+
+func (chain AuthenticatorChain) Authenticate(conn Conn, username, password string) (string, error) {
+	for _, auth := range chain {
+		name, err := auth.Authenticate(conn, username, password)
+		if errors.Is(err, backend.ErrInvalidCredentials) {
+			continue
+		}
+		return name, err
+	}
+	return "", backend.ErrInvalidCredentials
+}
+
+// StaticAuthenticator authenticates users with a fixed map of usernames to
+// cleartext passwords.
+type StaticAuthenticator map[string]string
+
+func (m StaticAuthenticator) Authenticate(conn Conn, username, password string) (string, error) {
+	expected, ok := m[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		return "", backend.ErrInvalidCredentials
+	}
+	return username, nil
+}
+
+// HtpasswdAuthenticator authenticates users with an Apache htpasswd file.
+//
+// MD5 ("$apr1$", the default of htpasswd) and SHA-1 ("{SHA}") hashes are
+// supported out of the box. Since the standard library doesn't implement
+// bcrypt, bcrypt hashes ("$2y$", "$2a$" and "$2b$") are checked with
+// CompareBcrypt, which can be set to
+// golang.org/x/crypto/bcrypt.CompareHashAndPassword.
+//
+// Users with unsupported hashes cannot log in: they are rejected like invalid
+// credentials, so that clients can't tell whether they exist, and the hash is
+// reported to ErrorLog.
+type HtpasswdAuthenticator struct {
+	// CompareBcrypt compares a bcrypt hash with a password, and returns nil on
+	// success. If nil, users with bcrypt hashes cannot log in.
+	CompareBcrypt func(hash, password []byte) error
+	// ErrorLog logs unsupported hashes. If nil, the server's ErrorLog is used.
+	ErrorLog imap.Logger
+
+	users map[string]string
+}
+
+// ParseHtpasswd parses an htpasswd file.
+func ParseHtpasswd(r io.Reader) (*HtpasswdAuthenticator, error) {
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, errors.New("Malformed htpasswd line")
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &HtpasswdAuthenticator{users: users}, nil
+}
+
+// LoadHtpasswd reads an htpasswd file from the filesystem.
+func LoadHtpasswd(path string) (*HtpasswdAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseHtpasswd(f)
+}
+
+func (h *HtpasswdAuthenticator) Authenticate(conn Conn, username, password string) (string, error) {
+	hash, ok := h.users[username]
+	if !ok {
+		return "", backend.ErrInvalidCredentials
+	}
+
+	switch {
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := hash[len(apr1Magic):]
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(apr1Crypt(password, salt))) != 1 {
+			return "", backend.ErrInvalidCredentials
+		}
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		encoded := base64.StdEncoding.EncodeToString(sum[:])
+		if subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(encoded)) != 1 {
+			return "", backend.ErrInvalidCredentials
+		}
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		if h.CompareBcrypt == nil {
+			h.logUnsupported(conn, username, "bcrypt hash without CompareBcrypt")
+			return "", backend.ErrInvalidCredentials
+		}
+		if err := h.CompareBcrypt([]byte(hash), []byte(password)); err != nil {
+			return "", backend.ErrInvalidCredentials
+		}
+	default:
+		h.logUnsupported(conn, username, "unsupported hash")
+		return "", backend.ErrInvalidCredentials
+	}
+
+	return username, nil
+}
+
+func (h *HtpasswdAuthenticator) logUnsupported(conn Conn, username, reason string) {
+	logger := h.ErrorLog
+	if logger == nil && conn != nil {
+		logger = conn.Server().ErrorLog
+	}
+	if logger != nil {
+		logger.Printf("htpasswd: cannot check password of %q: %v", username, reason)
+	}
+}
+
+const apr1Magic = "$apr1$"
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Crypt computes the Apache MD5 hash of a password, as written by
+// htpasswd -m.
+func apr1Crypt(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+
+	ctx := md5.New()
+	io.WriteString(ctx, password+apr1Magic+salt)
+	for i := len(pw); i > 0; i -= 16 {
+		n := i
+		if n > 16 {
+			n = 16
+		}
+		ctx.Write(alt[:n])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		ctx := md5.New()
+		if i&1 != 0 {
+			ctx.Write(pw)
+		} else {
+			ctx.Write(final)
+		}
+		if i%3 != 0 {
+			io.WriteString(ctx, salt)
+		}
+		if i%7 != 0 {
+			ctx.Write(pw)
+		}
+		if i&1 != 0 {
+			ctx.Write(final)
+		} else {
+			ctx.Write(pw)
+		}
+		final = ctx.Sum(nil)
+	}
+
+	out := []byte(apr1Magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return string(out)
+}
+
+// MasterUserAuthenticator allows master users to log in as any other user,
+// with a username of the form "user*master" and the master user's password.
+type MasterUserAuthenticator struct {
+	// Authenticator checks the credentials of master users.
+	Authenticator Authenticator
+	// Masters is the list of master users. If empty, there is no master user,
+	// and all logins are rejected.
+	Masters []string
+	// Separator between the user and the master user names. If empty, "*" is
+	// used.
+	Separator string
+}
+
+func (m *MasterUserAuthenticator) Authenticate(conn Conn, username, password string) (string, error) {
+	sep := m.Separator
+	if sep == "" {
+		sep = "*"
+	}
+
+	i := strings.LastIndex(username, sep)
+	if i <= 0 || i+len(sep) == len(username) {
+		return "", backend.ErrInvalidCredentials
+	}
+	user, master := username[:i], username[i+len(sep):]
+
+	var isMaster bool
+	for _, name := range m.Masters {
+		if name == master {
+			isMaster = true
+			break
+		}
+	}
+	if !isMaster {
+		return "", backend.ErrInvalidCredentials
+	}
+
+	if _, err := m.Authenticator.Authenticate(conn, master, password); err != nil {
+		return "", err
+	}
+	return user, nil
+}
@@ -0,0 +1,149 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/server"
+)
+
+const testHtpasswd = `# Test users
+username:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+admin:$2y$05$fakebcrypthash
+apache:$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0
+long:$apr1$abcdefgh$ZyuggYgms4sSpzTCqdPec1
+legacy:crypt0ldhash
+`
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	h, err := server.ParseHtpasswd(strings.NewReader(testHtpasswd))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name, err := h.Authenticate(nil, "username", "password"); err != nil || name != "username" {
+		t.Errorf("Authenticate(username, password) = %q, %v", name, err)
+	}
+	if _, err := h.Authenticate(nil, "username", "wrong"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Authenticate(username, wrong) = %v, want %v", err, backend.ErrInvalidCredentials)
+	}
+	if _, err := h.Authenticate(nil, "nobody", "password"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Authenticate(nobody, password) = %v, want %v", err, backend.ErrInvalidCredentials)
+	}
+
+	if name, err := h.Authenticate(nil, "apache", "password"); err != nil || name != "apache" {
+		t.Errorf("Authenticate(apache, password) = %q, %v", name, err)
+	}
+	if name, err := h.Authenticate(nil, "long", "a much longer password here!"); err != nil || name != "long" {
+		t.Errorf("Authenticate(long, ...) = %q, %v", name, err)
+	}
+	if _, err := h.Authenticate(nil, "apache", "wrong"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Authenticate(apache, wrong) = %v, want %v", err, backend.ErrInvalidCredentials)
+	}
+
+	// Unsupported hashes are rejected like invalid credentials
+	var logs bytes.Buffer
+	h.ErrorLog = log.New(&logs, "", 0)
+	if _, err := h.Authenticate(nil, "legacy", "password"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Authenticate(legacy, password) = %v, want %v", err, backend.ErrInvalidCredentials)
+	}
+
+	// bcrypt hashes need CompareBcrypt
+	if _, err := h.Authenticate(nil, "admin", "secret"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Authenticate(admin, secret) = %v, want %v", err, backend.ErrInvalidCredentials)
+	}
+	if !strings.Contains(logs.String(), "legacy") || !strings.Contains(logs.String(), "admin") {
+		t.Errorf("Unsupported hashes not logged: %q", logs.String())
+	}
+	h.CompareBcrypt = func(hash, password []byte) error {
+		if string(hash) != "$2y$05$fakebcrypthash" || string(password) != "secret" {
+			return errors.New("mismatch")
+		}
+		return nil
+	}
+	if name, err := h.Authenticate(nil, "admin", "secret"); err != nil || name != "admin" {
+		t.Errorf("Authenticate(admin, secret) = %q, %v", name, err)
+	}
+}
+
+func TestAuthenticatorChain(t *testing.T) {
+	chain := server.AuthenticatorChain{
+		server.StaticAuthenticator{"alice": "alicepass"},
+		&server.MasterUserAuthenticator{
+			Authenticator: server.StaticAuthenticator{"admin": "adminpass", "bob": "bobpass"},
+			Masters:       []string{"admin"},
+		},
+		server.AuthenticatorFunc(func(conn server.Conn, username, password string) (string, error) {
+			if username == "broken" {
+				return "", errors.New("Temporary failure")
+			}
+			return "", backend.ErrInvalidCredentials
+		}),
+	}
+
+	tests := []struct {
+		username, password string
+		name               string
+		err                bool
+	}{
+		{username: "alice", password: "alicepass", name: "alice"},
+		{username: "alice", password: "wrong", err: true},
+		{username: "alice*admin", password: "adminpass", name: "alice"},
+		{username: "alice*admin", password: "wrong", err: true},
+		{username: "alice*bob", password: "bobpass", err: true},
+		{username: "*admin", password: "adminpass", err: true},
+		{username: "bob*bob", password: "bobpass", err: true},
+		{username: "broken", password: "password", err: true},
+	}
+	for _, test := range tests {
+		name, err := chain.Authenticate(nil, test.username, test.password)
+		if test.err {
+			if err == nil {
+				t.Errorf("Authenticate(%q, %q) = %q, want an error", test.username, test.password, name)
+			}
+			continue
+		}
+		if err != nil || name != test.name {
+			t.Errorf("Authenticate(%q, %q) = %q, %v, want %q", test.username, test.password, name, err, test.name)
+		}
+	}
+
+	// Without Masters, there is no master user
+	m := &server.MasterUserAuthenticator{Authenticator: server.StaticAuthenticator{"bob": "bobpass"}}
+	if _, err := m.Authenticate(nil, "alice*bob", "bobpass"); err != backend.ErrInvalidCredentials {
+		t.Errorf("Authenticate(alice*bob) = %v, want %v", err, backend.ErrInvalidCredentials)
+	}
+}
+
+func TestLogin_Authenticator(t *testing.T) {
+	s, c := testServerWithConfig(t, &userGetterBackend{memory.New()}, func(s *server.Server) {
+		s.Authenticator = &server.MasterUserAuthenticator{
+			Authenticator: server.StaticAuthenticator{"admin": "adminpass"},
+			Masters:       []string{"admin"},
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 LOGIN username*admin adminpass\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linanh/go-imap"
+)
+
+// DefaultCertificateCheckInterval is the default interval between checks for
+// changed certificate files.
+const DefaultCertificateCheckInterval = time.Minute
+
+// ErrNoCertificate is returned when no certificate matches the server name
+// requested by a client.
+var ErrNoCertificate = errors.New("No certificate for server name")
+
+// CertificateStore selects the certificate presented to clients from the
+// server name they request with TLS Server Name Indication, and reloads
+// certificates when their files change on disk. The zero value is ready to
+// use.
+//
+// Set GetCertificate as the GetCertificate function of Server.TLSConfig or
+// ListenerConfig.TLSConfig, which are used for both implicit TLS and STARTTLS.
+// The server name is then reported to the backend, see backend.ServerName.
+type CertificateStore struct {
+	// How often certificate files are checked for changes, when a client
+	// requests a certificate. If zero, DefaultCertificateCheckInterval is used.
+	// If negative, certificates are only reloaded by Reload.
+	CheckInterval time.Duration
+	// ErrorLog logs certificates which cannot be reloaded. If nil, errors are
+	// not logged.
+	ErrorLog imap.Logger
+
+	locker    sync.RWMutex
+	certs     map[string]*certificateFiles
+	lastCheck time.Time
+}
+
+type certificateFiles struct {
+	certFile, keyFile string
+	certMod, keyMod   time.Time
+	cert              *tls.Certificate
+}
+
+// load loads the certificate if its files have changed since the last load.
+func (f *certificateFiles) load() error {
+	certMod, err := modTime(f.certFile)
+	if err != nil {
+		return err
+	}
+	keyMod, err := modTime(f.keyFile)
+	if err != nil {
+		return err
+	}
+	if f.cert != nil && certMod.Equal(f.certMod) && keyMod.Equal(f.keyMod) {
+		return nil
+	}
+
+	// The previous certificate is kept if the files are invalid, e.g. while
+	// they are being replaced
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+	f.cert, f.certMod, f.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+func modTime(name string) (time.Time, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// Add loads a certificate for a server name from a pair of PEM-encoded files.
+// The server name can be a wildcard, e.g. "*.example.org", which matches a
+// single label. The certificate of the empty server name is used for clients
+// which don't request any name or which request an unknown name.
+func (s *CertificateStore) Add(serverName, certFile, keyFile string) error {
+	f := &certificateFiles{certFile: certFile, keyFile: keyFile}
+	if err := f.load(); err != nil {
+		return err
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.certs == nil {
+		s.certs = make(map[string]*certificateFiles)
+		s.lastCheck = time.Now()
+	}
+	s.certs[strings.ToLower(serverName)] = f
+	return nil
+}
+
+// Reload reloads the certificates whose files have changed. Certificates which
+// cannot be loaded are kept unchanged, and the first error is returned.
+func (s *CertificateStore) Reload() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	return s.reload()
+}
+
+func (s *CertificateStore) reload() error {
+	s.lastCheck = time.Now()
+
+	var firstErr error
+	for name, f := range s.certs {
+		if err := f.load(); err != nil {
+			if s.ErrorLog != nil {
+				s.ErrorLog.Printf("cannot reload certificate for %q: %v", name, err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// checkReload reloads certificates if CheckInterval has elapsed since the
+// last check.
+func (s *CertificateStore) checkReload() {
+	interval := s.CheckInterval
+	if interval < 0 {
+		return
+	} else if interval == 0 {
+		interval = DefaultCertificateCheckInterval
+	}
+
+	s.locker.RLock()
+	due := time.Since(s.lastCheck) >= interval
+	s.locker.RUnlock()
+	if !due {
+		return
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	// Another handshake may have reloaded certificates in the meantime
+	if time.Since(s.lastCheck) >= interval {
+		s.reload()
+	}
+}
+
+// GetCertificate returns the certificate for the server name requested by a
+// client. It can be used as tls.Config.GetCertificate.
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.checkReload()
+
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if f, ok := s.certs[name]; ok {
+		return f.cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if f, ok := s.certs["*"+name[i:]]; ok {
+			return f.cert, nil
+		}
+	}
+	if f, ok := s.certs[""]; ok {
+		return f.cert, nil
+	}
+	return nil, ErrNoCertificate
+}
@@ -0,0 +1,248 @@
+package server_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/server"
+)
+
+// writeTestCertificate writes a self-signed certificate for commonName and its
+// key to PEM files.
+func writeTestCertificate(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	cert, _ := testClientCertificate(t, commonName)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, commonName+".crt")
+	keyFile = filepath.Join(dir, commonName+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func certificateName(t *testing.T, store *server.CertificateStore, serverName string) string {
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatalf("GetCertificate(%q): %v", serverName, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateStore_GetCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &server.CertificateStore{}
+	if _, err := store.GetCertificate(&tls.ClientHelloInfo{}); err != server.ErrNoCertificate {
+		t.Errorf("Expected ErrNoCertificate, got %v", err)
+	}
+
+	for name, cn := range map[string]string{
+		"":                 "default",
+		"mail.example.org": "example.org",
+		"*.Example.com":    "example.com",
+	} {
+		certFile, keyFile := writeTestCertificate(t, dir, cn)
+		if err := store.Add(name, certFile, keyFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for serverName, want := range map[string]string{
+		"":                  "default",
+		"mail.example.org":  "example.org",
+		"MAIL.example.org.": "example.org",
+		"imap.example.com":  "example.com",
+		"example.com":       "default",
+		"a.b.example.com":   "default",
+		"example.net":       "default",
+	} {
+		if got := certificateName(t, store, serverName); got != want {
+			t.Errorf("Certificate for %q: expected %q, got %q", serverName, want, got)
+		}
+	}
+}
+
+func TestCertificateStore_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir, "old")
+	store := &server.CertificateStore{CheckInterval: -1}
+	if err := store.Add("mail.example.org", certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the files, with a later modification time
+	newCertFile, newKeyFile := writeTestCertificate(t, dir, "new")
+	if err := os.Rename(newCertFile, certFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(newKeyFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	if got := certificateName(t, store, "mail.example.org"); got != "old" {
+		t.Errorf("Expected the old certificate before reload, got %q", got)
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := certificateName(t, store, "mail.example.org"); got != "new" {
+		t.Errorf("Expected the new certificate after reload, got %q", got)
+	}
+
+	// Invalid files don't replace the certificate
+	if err := ioutil.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	if err := store.Reload(); err == nil {
+		t.Error("Expected an error when reloading an invalid key")
+	}
+	if got := certificateName(t, store, "mail.example.org"); got != "new" {
+		t.Errorf("Expected the certificate to be kept, got %q", got)
+	}
+}
+
+// serverNameBackend records the server name of the last login.
+type serverNameBackend struct {
+	*memory.Backend
+	serverName chan string
+}
+
+func (be *serverNameBackend) Login(conn interface{}, username, password string) (backend.User, error) {
+	be.serverName <- backend.ServerName(conn)
+	return be.Backend.Login(conn, username, password)
+}
+
+func TestCertificateStore_STARTTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &server.CertificateStore{}
+	for _, name := range []string{"mail.example.org", "mail.example.com"} {
+		certFile, keyFile := writeTestCertificate(t, dir, name)
+		if err := store.Add(name, certFile, keyFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bkd := &serverNameBackend{memory.New(), make(chan string, 1)}
+	s, c := testServerWithConfig(t, bkd, func(s *server.Server) {
+		s.AllowInsecureAuth = false
+		s.TLSConfig = &tls.Config{GetCertificate: store.GetCertificate}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	sc := tls.Client(c, &tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true})
+	if err := sc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := sc.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "mail.example.com" {
+		t.Errorf("Invalid certificate: %v", cn)
+	}
+
+	scanner = bufio.NewScanner(sc)
+	io.WriteString(sc, "a002 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+	if name := <-bkd.serverName; name != "mail.example.com" {
+		t.Errorf("Expected server name mail.example.com, got %q", name)
+	}
+}
+
+func TestCertificateStore_ImplicitTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &server.CertificateStore{}
+	certFile, keyFile := writeTestCertificate(t, dir, "mail.example.org")
+	if err := store.Add("mail.example.org", certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	s := server.New(memory.New())
+	s.TLSConfig = &tls.Config{GetCertificate: store.GetCertificate}
+	defer s.Close()
+	go s.ServeListener(l, &server.ListenerConfig{ImplicitTLS: true})
+
+	c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "mail.example.org", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	if cn := c.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "mail.example.org" {
+		t.Errorf("Invalid certificate: %v", cn)
+	}
+	if name := s.Sessions()[0].Conn.Info().ServerName; name != "mail.example.org" {
+		t.Errorf("Expected server name mail.example.org, got %q", name)
+	}
+
+	// Unknown server names are rejected, since there is no default certificate
+	_, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "example.net", InsecureSkipVerify: true})
+	if err == nil {
+		t.Error("Expected handshake to fail")
+	}
+}
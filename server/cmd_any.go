@@ -50,3 +50,22 @@ func (cmd *Logout) Handle(conn Conn) error {
 	conn.Context().State = imap.LogoutState
 	return nil
 }
+
+type ID struct {
+	commands.ID
+}
+
+func (cmd *ID) Handle(conn Conn) error {
+	ctx := conn.Context()
+	ctx.ClientID = cmd.Params
+
+	// If the client isn't logged in yet, the backend is notified after
+	// authentication
+	if ctx.User != nil && cmd.Params != nil {
+		if err := ctx.User.SetExtensionID(cmd.Params); err != nil {
+			return err
+		}
+	}
+
+	return conn.WriteResp(&responses.ID{Params: conn.Server().ID})
+}
@@ -7,6 +7,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/backend/memory"
 	"github.com/linanh/go-imap/server"
 	"github.com/emersion/go-sasl"
 )
@@ -127,3 +129,70 @@ func TestServer_EnableAuth(t *testing.T) {
 		t.Fatal("Bad status response:", scanner.Text())
 	}
 }
+
+// idBackend is a memory backend recording the client identification.
+type idBackend struct {
+	*memory.Backend
+	clientID chan map[string]string
+}
+
+type idUser struct {
+	backend.User
+	be *idBackend
+}
+
+func (be *idBackend) Login(connInfo interface{}, username, password string) (backend.User, error) {
+	u, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &idUser{User: u, be: be}, nil
+}
+
+func (u *idUser) SetExtensionID(id map[string]string) error {
+	u.be.clientID <- id
+	return nil
+}
+
+func TestID(t *testing.T) {
+	bkd := &idBackend{Backend: memory.New(), clientID: make(chan map[string]string, 1)}
+	s, c := testServerWithConfig(t, bkd, func(s *server.Server) {
+		s.ID = map[string]string{"name": "go-imap", "version": "1.0"}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 ID (\"name\" \"test-client\" \"os\" NIL)\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* ID ("name" "go-imap" "version" "1.0")` {
+		t.Fatal("Invalid ID response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	id := <-bkd.clientID
+	if len(id) != 1 || id["name"] != "test-client" {
+		t.Fatal("Invalid client ID passed to backend:", id)
+	}
+
+	io.WriteString(c, "a003 ID NIL\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "* ID (") {
+		t.Fatal("Invalid ID response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
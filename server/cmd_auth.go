@@ -1,7 +1,11 @@
 package server
 
 import (
+	"compress/flate"
 	"errors"
+	"net"
+	"sort"
+	"strings"
 
 	"github.com/linanh/go-imap"
 	"github.com/linanh/go-imap/backend"
@@ -14,15 +18,65 @@ var (
 	ErrNotAuthenticated = errors.New("Not authenticated")
 )
 
+// Capabilities that can be enabled with the ENABLE command, if advertised.
+var enableableCaps = map[string]bool{
+	"UTF8=ACCEPT": true,
+	"IMAP4REV2":   true,
+}
+
+// imap4rev2 checks whether the client has enabled IMAP4rev2 semantics.
+func imap4rev2(conn Conn) bool {
+	return conn.Context().Enabled["IMAP4REV2"]
+}
+
+// imap4rev2Supported checks whether IMAP4rev2 can be advertised to a client.
+// IMAP4rev2 requires UID EXPUNGE and MOVE, which is emulated with UIDPLUS for
+// mailboxes which cannot move messages.
+func imap4rev2Supported(conn Conn) bool {
+	return conn.Server().IMAP4rev2 && supportsExtension(conn, "UIDPLUS")
+}
+
+// removeRecent returns flags without \Recent, which IMAP4rev2 removes.
+func removeRecent(flags []string) []string {
+	for i, flag := range flags {
+		if flag != imap.RecentFlag {
+			continue
+		}
+		// Don't modify the backend's slice
+		filtered := append([]string(nil), flags[:i]...)
+		for _, flag := range flags[i+1:] {
+			if flag != imap.RecentFlag {
+				filtered = append(filtered, flag)
+			}
+		}
+		return filtered
+	}
+	return flags
+}
+
 type Select struct {
 	commands.Select
 }
 
 func (cmd *Select) Handle(conn Conn) error {
 	ctx := conn.Context()
+	rev2 := imap4rev2(conn)
 
 	if ctx.Mailbox != nil {
 		ctx.Mailbox.DeSelect()
+
+		// RFC 9051 section 7.1: the CLOSED response code signals the end of the
+		// previously selected mailbox
+		if rev2 {
+			err := conn.WriteResp(&imap.StatusResp{
+				Type: imap.StatusRespOk,
+				Code: "CLOSED",
+				Info: "Previous mailbox is now closed",
+			})
+			if err != nil {
+				return err
+			}
+		}
 	}
 	// As per RFC1730#6.3.1,
 	// 		The SELECT command automatically deselects any
@@ -33,11 +87,12 @@ func (cmd *Select) Handle(conn Conn) error {
 	// server doesn't announce the UNSELECT capability.
 	ctx.Mailbox = nil
 	ctx.MailboxReadOnly = false
+	conn.mailboxView().reset(nil, nil, false)
 
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	mbox, err := backend.UserWithContext(ctx.User).GetMailboxContext(ctx.Ctx, cmd.Mailbox)
 	if err != nil {
 		return err
 	}
@@ -51,20 +106,60 @@ func (cmd *Select) Handle(conn Conn) error {
 		imap.StatusMessages, imap.StatusRecent, imap.StatusUnseen,
 		imap.StatusUidNext, imap.StatusUidValidity,
 	}
+	if rev2 {
+		// IMAP4rev2 removes \Recent and the UNSEEN response code
+		items = []imap.StatusItem{
+			imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity,
+		}
+	}
 
-	status, _, err := mbox.Status(items, nil)
+	status, _, err := backend.MailboxWithContext(mbox).StatusContext(ctx.Ctx, items, nil)
 	if err != nil {
 		return err
 	}
+	if rev2 {
+		delete(status.Items, imap.StatusRecent)
+		status.UnseenSeqNum = 0
+		status.Flags = removeRecent(status.Flags)
+		status.PermanentFlags = removeRecent(status.PermanentFlags)
+	}
+
+	// Backends sending updates may identify messages by UID only: keep track
+	// of the messages known by the client
+	if conn.Server().Updates != nil {
+		uids, _, err := backend.MailboxWithContext(mbox).SearchMessagesContext(ctx.Ctx, true, new(imap.SearchCriteria), nil)
+		if err != nil {
+			return err
+		}
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+		conn.mailboxView().reset(mbox, uids, rev2)
+		if _, ok := status.Items[imap.StatusMessages]; ok {
+			status.Messages = uint32(len(uids))
+		}
+	}
 
 	ctx.Mailbox = mbox
 	ctx.MailboxReadOnly = cmd.ReadOnly || status.ReadOnly
+	// Updates for the mailbox must be dispatched to the connection from now on
+	conn.updateSession()
 
 	res := &responses.Select{Mailbox: status}
 	if err := conn.WriteResp(res); err != nil {
 		return err
 	}
 
+	// RFC 9051 section 6.3.2: the server must return a LIST response with the
+	// mailbox name
+	if rev2 {
+		info, _, err := mbox.Info(nil)
+		if err != nil {
+			return err
+		}
+		if err := writeMailboxInfo(conn, info, cmd.UTF8); err != nil {
+			return err
+		}
+	}
+
 	var code imap.StatusRespCode = imap.CodeReadWrite
 	if ctx.MailboxReadOnly {
 		code = imap.CodeReadOnly
@@ -85,7 +180,7 @@ func (cmd *Create) Handle(conn Conn) error {
 		return ErrNotAuthenticated
 	}
 
-	return ctx.User.CreateMailbox(cmd.Mailbox)
+	return backend.UserWithContext(ctx.User).CreateMailboxContext(ctx.Ctx, cmd.Mailbox)
 }
 
 type Delete struct {
@@ -98,7 +193,7 @@ func (cmd *Delete) Handle(conn Conn) error {
 		return ErrNotAuthenticated
 	}
 
-	return ctx.User.DeleteMailbox(cmd.Mailbox)
+	return backend.UserWithContext(ctx.User).DeleteMailboxContext(ctx.Ctx, cmd.Mailbox)
 }
 
 type Rename struct {
@@ -111,7 +206,7 @@ func (cmd *Rename) Handle(conn Conn) error {
 		return ErrNotAuthenticated
 	}
 
-	return ctx.User.RenameMailbox(cmd.Existing, cmd.New)
+	return backend.UserWithContext(ctx.User).RenameMailboxContext(ctx.Ctx, cmd.Existing, cmd.New)
 }
 
 type Subscribe struct {
@@ -154,35 +249,63 @@ type List struct {
 	commands.List
 }
 
+func (cmd *List) hasOpt(opts []string, opt string) bool {
+	for _, o := range opts {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
 func (cmd *List) Handle(conn Conn) error {
 	ctx := conn.Context()
 	if ctx.User == nil {
 		return ErrNotAuthenticated
 	}
 
-	ch := make(chan *imap.MailboxInfo)
-	res := &responses.List{Mailboxes: ch, Subscribed: cmd.Subscribed}
-
-	done := make(chan error, 1)
-	go (func() {
-		done <- conn.WriteResp(res)
-		// Make sure to drain the channel.
-		for range ch {
+	if cmd.Subscribed && imap4rev2(conn) {
+		return ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespBad,
+			Info: "LSUB is not supported in IMAP4rev2, use LIST (SUBSCRIBED)",
+		})
+	}
+	for _, opt := range cmd.SelectOpts {
+		if opt != "SUBSCRIBED" && opt != "REMOTE" {
+			return ErrStatusResp(&imap.StatusResp{
+				Type: imap.StatusRespBad,
+				Info: "Unsupported LIST selection option",
+			})
 		}
-	})()
+	}
 
-	mailboxes, err := ctx.User.ListMailboxes(cmd.Subscribed)
+	subscribedOnly := cmd.Subscribed || cmd.hasOpt(cmd.SelectOpts, "SUBSCRIBED")
+	user := backend.UserWithContext(ctx.User)
+	mailboxes, err := user.ListMailboxesContext(ctx.Ctx, subscribedOnly)
 	if err != nil {
-		// Close channel to signal end of results
-		close(ch)
 		return err
 	}
 
+	// Find subscribed mailboxes to set the \Subscribed attribute
+	var subscribed map[string]bool
+	if cmd.hasOpt(cmd.SelectOpts, "SUBSCRIBED") || cmd.hasOpt(cmd.ReturnOpts, "SUBSCRIBED") {
+		subscribed = make(map[string]bool)
+		subscribedMailboxes := mailboxes
+		if !subscribedOnly {
+			if subscribedMailboxes, err = user.ListMailboxesContext(ctx.Ctx, true); err != nil {
+				return err
+			}
+		}
+		for _, mbox := range subscribedMailboxes {
+			subscribed[mbox.Name()] = true
+		}
+	}
+
+	var matched []backend.Mailbox
+	var infos []*imap.MailboxInfo
 	for _, mbox := range mailboxes {
 		info, _, err := mbox.Info(nil)
 		if err != nil {
-			// Close channel to signal end of results
-			close(ch)
 			return err
 		}
 
@@ -190,22 +313,85 @@ func (cmd *List) Handle(conn Conn) error {
 		// the hierarchy delimiter and the root name of the name given in the
 		// reference.
 		if cmd.Mailbox == "" {
-			ch <- &imap.MailboxInfo{
+			infos = append(infos, &imap.MailboxInfo{
 				Attributes: []string{imap.NoSelectAttr},
 				Delimiter:  info.Delimiter,
 				Name:       info.Delimiter,
-			}
+			})
+			matched = append(matched, nil)
 			break
 		}
 
 		if info.Match(cmd.Reference, cmd.Mailbox) {
+			if subscribed[info.Name] {
+				info.Attributes = append(info.Attributes, imap.SubscribedAttr)
+			}
+			infos = append(infos, info)
+			matched = append(matched, mbox)
+		}
+	}
+
+	if len(cmd.ReturnStatus) == 0 {
+		ch := make(chan *imap.MailboxInfo, len(infos))
+		for _, info := range infos {
 			ch <- info
 		}
+		close(ch)
+
+		res := &responses.List{Mailboxes: ch, Subscribed: cmd.Subscribed, UTF8: cmd.UTF8}
+		return conn.WriteResp(res)
+	}
+
+	// RFC 5819 section 2: each STATUS response follows its LIST response
+	for i, info := range infos {
+		if err := writeMailboxInfo(conn, info, cmd.UTF8); err != nil {
+			return err
+		}
+
+		if matched[i] == nil || hasAttr(info.Attributes, imap.NoSelectAttr) {
+			continue
+		}
+		if err := writeStatus(conn, matched[i], cmd.ReturnStatus, cmd.UTF8); err != nil {
+			return err
+		}
 	}
-	// Close channel to signal end of results
+
+	return nil
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMailboxInfo writes a single LIST response.
+func writeMailboxInfo(conn Conn, info *imap.MailboxInfo, utf8 bool) error {
+	ch := make(chan *imap.MailboxInfo, 1)
+	ch <- info
 	close(ch)
 
-	return <-done
+	return conn.WriteResp(&responses.List{Mailboxes: ch, UTF8: utf8})
+}
+
+// writeStatus writes a STATUS response containing only the requested items.
+func writeStatus(conn Conn, mbox backend.Mailbox, items []imap.StatusItem, utf8 bool) error {
+	status, _, err := backend.MailboxWithContext(mbox).StatusContext(conn.Context().Ctx, items, nil)
+	if err != nil {
+		return err
+	}
+
+	// Only keep items that have been requested
+	requested := make(map[imap.StatusItem]interface{})
+	for _, k := range items {
+		requested[k] = status.Items[k]
+	}
+	status.Items = requested
+
+	return conn.WriteResp(&responses.Status{Mailbox: status, UTF8: utf8})
 }
 
 type Status struct {
@@ -218,25 +404,23 @@ func (cmd *Status) Handle(conn Conn) error {
 		return ErrNotAuthenticated
 	}
 
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
-	if err != nil {
-		return err
+	if imap4rev2(conn) {
+		for _, item := range cmd.Items {
+			if item == imap.StatusRecent {
+				return ErrStatusResp(&imap.StatusResp{
+					Type: imap.StatusRespBad,
+					Info: "RECENT is not supported in IMAP4rev2",
+				})
+			}
+		}
 	}
 
-	status, _, err := mbox.Status(cmd.Items, nil)
+	mbox, err := backend.UserWithContext(ctx.User).GetMailboxContext(ctx.Ctx, cmd.Mailbox)
 	if err != nil {
 		return err
 	}
 
-	// Only keep items thqat have been requested
-	items := make(map[imap.StatusItem]interface{})
-	for _, k := range cmd.Items {
-		items[k] = status.Items[k]
-	}
-	status.Items = items
-
-	res := &responses.Status{Mailbox: status}
-	return conn.WriteResp(res)
+	return writeStatus(conn, mbox, cmd.Items, cmd.UTF8)
 }
 
 type Append struct {
@@ -249,8 +433,8 @@ func (cmd *Append) Handle(conn Conn) error {
 		return ErrNotAuthenticated
 	}
 
-	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
-	if err == backend.ErrNoSuchMailbox {
+	mbox, err := backend.UserWithContext(ctx.User).GetMailboxContext(ctx.Ctx, cmd.Mailbox)
+	if errors.Is(err, backend.ErrNoSuchMailbox) {
 		return ErrStatusResp(&imap.StatusResp{
 			Type: imap.StatusRespNo,
 			Code: imap.CodeTryCreate,
@@ -260,7 +444,7 @@ func (cmd *Append) Handle(conn Conn) error {
 		return err
 	}
 
-	res, err := mbox.CreateMessage(cmd.Flags, cmd.Date, cmd.Message, nil)
+	res, err := backend.MailboxWithContext(mbox).CreateMessageContext(ctx.Ctx, cmd.Flags, cmd.Date, cmd.Message, nil)
 	if err != nil {
 		return err
 	}
@@ -307,3 +491,108 @@ func (cmd *Append) Handle(conn Conn) error {
 
 	return nil
 }
+
+type Enable struct {
+	commands.Enable
+}
+
+func (cmd *Enable) Handle(conn Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return ErrNotAuthenticated
+	}
+	// RFC 5161 section 3.1: ENABLE is only valid in the authenticated state
+	if ctx.Mailbox != nil {
+		return errors.New("ENABLE is not allowed when a mailbox is selected")
+	}
+
+	var enabled []string
+	for _, c := range cmd.Caps {
+		if conn.enable(c) {
+			enabled = append(enabled, c)
+		}
+	}
+
+	return conn.WriteResp(&responses.Enabled{Caps: enabled})
+}
+
+type Namespace struct {
+	commands.Namespace
+}
+
+func (cmd *Namespace) Handle(conn Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return ErrNotAuthenticated
+	}
+	if !imap4rev2Supported(conn) {
+		return errors.New("Unknown command")
+	}
+
+	if u, ok := ctx.User.(backend.NamespaceUser); ok {
+		personal, other, shared, err := u.Namespaces()
+		if err != nil {
+			return err
+		}
+		return conn.WriteResp(&responses.Namespace{
+			Personal: personal,
+			Other:    other,
+			Shared:   shared,
+		})
+	}
+
+	// Default to a single personal namespace, using the INBOX delimiter
+	var delim string
+	if mbox, err := ctx.User.GetMailbox("INBOX"); err == nil {
+		if info, _, err := mbox.Info(nil); err == nil {
+			delim = info.Delimiter
+		}
+	}
+	return conn.WriteResp(&responses.Namespace{
+		Personal: []imap.NamespaceDescriptor{{Delimiter: delim}},
+	})
+}
+
+type Compress struct {
+	commands.Compress
+}
+
+func (cmd *Compress) Handle(conn Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return ErrNotAuthenticated
+	}
+	if !conn.Server().Compress {
+		return errors.New("Unknown command")
+	}
+	if cmd.Mechanism != imap.CompressDeflate {
+		return ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespBad,
+			Info: "Unsupported compression mechanism",
+		})
+	}
+	if conn.isCompressed() {
+		return ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeCompressionActive,
+			Info: "Compression is already active",
+		})
+	}
+
+	return ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Info: imap.CompressDeflate + " active",
+	})
+}
+
+func (cmd *Compress) Upgrade(conn Conn) error {
+	level := conn.Server().CompressLevel
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	return conn.Upgrade(func(sock net.Conn) (net.Conn, error) {
+		conn.WaitReady()
+		return imap.NewDeflateConn(sock, level)
+	})
+}
@@ -2,11 +2,16 @@ package server_test
 
 import (
 	"bufio"
+	"compress/flate"
+	"fmt"
 	"io"
 	"net"
 	"strings"
 	"testing"
 
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/backend/memory"
 	"github.com/linanh/go-imap/server"
 )
 
@@ -101,6 +106,19 @@ func TestSelect_InvalidMailbox(t *testing.T) {
 	}
 }
 
+func TestSelect_NonExistent(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 SELECT idontexist\r\n")
+	scanner.Scan()
+
+	if scanner.Text() != "a001 NO [NONEXISTENT] No such mailbox" {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
 func TestSelect_NotAuthenticated(t *testing.T) {
 	s, c, scanner := testServerGreeted(t)
 	defer s.Close()
@@ -126,6 +144,59 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+func TestCreate_AlreadyExists(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 CREATE INBOX\r\n")
+	scanner.Scan()
+
+	if scanner.Text() != "a001 NO [ALREADYEXISTS] Mailbox already exists" {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+// quotaBackend is a memory backend whose users are over quota.
+type quotaBackend struct {
+	*memory.Backend
+}
+
+type quotaUser struct {
+	backend.User
+}
+
+func (be *quotaBackend) Login(connInfo interface{}, username, password string) (backend.User, error) {
+	user, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaUser{user}, nil
+}
+
+func (u *quotaUser) CreateMailbox(name string) error {
+	return fmt.Errorf("cannot create %v: %w", name, imap.ErrOverQuota)
+}
+
+func TestCreate_OverQuota(t *testing.T) {
+	s, c := testServerWithBackend(t, &quotaBackend{memory.New()})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "a001 CREATE test\r\n")
+	scanner.Scan()
+
+	if scanner.Text() != "a001 NO [OVERQUOTA] cannot create test: Quota exceeded" {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
 func TestCreate_NotAuthenticated(t *testing.T) {
 	s, c, scanner := testServerGreeted(t)
 	defer s.Close()
@@ -609,3 +680,303 @@ func TestAppend_NotAuthenticated(t *testing.T) {
 		t.Fatal("Invalid status response:", scanner.Text())
 	}
 }
+
+func testServerUTF8(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner) {
+	bkd := &extBackend{Backend: memory.New(), exts: []string{"UTF8=ACCEPT"}}
+	s, c = testServerWithBackend(t, bkd)
+	scanner = bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan() // OK response
+	return
+}
+
+func TestEnable_UTF8Accept(t *testing.T) {
+	s, c, scanner := testServerUTF8(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 ENABLE UTF8=ACCEPT CONDSTORE\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "* ENABLED UTF8=ACCEPT" {
+		t.Fatal("Invalid ENABLED response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 CREATE \"Répertoire &-\"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a003 LIST \"\" Rép*\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* LIST () "/" "Répertoire &-"` {
+		t.Fatal("Invalid LIST response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a004 APPEND \"Répertoire &-\" UTF8 (~{7+}\r\nSubject)\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a004 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestEnable_NotSupported(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 ENABLE UTF8=ACCEPT\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "* ENABLED" {
+		t.Fatal("Invalid ENABLED response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestUTF8_NotEnabled(t *testing.T) {
+	s, c, scanner := testServerUTF8(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 CREATE \"Répertoire\"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 BAD ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 APPEND INBOX UTF8 (~{7+}\r\nSubject)\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 BAD ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func testServerIMAP4rev2(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner) {
+	bkd := &extBackend{Backend: memory.New(), exts: []string{"UIDPLUS"}}
+	s, c = testServerWithConfig(t, bkd, func(s *server.Server) {
+		s.IMAP4rev2 = true
+	})
+	scanner = bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan() // OK response
+
+	io.WriteString(c, "a000 ENABLE IMAP4rev2\r\n")
+	scanner.Scan() // ENABLED response
+	if scanner.Text() != "* ENABLED IMAP4REV2" {
+		t.Fatal("Invalid ENABLED response:", scanner.Text())
+	}
+	scanner.Scan() // OK response
+	return
+}
+
+func TestIMAP4rev2_Capability(t *testing.T) {
+	bkd := &extBackend{Backend: memory.New(), exts: []string{"UIDPLUS"}}
+	s, c := testServerWithConfig(t, bkd, func(s *server.Server) {
+		s.IMAP4rev2 = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 CAPABILITY\r\n")
+	scanner.Scan()
+	expected := "* CAPABILITY IMAP4rev1 IMAP4rev2 " + builtinExtensions +
+		" AUTH=PLAIN UIDPLUS NAMESPACE MOVE ESEARCH LIST-EXTENDED LIST-STATUS ENABLE"
+	if scanner.Text() != expected {
+		t.Fatal("Invalid CAPABILITY response:", scanner.Text())
+	}
+}
+
+func TestIMAP4rev2_CapabilityWithoutUidplus(t *testing.T) {
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.IMAP4rev2 = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	// IMAP4rev2 requires UID EXPUNGE
+	io.WriteString(c, "a001 CAPABILITY\r\n")
+	scanner.Scan()
+	expected := "* CAPABILITY IMAP4rev1 " + builtinExtensions + " AUTH=PLAIN"
+	if scanner.Text() != expected {
+		t.Fatal("Invalid CAPABILITY response:", scanner.Text())
+	}
+}
+
+func TestIMAP4rev2_Select(t *testing.T) {
+	s, c, scanner := testServerIMAP4rev2(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+
+	gotList := false
+	for scanner.Scan() {
+		res := scanner.Text()
+		if strings.HasPrefix(res, "a001 ") {
+			if !strings.HasPrefix(res, "a001 OK [READ-WRITE] ") {
+				t.Fatal("Invalid status response:", res)
+			}
+			break
+		}
+		if strings.Contains(res, "RECENT") || strings.Contains(res, "[UNSEEN ") {
+			t.Fatal("Unexpected response in IMAP4rev2 mode:", res)
+		}
+		if res == `* LIST () "/" INBOX` {
+			gotList = true
+		}
+	}
+	if !gotList {
+		t.Fatal("Missing LIST response")
+	}
+
+	io.WriteString(c, "a002 EXAMINE INBOX\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "* OK [CLOSED] ") {
+		t.Fatal("Invalid CLOSED response:", scanner.Text())
+	}
+}
+
+func TestIMAP4rev2_Lsub(t *testing.T) {
+	s, c, scanner := testServerIMAP4rev2(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 LSUB \"\" *\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 BAD ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestIMAP4rev2_Status(t *testing.T) {
+	s, c, scanner := testServerIMAP4rev2(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 STATUS INBOX (MESSAGES RECENT)\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 BAD ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestList_SelectSubscribed(t *testing.T) {
+	s, c, scanner := testServerIMAP4rev2(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 CREATE Archive\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a002 SUBSCRIBE INBOX\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "a003 LIST (SUBSCRIBED) \"\" *\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* LIST (\Subscribed) "/" INBOX` {
+		t.Fatal("Invalid LIST response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestList_ReturnStatus(t *testing.T) {
+	s, c, scanner := testServerIMAP4rev2(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 LIST \"\" INBOX RETURN (STATUS (MESSAGES))\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* LIST () "/" INBOX` {
+		t.Fatal("Invalid LIST response:", scanner.Text())
+	}
+	scanner.Scan()
+	if scanner.Text() != "* STATUS INBOX (MESSAGES 1)" {
+		t.Fatal("Invalid STATUS response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	s, c, scanner := testServerIMAP4rev2(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 NAMESPACE\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* NAMESPACE (("" "/")) NIL NIL` {
+		t.Fatal("Invalid NAMESPACE response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestCompress(t *testing.T) {
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.Compress = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan() // OK response
+
+	io.WriteString(c, "a001 COMPRESS DEFLATE\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	cc, err := imap.NewDeflateConn(c, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal("cannot create compressed connection:", err)
+	}
+	flusher := cc.(interface{ Flush() error })
+	scanner = bufio.NewScanner(cc)
+
+	io.WriteString(cc, "a002 NOOP\r\n")
+	flusher.Flush()
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(cc, "a003 COMPRESS DEFLATE\r\n")
+	flusher.Flush()
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 NO [COMPRESSIONACTIVE] ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
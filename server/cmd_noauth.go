@@ -14,6 +14,7 @@ import (
 var (
 	ErrAlreadyAuthenticated = errors.New("Already authenticated")
 	ErrAuthDisabled         = errors.New("Authentication disabled")
+	ErrServerDraining       = &imap.StatusError{Code: imap.CodeUnavailable, Info: "Server is shutting down, try again later"}
 )
 
 type StartTLS struct {
@@ -28,7 +29,7 @@ func (cmd *StartTLS) Handle(conn Conn) error {
 	if conn.IsTLS() {
 		return errors.New("TLS is already enabled")
 	}
-	if conn.Server().TLSConfig == nil {
+	if conn.Server().tlsConfig(conn.ListenerConfig()) == nil {
 		return errors.New("TLS support not enabled")
 	}
 
@@ -41,7 +42,7 @@ func (cmd *StartTLS) Handle(conn Conn) error {
 }
 
 func (cmd *StartTLS) Upgrade(conn Conn) error {
-	tlsConfig := conn.Server().TLSConfig
+	tlsConfig := conn.Server().tlsConfig(conn.ListenerConfig())
 
 	var tlsConn *tls.Conn
 	err := conn.Upgrade(func(sock net.Conn) (net.Conn, error) {
@@ -60,6 +61,14 @@ func (cmd *StartTLS) Upgrade(conn Conn) error {
 }
 
 func afterAuthStatus(conn Conn) error {
+	// Forward the identification sent before authentication to the backend
+	ctx := conn.Context()
+	if ctx.User != nil && ctx.ClientID != nil {
+		if err := ctx.User.SetExtensionID(ctx.ClientID); err != nil {
+			conn.Server().ErrorLog.Printf("cannot set client ID: %v", err)
+		}
+	}
+
 	caps := conn.Capabilities()
 	capAtoms := make([]interface{}, 0, len(caps))
 	for _, cap := range caps {
@@ -94,14 +103,34 @@ func (cmd *Login) Handle(conn Conn) error {
 	if !canAuth(conn) {
 		return ErrAuthDisabled
 	}
+	if conn.Server().Draining() {
+		return ErrServerDraining
+	}
 
-	user, err := conn.Server().Backend.Login(conn, cmd.Username, cmd.Password)
+	login := func() error {
+		user, err := conn.Server().login(conn, cmd.Username, cmd.Password)
+		if err != nil {
+			return err
+		}
+
+		ctx.State = imap.AuthenticatedState
+		ctx.User = user
+		return nil
+	}
+
+	var err error
+	if policy := loginPolicy(conn); policy != nil {
+		err = policy.authenticate(conn, "LOGIN", login)
+	} else {
+		err = login()
+	}
+	if metrics := conn.Server().Metrics; metrics != nil {
+		metrics.AuthAttempt("LOGIN", err == nil)
+	}
 	if err != nil {
 		return err
 	}
 
-	ctx.State = imap.AuthenticatedState
-	ctx.User = user
 	return afterAuthStatus(conn)
 }
 
@@ -114,16 +143,41 @@ func (cmd *Authenticate) Handle(conn Conn) error {
 	if ctx.State != imap.NotAuthenticatedState {
 		return ErrAlreadyAuthenticated
 	}
-	if !canAuth(conn) {
-		return ErrAuthDisabled
+	if conn.Server().Draining() {
+		return ErrServerDraining
+	}
+
+	// Only offer the mechanisms advertised to this client
+	advertised := map[string]bool{}
+	for _, cap := range conn.Capabilities() {
+		advertised[cap] = true
 	}
 
 	mechanisms := map[string]sasl.Server{}
 	for name, newSasl := range conn.Server().auths {
-		mechanisms[name] = newSasl(conn)
+		if advertised["AUTH="+name] {
+			mechanisms[name] = newSasl(conn)
+		}
+	}
+	if len(mechanisms) == 0 {
+		return ErrAuthDisabled
 	}
 
-	err := cmd.Authenticate.Handle(mechanisms, conn)
+	var err error
+	if policy := loginPolicy(conn); policy != nil {
+		err = policy.authenticate(conn, cmd.Mechanism, func() error {
+			return cmd.Authenticate.Handle(mechanisms, conn)
+		})
+	} else {
+		err = cmd.Authenticate.Handle(mechanisms, conn)
+	}
+	if metrics := conn.Server().Metrics; metrics != nil {
+		mech := cmd.Mechanism
+		if _, ok := mechanisms[mech]; !ok {
+			mech = "UNKNOWN"
+		}
+		metrics.AuthAttempt(mech, err == nil)
+	}
 	if err != nil {
 		return err
 	}
@@ -2,12 +2,26 @@ package server_test
 
 import (
 	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
 	"io"
+	"math/big"
 	"net"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-sasl"
+	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/backend/memory"
 	"github.com/linanh/go-imap/internal"
 	"github.com/linanh/go-imap/server"
 )
@@ -223,3 +237,550 @@ func TestAuthenticate_No(t *testing.T) {
 		t.Fatal("Bad status response:", scanner.Text())
 	}
 }
+
+// scramBackend is a memory backend supporting SCRAM authentication.
+type scramBackend struct {
+	*memory.Backend
+}
+
+func (be *scramBackend) GetUser(connInfo interface{}, username string) (backend.User, error) {
+	return be.Backend.Login(connInfo, username, "password")
+}
+
+func (be *scramBackend) SCRAMCredentials(connInfo interface{}, username, mechanism string) (*backend.SCRAMCredentials, error) {
+	if username != "username" {
+		return nil, errors.New("No such user")
+	}
+	return backend.NewSCRAMCredentials(mechanism, "password", []byte("salt"), 1)
+}
+
+// scramClientProof computes a SCRAM-SHA-256 client proof, with an iteration
+// count of 1.
+func scramClientProof(password, salt []byte, authMessage string) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	saltedPassword := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, saltedPassword)
+	mac.Write([]byte("Client Key"))
+	clientKey := mac.Sum(nil)
+	storedKey := sha256.Sum256(clientKey)
+
+	mac = hmac.New(sha256.New, storedKey[:])
+	mac.Write([]byte(authMessage))
+	clientSignature := mac.Sum(nil)
+
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	return proof
+}
+
+func testAuthenticateSCRAM(t *testing.T, c net.Conn, scanner *bufio.Scanner, mech, gs2Header string, cbData []byte) string {
+	clientFirstBare := "n=username,r=clientnonce"
+	clientFirst := gs2Header + clientFirstBare
+	io.WriteString(c, "a001 AUTHENTICATE "+mech+" "+base64.StdEncoding.EncodeToString([]byte(clientFirst))+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "+ ") {
+		return scanner.Text()
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(scanner.Text(), "+ "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverFirst := string(b)
+	if !strings.HasPrefix(serverFirst, "r=clientnonce") || !strings.HasSuffix(serverFirst, ",s=c2FsdA==,i=1") {
+		t.Fatal("Bad server-first-message:", serverFirst)
+	}
+	nonce := strings.TrimPrefix(strings.SplitN(serverFirst, ",", 2)[0], "r=")
+
+	cb := base64.StdEncoding.EncodeToString(append([]byte(gs2Header), cbData...))
+	withoutProof := "c=" + cb + ",r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := scramClientProof([]byte("password"), []byte("salt"), authMessage)
+	clientFinal := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	io.WriteString(c, base64.StdEncoding.EncodeToString([]byte(clientFinal))+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "+ ") {
+		return scanner.Text()
+	}
+	b, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(scanner.Text(), "+ "))
+	if err != nil || !strings.HasPrefix(string(b), "v=") {
+		t.Fatal("Bad server-final-message:", scanner.Text())
+	}
+
+	io.WriteString(c, "\r\n")
+	scanner.Scan()
+	return scanner.Text()
+}
+
+func TestAuthenticate_SCRAM(t *testing.T) {
+	s, c := testServerWithBackend(t, &scramBackend{memory.New()})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	if !strings.Contains(scanner.Text(), " AUTH=SCRAM-SHA-256") {
+		t.Fatal("SCRAM-SHA-256 not advertised:", scanner.Text())
+	}
+	if strings.Contains(scanner.Text(), "-PLUS") {
+		t.Fatal("SCRAM-SHA-256-PLUS advertised without TLS:", scanner.Text())
+	}
+
+	res := testAuthenticateSCRAM(t, c, scanner, "SCRAM-SHA-256", "n,,", nil)
+	if !strings.HasPrefix(res, "a001 OK ") {
+		t.Fatal("Bad status response:", res)
+	}
+}
+
+func TestAuthenticate_SCRAM_No(t *testing.T) {
+	s, c := testServerWithBackend(t, &scramBackend{memory.New()})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	// The SCRAM-SHA-1 proof is computed with SHA-256
+	res := testAuthenticateSCRAM(t, c, scanner, "SCRAM-SHA-1", "n,,", nil)
+	if !strings.HasPrefix(res, "a001 NO ") {
+		t.Fatal("Bad status response:", res)
+	}
+}
+
+func TestAuthenticate_SCRAM_UnknownUser(t *testing.T) {
+	s, c := testServerWithBackend(t, &scramBackend{memory.New()})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	// The exchange only fails at the proof check, with the same salt for each
+	// attempt, like for an existing user
+	var salts []string
+	for i := 0; i < 2; i++ {
+		clientFirst := "n,,n=nobody,r=clientnonce"
+		io.WriteString(c, "a001 AUTHENTICATE SCRAM-SHA-256 "+base64.StdEncoding.EncodeToString([]byte(clientFirst))+"\r\n")
+
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "+ ") {
+			t.Fatal("Bad continuation request:", scanner.Text())
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(scanner.Text(), "+ "))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := strings.Split(string(b), ",")
+		if len(fields) != 3 || fields[2] != "i=4096" {
+			t.Fatal("Bad server-first-message:", string(b))
+		}
+		salts = append(salts, fields[1])
+
+		clientFinal := "c=biws," + fields[0] + ",p=" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+		io.WriteString(c, base64.StdEncoding.EncodeToString([]byte(clientFinal))+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+			t.Fatal("Bad status response:", scanner.Text())
+		}
+	}
+	if salts[0] != salts[1] {
+		t.Errorf("Salts differ between attempts: %v", salts)
+	}
+}
+
+func TestAuthenticate_SCRAMPlus(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{cert},
+	}
+
+	s, c := testServerWithConfig(t, &scramBackend{memory.New()}, func(s *server.Server) {
+		s.TLSConfig = tlsConfig
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a000 STARTTLS\r\n")
+	scanner.Scan()
+	sc := tls.Client(c, tlsConfig)
+	if err := sc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	scanner = bufio.NewScanner(sc)
+
+	state := sc.ConnectionState()
+	cbData, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := testAuthenticateSCRAM(t, sc, scanner, "SCRAM-SHA-256-PLUS", "p=tls-exporter,,", cbData)
+	if !strings.HasPrefix(res, "a001 OK ") {
+		t.Fatal("Bad status response:", res)
+	}
+}
+
+func TestAuthenticate_SCRAM_UnexpectedChannelBinding(t *testing.T) {
+	s, c := testServerWithBackend(t, &scramBackend{memory.New()})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	// Channel binding is only allowed with -PLUS mechanisms
+	res := testAuthenticateSCRAM(t, c, scanner, "SCRAM-SHA-256", "p=tls-exporter,,", []byte("fake"))
+	if !strings.HasPrefix(res, "a001 NO ") {
+		t.Fatal("Bad status response:", res)
+	}
+}
+
+func TestAuthenticate_SCRAM_Downgrade(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{cert},
+	}
+
+	s := server.New(&scramBackend{memory.New()})
+	s.TLSConfig = tlsConfig
+	defer s.Close()
+
+	tests := []struct {
+		mechanisms []string
+		ok         bool
+	}{
+		// The client thinks channel binding isn't supported, but it is
+		{mechanisms: nil, ok: false},
+		// Channel binding isn't advertised on this listener
+		{mechanisms: []string{"SCRAM-SHA-256"}, ok: true},
+	}
+	for _, test := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("Cannot listen:", err)
+		}
+		go s.ServeListener(l, &server.ListenerConfig{Mechanisms: test.mechanisms})
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("Cannot connect to server:", err)
+		}
+		defer c.Close()
+
+		scanner := bufio.NewScanner(c)
+		scanner.Scan() // Greeting
+		io.WriteString(c, "a000 STARTTLS\r\n")
+		scanner.Scan()
+		sc := tls.Client(c, tlsConfig)
+		if err := sc.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		scanner = bufio.NewScanner(sc)
+
+		res := testAuthenticateSCRAM(t, sc, scanner, "SCRAM-SHA-256", "y,,", nil)
+		if ok := strings.HasPrefix(res, "a001 OK "); ok != test.ok {
+			t.Errorf("Bad status response with mechanisms %v: %v", test.mechanisms, res)
+		}
+	}
+}
+
+// userGetterBackend is a memory backend supporting user lookups without a
+// password.
+type userGetterBackend struct {
+	*memory.Backend
+}
+
+func (be *userGetterBackend) GetUser(connInfo interface{}, username string) (backend.User, error) {
+	return be.Backend.Login(connInfo, username, "password")
+}
+
+func testOAuthVerifier(conn server.Conn, username, token string) (string, error) {
+	if token != "token" {
+		return "", &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer", Scope: "imap"}
+	}
+	if username == "" {
+		username = "username"
+	}
+	return username, nil
+}
+
+func testServerOAuth(t *testing.T) (s *server.Server, c net.Conn) {
+	return testServerWithConfig(t, &userGetterBackend{memory.New()}, func(s *server.Server) {
+		verifier := server.TokenVerifierFunc(testOAuthVerifier)
+		s.EnableAuth(sasl.OAuthBearer, server.NewOAuthBearerServerFactory(verifier))
+		s.EnableAuth(server.XOAuth2, server.NewXOAuth2ServerFactory(verifier))
+	})
+}
+
+func TestAuthenticate_OAuthBearer(t *testing.T) {
+	s, c := testServerOAuth(t)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	if !strings.Contains(scanner.Text(), " AUTH=OAUTHBEARER") || !strings.Contains(scanner.Text(), " AUTH=XOAUTH2") {
+		t.Fatal("OAuth mechanisms not advertised:", scanner.Text())
+	}
+
+	ir := "n,a=username,\x01host=localhost\x01auth=Bearer token\x01\x01"
+	io.WriteString(c, "a001 AUTHENTICATE OAUTHBEARER "+base64.StdEncoding.EncodeToString([]byte(ir))+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_OAuthBearer_NoInitialResponse(t *testing.T) {
+	s, c := testServerOAuth(t)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 AUTHENTICATE OAUTHBEARER\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "+") {
+		t.Fatal("Bad continuation request:", scanner.Text())
+	}
+
+	resp := "n,,\x01auth=Bearer token\x01\x01"
+	io.WriteString(c, base64.StdEncoding.EncodeToString([]byte(resp))+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_OAuthBearer_InvalidToken(t *testing.T) {
+	s, c := testServerOAuth(t)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	ir := "n,a=username,\x01auth=Bearer invalid\x01\x01"
+	io.WriteString(c, "a001 AUTHENTICATE OAUTHBEARER "+base64.StdEncoding.EncodeToString([]byte(ir))+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "+ ") {
+		t.Fatal("Bad continuation request:", scanner.Text())
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(scanner.Text(), "+ "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"status":"invalid_token","schemes":"bearer","scope":"imap"}`; string(b) != want {
+		t.Fatalf("Bad error challenge: got %v, want %v", string(b), want)
+	}
+
+	io.WriteString(c, base64.StdEncoding.EncodeToString([]byte{0x01})+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_XOAuth2(t *testing.T) {
+	s, c := testServerOAuth(t)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	ir := "user=username\x01auth=Bearer token\x01\x01"
+	io.WriteString(c, "a001 AUTHENTICATE XOAUTH2 "+base64.StdEncoding.EncodeToString([]byte(ir))+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_XOAuth2_InvalidToken(t *testing.T) {
+	s, c := testServerOAuth(t)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	ir := "user=username\x01auth=Bearer invalid\x01\x01"
+	io.WriteString(c, "a001 AUTHENTICATE XOAUTH2 "+base64.StdEncoding.EncodeToString([]byte(ir))+"\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "+ ") {
+		t.Fatal("Bad continuation request:", scanner.Text())
+	}
+
+	// XOAUTH2 clients acknowledge the error with an empty response
+	io.WriteString(c, "\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+// externalBackend is a memory backend supporting TLS client certificates.
+type externalBackend struct {
+	*memory.Backend
+}
+
+func (be *externalBackend) LoginExternal(connInfo interface{}, cert *x509.Certificate, identity string) (backend.User, error) {
+	username := cert.Subject.CommonName
+	if identity != "" && identity != username {
+		return nil, errors.New("Identities not supported")
+	}
+	return be.Backend.Login(connInfo, username, "password")
+}
+
+// testClientCertificate generates a self-signed client certificate for
+// commonName.
+func testClientCertificate(t *testing.T, commonName string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func testServerExternal(t *testing.T, clientCerts []tls.Certificate) (s *server.Server, c net.Conn, scanner *bufio.Scanner) {
+	serverCert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, x509Cert := testClientCertificate(t, "username")
+	if clientCerts == nil {
+		clientCerts = []tls.Certificate{clientCert}
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(x509Cert)
+
+	s, c = testServerWithConfig(t, &externalBackend{memory.New()}, func(s *server.Server) {
+		s.AllowInsecureAuth = false
+		s.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    clientCAs,
+		}
+	})
+
+	scanner = bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	if strings.Contains(scanner.Text(), "AUTH=EXTERNAL") {
+		t.Fatal("EXTERNAL advertised without TLS:", scanner.Text())
+	}
+
+	io.WriteString(c, "a000 STARTTLS\r\n")
+	scanner.Scan()
+	sc := tls.Client(c, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       clientCerts,
+	})
+	if err := sc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, sc, bufio.NewScanner(sc)
+}
+
+func TestAuthenticate_External(t *testing.T) {
+	s, c, scanner := testServerExternal(t, nil)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 CAPABILITY\r\n")
+	scanner.Scan()
+	if !strings.Contains(scanner.Text(), " AUTH=EXTERNAL") {
+		t.Fatal("EXTERNAL not advertised:", scanner.Text())
+	}
+	scanner.Scan()
+
+	io.WriteString(c, "a002 AUTHENTICATE EXTERNAL =\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_External_Identity(t *testing.T) {
+	s, c, scanner := testServerExternal(t, nil)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 AUTHENTICATE EXTERNAL\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "+") {
+		t.Fatal("Bad continuation request:", scanner.Text())
+	}
+
+	io.WriteString(c, base64.StdEncoding.EncodeToString([]byte("root"))+"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_External_NoCertificate(t *testing.T) {
+	s, c, scanner := testServerExternal(t, []tls.Certificate{})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 CAPABILITY\r\n")
+	scanner.Scan()
+	if strings.Contains(scanner.Text(), "AUTH=EXTERNAL") {
+		t.Fatal("EXTERNAL advertised without client certificate:", scanner.Text())
+	}
+	scanner.Scan()
+
+	io.WriteString(c, "a002 AUTHENTICATE EXTERNAL =\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
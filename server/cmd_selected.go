@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 
 	"github.com/linanh/go-imap"
@@ -15,6 +16,27 @@ var (
 	ErrMailboxReadOnly   = errors.New("Mailbox opened in read-only mode")
 )
 
+// errCommandTimeout is returned when a backend operation exceeds
+// Server.CommandTimeout.
+var errCommandTimeout = &imap.StatusError{Code: imap.CodeLimit, Info: "Operation took too long"}
+
+// commandContext returns the context of a potentially long backend operation,
+// with the server's CommandTimeout.
+func commandContext(conn Conn) (context.Context, context.CancelFunc) {
+	ctx := conn.Context().Ctx
+	if d := conn.Server().CommandTimeout; d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+func commandContextErr(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errCommandTimeout
+	}
+	return err
+}
+
 // A command handler that supports UIDs.
 type UidHandler interface {
 	Handler
@@ -52,6 +74,7 @@ func (cmd *Close) Handle(conn Conn) error {
 	mailbox := ctx.Mailbox
 	ctx.Mailbox = nil
 	ctx.MailboxReadOnly = false
+	conn.mailboxView().reset(nil, nil, false)
 
 	// No need to send expunge updates here, since the mailbox is already unselected
 	_, err := mailbox.Expunge(nil)
@@ -90,7 +113,7 @@ func (cmd *Expunge) Handle(conn Conn) error {
 		}
 	}
 
-	_, err = ctx.Mailbox.Expunge(nil)
+	_, err = backend.MailboxWithContext(ctx.Mailbox).ExpungeContext(ctx.Ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -129,7 +152,7 @@ func (cmd *Expunge) Handle(conn Conn) error {
 }
 
 func (cmd *Expunge) UidHandle(conn Conn) error {
-	if _, ok := conn.Server().backendExts["UIDPLUS"]; !ok {
+	if !supportsExtension(conn, "UIDPLUS") {
 		return errors.New("Unknown command")
 	}
 	if cmd.SeqSet == nil {
@@ -144,7 +167,7 @@ func (cmd *Expunge) UidHandle(conn Conn) error {
 		return ErrMailboxReadOnly
 	}
 
-	_, err := ctx.Mailbox.Expunge([]backend.ExtensionOption{
+	_, err := backend.MailboxWithContext(ctx.Mailbox).ExpungeContext(ctx.Ctx, []backend.ExtensionOption{
 		backend.ExpungeSeqSet{SeqSet: cmd.SeqSet},
 	})
 	return err
@@ -152,6 +175,12 @@ func (cmd *Expunge) UidHandle(conn Conn) error {
 
 type Search struct {
 	commands.Search
+
+	tag string
+}
+
+func (cmd *Search) setTag(tag string) {
+	cmd.tag = tag
 }
 
 func (cmd *Search) handle(uid bool, conn Conn) error {
@@ -160,12 +189,63 @@ func (cmd *Search) handle(uid bool, conn Conn) error {
 		return ErrNoMailboxSelected
 	}
 
-	ids, _, err := ctx.Mailbox.SearchMessages(uid, cmd.Criteria, nil)
+	esearch := cmd.Return != nil || imap4rev2(conn)
+	if cmd.Return != nil && !imap4rev2Supported(conn) {
+		return errors.New("Unsupported SEARCH return options")
+	}
+	for _, opt := range cmd.Return {
+		switch opt {
+		case "MIN", "MAX", "ALL", "COUNT":
+		default:
+			return errors.New("Unsupported SEARCH return option: " + opt)
+		}
+	}
+
+	bctx, cancel := commandContext(conn)
+	defer cancel()
+
+	view := conn.mailboxView()
+	translate := view.translating()
+	criteria := cmd.Criteria
+	if translate {
+		criteria = view.searchCriteria(criteria)
+	}
+
+	ids, _, err := backend.MailboxWithContext(ctx.Mailbox).SearchMessagesContext(bctx, uid || translate, criteria, nil)
 	if err != nil {
-		return err
+		return commandContextErr(err)
+	}
+	if translate && !uid {
+		seqNums := make([]uint32, 0, len(ids))
+		for _, id := range ids {
+			if seqNum := view.seqNum(id); seqNum != 0 {
+				seqNums = append(seqNums, seqNum)
+			}
+		}
+		ids = seqNums
+	}
+
+	if !esearch {
+		res := &responses.Search{Ids: ids}
+		return conn.WriteResp(res)
 	}
 
-	res := &responses.Search{Ids: ids}
+	res := &responses.ESearch{
+		Tag:    cmd.tag,
+		Uid:    uid,
+		Return: cmd.Return,
+		Count:  uint32(len(ids)),
+		All:    new(imap.SeqSet),
+	}
+	for _, id := range ids {
+		if res.Min == 0 || id < res.Min {
+			res.Min = id
+		}
+		if id > res.Max {
+			res.Max = id
+		}
+		res.All.AddNum(id)
+	}
 	return conn.WriteResp(res)
 }
 
@@ -187,23 +267,84 @@ func (cmd *Fetch) handle(uid bool, conn Conn) error {
 		return ErrNoMailboxSelected
 	}
 
+	bctx, cancel := commandContext(conn)
+	defer cancel()
+
 	ch := make(chan *imap.Message)
 	res := &responses.Fetch{Messages: ch}
 
+	// If the client's sequence numbers differ from the backend's ones, fetch
+	// messages by UID and compute sequence numbers from the mailbox view
+	seqset, items, out := cmd.SeqSet, cmd.Items, ch
+	view := conn.mailboxView()
+	translating := view.translating()
+	hasUid := true
+	if translating {
+		if !uid {
+			uid, seqset = true, view.uidSet(cmd.SeqSet)
+		}
+
+		hasUid = false
+		for _, item := range items {
+			if item == imap.FetchUid {
+				hasUid = true
+				break
+			}
+		}
+		if !hasUid {
+			items = append(items[:len(items):len(items)], imap.FetchUid)
+		}
+	}
+
+	metrics := conn.Server().Metrics
+	rev2 := imap4rev2(conn)
+	if translating || metrics != nil || rev2 {
+		out = make(chan *imap.Message)
+		go func() {
+			defer close(ch)
+			for msg := range out {
+				if rev2 {
+					msg.Flags = removeRecent(msg.Flags)
+				}
+				if translating {
+					msg.SeqNum = view.seqNum(msg.Uid)
+					if msg.SeqNum == 0 {
+						// Not known by the client yet
+						continue
+					}
+					if !hasUid {
+						delete(msg.Items, imap.FetchUid)
+					}
+				}
+				if metrics != nil {
+					if n := messageLiteralBytes(msg); n > 0 {
+						metrics.LiteralBytesOut(n)
+					}
+				}
+				ch <- msg
+			}
+		}()
+	}
+
 	done := make(chan error, 1)
 	go (func() {
-		done <- conn.WriteResp(res)
+		err := conn.WriteResp(res)
+		if err != nil {
+			// Stop fetching messages nobody will read
+			cancel()
+		}
+		done <- err
 		// Make sure to drain the message channel.
 		for _ = range ch {
 		}
 	})()
 
-	_, err := ctx.Mailbox.ListMessages(uid, cmd.SeqSet, cmd.Items, ch, nil)
+	_, err := backend.MailboxWithContext(ctx.Mailbox).ListMessagesContext(bctx, uid, seqset, items, out, nil)
+	writeErr := <-done
 	if err != nil {
-		return err
+		return commandContextErr(err)
 	}
-
-	return <-done
+	return writeErr
 }
 
 func (cmd *Fetch) Handle(conn Conn) error {
@@ -270,7 +411,8 @@ func (cmd *Store) handle(uid bool, conn Conn) error {
 	// from receiving them
 	// TODO: find a better way to do this, without conn.silent
 	*conn.silent() = silent
-	_, err = ctx.Mailbox.UpdateMessagesFlags(uid, cmd.SeqSet, op, flags, nil)
+	backendUid, seqset := sessionSeqSet(conn, uid, cmd.SeqSet)
+	_, err = backend.MailboxWithContext(ctx.Mailbox).UpdateMessagesFlagsContext(ctx.Ctx, backendUid, seqset, op, flags, nil)
 	*conn.silent() = false
 	if err != nil {
 		return err
@@ -312,9 +454,10 @@ func (cmd *Copy) handle(uid bool, conn Conn) error {
 		return ErrNoMailboxSelected
 	}
 
-	resp, err := ctx.Mailbox.CopyMessages(uid, cmd.SeqSet, cmd.Mailbox, nil)
+	uid, seqset := sessionSeqSet(conn, uid, cmd.SeqSet)
+	resp, err := backend.MailboxWithContext(ctx.Mailbox).CopyMessagesContext(ctx.Ctx, uid, seqset, cmd.Mailbox, nil)
 	if err != nil {
-		if err == backend.ErrNoSuchMailbox {
+		if errors.Is(err, backend.ErrNoSuchMailbox) {
 			return ErrStatusResp(&imap.StatusResp{
 				Type: imap.StatusRespNo,
 				Code: imap.CodeTryCreate,
@@ -358,12 +501,161 @@ func (cmd *Copy) UidHandle(conn Conn) error {
 	return cmd.handle(true, conn)
 }
 
+type Move struct {
+	commands.Move
+}
+
+func (cmd *Move) handle(uid bool, conn Conn) error {
+	ctx := conn.Context()
+	if !imap4rev2Supported(conn) {
+		return errors.New("Unknown command")
+	}
+	if ctx.Mailbox == nil {
+		return ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return ErrMailboxReadOnly
+	}
+
+	uid, cmd.SeqSet = sessionSeqSet(conn, uid, cmd.SeqSet)
+
+	// Get the sequence numbers of the messages that will be moved, to send
+	// expunge updates if the backend doesn't support it
+	var seqnums []uint32
+	if conn.Server().Updates == nil {
+		criteria := &imap.SearchCriteria{SeqNum: cmd.SeqSet}
+		if uid {
+			criteria = &imap.SearchCriteria{Uid: cmd.SeqSet}
+		}
+		var err error
+		seqnums, _, err = ctx.Mailbox.SearchMessages(false, criteria, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	var res []backend.ExtensionResult
+	var err error
+	if mbox, ok := ctx.Mailbox.(backend.MoveMailbox); ok {
+		res, err = mbox.MoveMessages(uid, cmd.SeqSet, cmd.Mailbox, nil)
+	} else {
+		res, err = cmd.emulate(uid, conn)
+	}
+	if errors.Is(err, backend.ErrNoSuchMailbox) {
+		return ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: "No such mailbox",
+		})
+	} else if err != nil {
+		return err
+	}
+
+	// RFC 6851 section 4.3: COPYUID is sent in an untagged OK response before
+	// the expunge responses
+	for _, value := range res {
+		switch value := value.(type) {
+		case backend.CopyUIDs:
+			err := conn.WriteResp(&imap.StatusResp{
+				Type: imap.StatusRespOk,
+				Code: "COPYUID",
+				Arguments: []interface{}{
+					value.UIDValidity,
+					value.Source,
+					value.Dest,
+				},
+			})
+			if err != nil {
+				return err
+			}
+		default:
+			conn.Server().ErrorLog.Printf("ExtensionResult of unknown type returned by backend: %T", value)
+		}
+	}
+
+	// If the backend doesn't support expunge updates, let's do it ourselves.
+	// Iterate sequence numbers from the last one to the first one, as deleting
+	// messages changes their respective numbers.
+	if len(seqnums) > 0 {
+		ch := make(chan uint32, len(seqnums))
+		for i := len(seqnums) - 1; i >= 0; i-- {
+			ch <- seqnums[i]
+		}
+		close(ch)
+
+		if err := conn.WriteResp(&responses.Expunge{SeqNums: ch}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// emulate moves messages with COPY, STORE and UID EXPUNGE, for mailboxes which
+// don't implement backend.MoveMailbox.
+func (cmd *Move) emulate(uid bool, conn Conn) ([]backend.ExtensionResult, error) {
+	if !supportsExtension(conn, "UIDPLUS") {
+		return nil, errors.New("MOVE is not supported by this mailbox")
+	}
+
+	mbox := conn.Context().Mailbox
+
+	criteria := &imap.SearchCriteria{SeqNum: cmd.SeqSet}
+	if uid {
+		criteria = &imap.SearchCriteria{Uid: cmd.SeqSet}
+	}
+	uids, _, err := mbox.SearchMessages(true, criteria, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(uids) == 0 {
+		return nil, nil
+	}
+	uidSet := new(imap.SeqSet)
+	uidSet.AddNum(uids...)
+
+	res, err := mbox.CopyMessages(true, uidSet, cmd.Mailbox, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	*conn.silent() = true
+	_, err = mbox.UpdateMessagesFlags(true, uidSet, imap.AddFlags, []string{imap.DeletedFlag}, nil)
+	*conn.silent() = false
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := mbox.Expunge([]backend.ExtensionOption{
+		backend.ExpungeSeqSet{SeqSet: uidSet},
+	}); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (cmd *Move) Handle(conn Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *Move) UidHandle(conn Conn) error {
+	return cmd.handle(true, conn)
+}
+
 type Uid struct {
 	commands.Uid
+
+	tag string
+}
+
+func (cmd *Uid) setTag(tag string) {
+	cmd.tag = tag
 }
 
 func (cmd *Uid) Handle(conn Conn) error {
 	inner := cmd.Cmd.Command()
+	inner.Tag = cmd.tag
 	hdlr, err := conn.commandHandler(inner)
 	if err != nil {
 		return err
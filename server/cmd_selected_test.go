@@ -2,11 +2,16 @@ package server_test
 
 import (
 	"bufio"
+	"context"
 	"io"
 	"net"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/backend/memory"
 	"github.com/linanh/go-imap/server"
 )
 
@@ -582,3 +587,399 @@ func TestUid_InvalidCommand(t *testing.T) {
 		t.Fatal("Invalid status response:", scanner.Text())
 	}
 }
+
+func testServerIMAP4rev2Selected(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner) {
+	s, c, scanner = testServerIMAP4rev2(t)
+
+	io.WriteString(c, "a000 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a000 ") {
+			break
+		}
+	}
+	return
+}
+
+func TestSearch_ESearch(t *testing.T) {
+	s, c, scanner := testServerIMAP4rev2Selected(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 SEARCH UNDELETED\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* ESEARCH (TAG "a001") ALL 1` {
+		t.Fatal("Invalid ESEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 UID SEARCH RETURN (MIN COUNT) ALL\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* ESEARCH (TAG "a002") UID MIN 6 COUNT 1` {
+		t.Fatal("Invalid ESEARCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestIMAP4rev2_FetchRecent(t *testing.T) {
+	s, c, scanner := testServerIMAP4rev2Selected(t)
+	defer s.Close()
+	defer c.Close()
+
+	// IMAP4rev2 removes \Recent
+	io.WriteString(c, "a001 STORE 1 +FLAGS (\\Recent)\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* 1 FETCH (FLAGS (\Seen))` {
+		t.Fatal("Invalid FETCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 FETCH 1 (FLAGS)\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* 1 FETCH (FLAGS (\Seen))` {
+		t.Fatal("Invalid FETCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+func TestMove(t *testing.T) {
+	s, c, scanner := testServerIMAP4rev2Selected(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 CREATE Archive\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "a002 MOVE 1 Archive\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* 1 EXPUNGE" {
+		t.Fatal("Invalid EXPUNGE response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a003 STATUS Archive (MESSAGES)\r\n")
+	scanner.Scan()
+	if scanner.Text() != `* STATUS "Archive" (MESSAGES 1)` {
+		t.Fatal("Invalid STATUS response:", scanner.Text())
+	}
+}
+
+func TestMove_NotSupported(t *testing.T) {
+	s, c, scanner := testServerSelected(t, false)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 MOVE 1 Archive\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+}
+
+// slowBackend is a memory backend whose searches block until unblock is
+// closed, as well as fetches if blockFetch is set. It records the context of
+// the last connection which logged in.
+type slowBackend struct {
+	*memory.Backend
+	unblock    chan struct{}
+	ctx        chan context.Context
+	blockFetch bool
+}
+
+type slowUser struct {
+	backend.User
+	be *slowBackend
+}
+
+type slowMailbox struct {
+	backend.Mailbox
+	be *slowBackend
+}
+
+func newSlowBackend() *slowBackend {
+	return &slowBackend{
+		Backend: memory.New(),
+		unblock: make(chan struct{}),
+		ctx:     make(chan context.Context, 1),
+	}
+}
+
+func (be *slowBackend) Login(connInfo interface{}, username, password string) (backend.User, error) {
+	user, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	be.ctx <- connInfo.(server.Conn).Context().Ctx
+	return &slowUser{user, be}, nil
+}
+
+func (u *slowUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &slowMailbox{mbox, u.be}, nil
+}
+
+func (mbox *slowMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria, opts []backend.ExtensionOption) ([]uint32, []backend.ExtensionResult, error) {
+	<-mbox.be.unblock
+	return mbox.Mailbox.SearchMessages(uid, criteria, opts)
+}
+
+func (mbox *slowMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message, opts []backend.ExtensionOption) ([]backend.ExtensionResult, error) {
+	if mbox.be.blockFetch {
+		<-mbox.be.unblock
+	}
+	return mbox.Mailbox.ListMessages(uid, seqset, items, ch, opts)
+}
+
+func TestSearch_CommandTimeout(t *testing.T) {
+	be := newSlowBackend()
+	defer close(be.unblock)
+
+	s, c := testServerWithConfig(t, be, func(s *server.Server) {
+		s.CommandTimeout = 10 * time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a001 ") {
+			break
+		}
+	}
+
+	io.WriteString(c, "a002 SEARCH ALL\r\n")
+	scanner.Scan()
+	if scanner.Text() != "a002 NO [LIMIT] Operation took too long" {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestConn_ContextCancelledOnLogout(t *testing.T) {
+	be := newSlowBackend()
+	defer close(be.unblock)
+
+	s, c := testServerWithBackend(t, be)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan()
+	ctx := <-be.ctx
+	if err := ctx.Err(); err != nil {
+		t.Fatal("Context done before LOGOUT:", err)
+	}
+
+	io.WriteString(c, "a001 LOGOUT\r\n")
+	scanner.Scan() // BYE
+	scanner.Scan() // OK
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Context not cancelled after LOGOUT")
+	}
+}
+
+func TestConn_ContextCancelledOnDisconnect(t *testing.T) {
+	be := newSlowBackend()
+	defer close(be.unblock)
+
+	s, c := testServerWithConfig(t, be, func(s *server.Server) {
+		s.MaxConcurrentCommands = 4
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan()
+	ctx := <-be.ctx
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a001 ") {
+			break
+		}
+	}
+
+	// The client disconnects while SEARCH is blocked
+	io.WriteString(c, "a002 SEARCH ALL\r\n")
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Context not cancelled after disconnection")
+	}
+}
+
+func TestConn_ContextCancelledOnDisconnectDuringFetch(t *testing.T) {
+	be := newSlowBackend()
+	be.blockFetch = true
+	defer close(be.unblock)
+
+	s, c := testServerWithBackend(t, be)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := login(t, c, "username")
+	ctx := <-be.ctx
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a002 ") {
+			break
+		}
+	}
+
+	// The client disconnects while FETCH is blocked
+	io.WriteString(c, "a003 FETCH 1 (BODY[])\r\n")
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Context not cancelled after disconnection")
+	}
+}
+
+func TestConn_ConcurrentCommands(t *testing.T) {
+	be := newSlowBackend()
+	defer close(be.unblock)
+
+	s, c := testServerWithConfig(t, be, func(s *server.Server) {
+		s.MaxConcurrentCommands = 4
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a001 ") {
+			break
+		}
+	}
+
+	// NOOP completes while SEARCH is blocked
+	io.WriteString(c, "a002 SEARCH ALL\r\n")
+	io.WriteString(c, "a003 NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	// EXAMINE changes the state of the session: it waits for SEARCH
+	io.WriteString(c, "a004 EXAMINE INBOX\r\n")
+	time.Sleep(10 * time.Millisecond)
+	be.unblock <- struct{}{}
+
+	scanner.Scan()
+	if scanner.Text() != "* SEARCH 1" {
+		t.Fatal("Bad search response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a004 ") {
+			break
+		}
+	}
+	if !strings.HasPrefix(scanner.Text(), "a004 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestConn_ConcurrentFetch(t *testing.T) {
+	be := newSlowBackend()
+	defer close(be.unblock)
+
+	s, c := testServerWithConfig(t, be, func(s *server.Server) {
+		s.MaxConcurrentCommands = 4
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a001 ") {
+			break
+		}
+	}
+
+	// FETCH BODY.PEEK completes while SEARCH is blocked
+	io.WriteString(c, "a002 SEARCH ALL\r\n")
+	io.WriteString(c, "a003 FETCH 1 (FLAGS BODY.PEEK[TEXT])\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "* 1 FETCH ") {
+		t.Fatal("Bad fetch response:", scanner.Text())
+	}
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a003 ") {
+			break
+		}
+	}
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	// FETCH BODY sets the \Seen flag: it waits for SEARCH
+	io.WriteString(c, "a004 FETCH 1 (BODY[TEXT])\r\n")
+	time.Sleep(10 * time.Millisecond)
+	be.unblock <- struct{}{}
+
+	scanner.Scan()
+	if scanner.Text() != "* SEARCH 1" {
+		t.Fatal("Bad search response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a004 ") {
+			break
+		}
+	}
+	if !strings.HasPrefix(scanner.Text(), "a004 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
@@ -1,16 +1,21 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/linanh/go-imap"
 	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/commands"
 )
 
 // Conn is a connection to a client.
@@ -37,9 +42,20 @@ type Conn interface {
 	WaitReady()
 
 	Info() *imap.ConnInfo
+	// ListenerConfig returns the configuration of the listener this connection
+	// has been accepted on.
+	ListenerConfig() *ListenerConfig
 
 	setTLSConn(*tls.Conn)
+	isCompressed() bool
+	enable(cap string) bool
 	silent() *bool // TODO: remove this
+	mailboxView() *mailboxView
+	updateQueue() *updateQueue
+	debugCapture() *debugCapture
+	activity() *activity
+	session() session
+	updateSession()
 	serve(Conn) error
 	commandHandler(cmd *imap.Command) (hdlr Handler, err error)
 }
@@ -58,6 +74,18 @@ type Context struct {
 	Responses chan<- imap.WriterTo
 	// Closed when the client is logged out.
 	LoggedOut <-chan struct{}
+	// Capabilities enabled by the client with the ENABLE command.
+	Enabled map[string]bool
+	// The client identification sent with the ID command, nil if the client
+	// hasn't sent any.
+	ClientID map[string]string
+	// Ctx is cancelled when the client disconnects, logs out or is logged out
+	// automatically, including while a command is being handled. It should be
+	// passed to context-aware backends, see backend.BackendContext.
+	Ctx context.Context
+	// If the server's backend is a TenantRouter and the client is logged in,
+	// the tenant the client has authenticated to.
+	Tenant *Tenant
 }
 
 type conn struct {
@@ -67,14 +95,29 @@ type conn struct {
 	s         *Server
 	ctx       *Context
 	tlsConn   *tls.Conn
+	proxy     *proxyConn
+	listener  *ListenerConfig
 	continues chan bool
 	upgrade   chan bool
 	responses chan imap.WriterTo
 	loggedOut chan struct{}
 	silentVal bool
+	cancel    context.CancelFunc
+	view      mailboxView
+	updates   updateQueue
+	// Limits the number of concurrent commands, nil if disabled
+	slots    chan struct{}
+	inflight sync.WaitGroup
+	// Mirrors network activity for debugging
+	debug *debugCapture
+	// Time of the last command
+	active activity
+	// State of the connection, for other goroutines
+	snapshot   sessionSnapshot
+	logoutOnce sync.Once
 }
 
-func newConn(s *Server, c net.Conn) *conn {
+func newConn(s *Server, c net.Conn, cfg *ListenerConfig) *conn {
 	// Create an imap.Reader and an imap.Writer
 	continues := make(chan bool)
 	r := imap.NewServerReader(nil, continues)
@@ -84,29 +127,42 @@ func newConn(s *Server, c net.Conn) *conn {
 	loggedOut := make(chan struct{})
 
 	tlsConn, _ := c.(*tls.Conn)
+	proxy, _ := c.(*proxyConn)
+	ctx, cancel := context.WithCancel(context.Background())
 
 	conn := &conn{
-		Conn: imap.NewConn(c, r, w),
-
 		s: s,
 		ctx: &Context{
 			State:     imap.ConnectingState,
 			Responses: responses,
 			LoggedOut: loggedOut,
+			Enabled:   make(map[string]bool),
+			Ctx:       ctx,
 		},
 		tlsConn:   tlsConn,
+		proxy:     proxy,
+		listener:  cfg,
 		continues: continues,
 		upgrade:   make(chan bool),
 		responses: responses,
 		loggedOut: loggedOut,
+		cancel:    cancel,
+		active:    activity{started: time.Now()},
 	}
 
-	if s.Debug != nil {
-		conn.Conn.SetDebug(s.Debug)
-	}
+	// Cancel the context as soon as the client disconnects, even while a
+	// command is being handled
+	watched := newWatchedConn(c, cancel)
+	conn.Conn = imap.NewConn(activityConn{watched, &conn.active}, r, w)
+
+	// Debug capture can be enabled at runtime, so network activity is always
+	// mirrored to the connection's debugCapture
+	conn.debug = newDebugCapture(s.Debug, s.DebugRedaction)
+	conn.Conn.SetDebug(imap.NewDebugWriter(&conn.debug.local, &conn.debug.remote))
 	if s.MaxLiteralSize > 0 {
 		conn.Conn.MaxLiteralSize = s.MaxLiteralSize
 	}
+	conn.updateSession()
 
 	go conn.send()
 
@@ -121,6 +177,10 @@ func (c *conn) Context() *Context {
 	return c.ctx
 }
 
+func (c *conn) ListenerConfig() *ListenerConfig {
+	return c.listener
+}
+
 type response struct {
 	response imap.WriterTo
 	done     chan struct{}
@@ -147,6 +207,11 @@ func (c *conn) setDeadline() {
 }
 
 func (c *conn) WriteResp(r imap.WriterTo) error {
+	if _, ok := r.(*imap.ContinuationReq); ok {
+		// Recorded before the client can reply
+		c.active.wait()
+	}
+
 	done := make(chan struct{})
 	c.responses <- &response{r, done}
 	<-done
@@ -155,41 +220,95 @@ func (c *conn) WriteResp(r imap.WriterTo) error {
 }
 
 func (c *conn) Close() error {
-	if c.ctx.User != nil {
-		c.ctx.User.Logout()
-	}
+	c.cancel()
+	// Close can be called several times, e.g. by Server.Shutdown and when the
+	// connection is done
+	c.logoutOnce.Do(func() {
+		if c.ctx.User != nil {
+			c.ctx.User.Logout()
+		}
+	})
 
 	return c.Conn.Close()
 }
 
 func (c *conn) Capabilities() []string {
-	caps := []string{"IMAP4rev1", "LITERAL+", "SASL-IR", "CHILDREN"}
+	rev2 := imap4rev2Supported(c)
+	caps := []string{"IMAP4rev1"}
+	if rev2 {
+		caps = append(caps, "IMAP4rev2")
+	}
+	caps = append(caps, "LITERAL+", "SASL-IR", "CHILDREN", "ID")
 
 	if c.ctx.State == imap.NotAuthenticatedState {
-		if !c.IsTLS() && c.s.TLSConfig != nil {
+		if !c.IsTLS() && c.s.tlsConfig(c.listener) != nil {
 			caps = append(caps, "STARTTLS")
 		}
 
 		if !c.canAuth() {
 			caps = append(caps, "LOGINDISABLED")
 		} else {
+			if !c.listener.mechanismAllowed(sasl.Plain) {
+				// LOGIN sends a password in plain text, like PLAIN
+				caps = append(caps, "LOGINDISABLED")
+			}
 			for name := range c.s.auths {
+				if !c.listener.mechanismAllowed(name) {
+					continue
+				}
+				// Channel binding requires TLS
+				if strings.HasSuffix(name, scramPlusSuffix) && !c.IsTLS() {
+					continue
+				}
+				// EXTERNAL requires a verified client certificate
+				if name == sasl.External && peerCertificate(c) == nil {
+					continue
+				}
+				// The tenant's backend may not support the mechanism
+				if r, ok := c.s.Backend.(*TenantRouter); ok && !r.mechanismSupported(c, name) {
+					continue
+				}
 				caps = append(caps, "AUTH="+name)
 			}
 		}
 	}
 
-	for _, ext := range c.Server().Backend.SupportedExtensions() {
+	var canEnable bool
+	for _, ext := range connBackend(c).SupportedExtensions() {
 		switch ext {
 		case "UIDPLUS":
 			caps = append(caps, "UIDPLUS")
+		case "UTF8=ACCEPT":
+			caps = append(caps, "UTF8=ACCEPT")
+			canEnable = true
 		}
 	}
+	if rev2 {
+		caps = append(caps, "NAMESPACE", "MOVE", "ESEARCH", "LIST-EXTENDED", "LIST-STATUS")
+		canEnable = true
+	}
+	if canEnable {
+		caps = append(caps, "ENABLE")
+	}
+	if c.s.Compress && c.ctx.State&imap.AuthenticatedState != 0 {
+		caps = append(caps, "COMPRESS="+imap.CompressDeflate)
+	}
 
 	for _, ext := range c.s.extensions {
 		caps = append(caps, ext.Capabilities(c)...)
 	}
 
+	tenant := connTenant(c)
+	if len(c.listener.DisabledCapabilities) > 0 || (tenant != nil && len(tenant.DisabledCapabilities) > 0) {
+		enabled := caps[:0]
+		for _, cap := range caps {
+			if !c.capabilityDisabled(tenant, cap) {
+				enabled = append(enabled, cap)
+			}
+		}
+		caps = enabled
+	}
+
 	return caps
 }
 
@@ -211,15 +330,15 @@ func (c *conn) send() {
 			// Send continuation requests
 			if needCont {
 				resp := &imap.ContinuationReq{Info: "send literal"}
-				if err := c.writeAndFlush(resp); err != nil && c.s.LogPrintNetConnErr {
-					c.Server().ErrorLog.Println("cannot send continuation request: ", err)
+				if err := c.writeAndFlush(resp); err != nil {
+					c.writeFailed("cannot send continuation request: ", err)
 				}
 			}
 		case res := <-c.responses:
 			// Got a response that needs to be sent
 			// Request to send the response
-			if err := c.writeAndFlush(res); err != nil && c.s.LogPrintNetConnErr {
-				c.Server().ErrorLog.Println("cannot send response: ", err)
+			if err := c.writeAndFlush(res); err != nil {
+				c.writeFailed("cannot send response: ", err)
 			}
 		case <-c.loggedOut:
 			return
@@ -227,8 +346,18 @@ func (c *conn) send() {
 	}
 }
 
+// writeFailed is called when a response cannot be written: the client is gone,
+// so the command being handled is cancelled.
+func (c *conn) writeFailed(msg string, err error) {
+	c.cancel()
+	if c.s.LogPrintNetConnErr {
+		c.Server().ErrorLog.Println(msg, err)
+	}
+}
+
 func (c *conn) greet() error {
 	c.ctx.State = imap.NotAuthenticatedState
+	c.updateSession()
 
 	caps := c.Capabilities()
 	args := make([]interface{}, len(caps))
@@ -251,7 +380,24 @@ func (c *conn) setTLSConn(tlsConn *tls.Conn) {
 }
 
 func (c *conn) IsTLS() bool {
-	return c.tlsConn != nil
+	return c.tlsConn != nil || (c.proxy != nil && c.proxy.TLSTerminated())
+}
+
+func (c *conn) Info() *imap.ConnInfo {
+	info := c.Conn.Info()
+	if info.TLS == nil && c.tlsConn != nil {
+		// With implicit TLS, the TLS connection is wrapped by a watchedConn
+		state := c.tlsConn.ConnectionState()
+		info.TLS = &state
+		info.ServerName = state.ServerName
+	}
+	if c.proxy != nil && c.proxy.TLSTerminated() {
+		info.TLSTerminated = true
+		if info.ServerName == "" {
+			info.ServerName = c.proxy.ServerName()
+		}
+	}
+	return info
 }
 
 func (c *conn) TLSState() *tls.ConnectionState {
@@ -262,8 +408,22 @@ func (c *conn) TLSState() *tls.ConnectionState {
 	return nil
 }
 
-// canAuth checks if the client can use plain text authentication.
+func (c *conn) isCompressed() bool {
+	return c.Conn.IsCompressed()
+}
+
+// canAuth checks if the client can use plain text authentication, according
+// to the listener's AuthPolicy.
 func (c *conn) canAuth() bool {
+	switch c.listener.AuthPolicy {
+	case AuthDisabled:
+		return false
+	case AuthRequireTLS:
+		return c.IsTLS()
+	case AuthAllowInsecure:
+		return true
+	}
+
 	canAuthResult := c.IsTLS() || c.s.AllowInsecureAuth
 
 	//check secure network
@@ -280,15 +440,93 @@ func (c *conn) canAuth() bool {
 	return canAuthResult
 }
 
+// enable enables a capability requested with the ENABLE command. It returns
+// false if the capability cannot be enabled or was already enabled.
+func (c *conn) enable(cap string) bool {
+	cap = strings.ToUpper(cap)
+	if !enableableCaps[cap] || c.ctx.Enabled[cap] {
+		return false
+	}
+
+	advertised := false
+	for _, advertisedCap := range c.conn.Capabilities() {
+		if strings.EqualFold(advertisedCap, cap) {
+			advertised = true
+			break
+		}
+	}
+	if !advertised {
+		return false
+	}
+
+	c.ctx.Enabled[cap] = true
+	if cap == "UTF8=ACCEPT" || cap == "IMAP4REV2" {
+		c.WriteResp(allowUTF8{})
+	}
+	return true
+}
+
+// allowUTF8 permits UTF-8 in quoted strings. It is sent as a response, so that
+// the writer is only modified by the goroutine writing responses.
+type allowUTF8 struct{}
+
+func (allowUTF8) WriteTo(w *imap.Writer) error {
+	w.AllowUTF8 = true
+	return nil
+}
+
+// utf8Enabled checks whether the client has enabled UTF-8 mailbox names and
+// quoted strings, either with UTF8=ACCEPT or IMAP4rev2.
+func (c *conn) utf8Enabled() bool {
+	return c.ctx.Enabled["UTF8=ACCEPT"] || c.ctx.Enabled["IMAP4REV2"]
+}
+
+// hasUTF8 checks if fields contain 8-bit data outside literals.
+func hasUTF8(fields []interface{}) bool {
+	for _, f := range fields {
+		switch f := f.(type) {
+		case string:
+			for i := 0; i < len(f); i++ {
+				if f[i] >= 0x80 {
+					return true
+				}
+			}
+		case []interface{}:
+			if hasUTF8(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (c *conn) silent() *bool {
 	return &c.silentVal
 }
 
+func (c *conn) mailboxView() *mailboxView {
+	return &c.view
+}
+
+func (c *conn) updateQueue() *updateQueue {
+	return &c.updates
+}
+
+func (c *conn) debugCapture() *debugCapture {
+	return c.debug
+}
+
+func (c *conn) activity() *activity {
+	return &c.active
+}
+
 func (c *conn) serve(conn Conn) (err error) {
 	c.conn = conn
 
 	defer func() {
 		c.ctx.State = imap.LogoutState
+		c.updateSession()
+		c.cancel()
 		close(c.loggedOut)
 	}()
 
@@ -306,6 +544,16 @@ func (c *conn) serve(conn Conn) (err error) {
 		}
 	}()
 
+	if c.s.MaxConcurrentCommands > 1 {
+		c.slots = make(chan struct{}, c.s.MaxConcurrentCommands)
+	}
+	// Concurrent commands must complete before the connection is logged out.
+	// They are cancelled first, e.g. if the client has disconnected.
+	defer func() {
+		c.cancel()
+		c.inflight.Wait()
+	}()
+
 	// Send greeting
 	if err := c.greet(); err != nil {
 		return err
@@ -315,6 +563,14 @@ func (c *conn) serve(conn Conn) (err error) {
 		if c.ctx.State == imap.LogoutState {
 			return nil
 		}
+		if c.s.shuttingDown() {
+			// Concurrent commands must complete before BYE
+			c.inflight.Wait()
+			return c.WriteResp(&imap.StatusResp{
+				Type: imap.StatusRespBye,
+				Info: c.s.shutdownReason(),
+			})
+		}
 
 		var res *imap.StatusResp
 		var up Upgrader
@@ -324,6 +580,7 @@ func (c *conn) serve(conn Conn) (err error) {
 			return nil
 		}
 		c.setDeadline()
+		c.active.begin()
 
 		if err != nil {
 			if imap.IsParseError(err) {
@@ -345,35 +602,116 @@ func (c *conn) serve(conn Conn) (err error) {
 					Type: imap.StatusRespBad,
 					Info: err.Error(),
 				}
-			} else {
-				var err error
-				res, up, err = c.handleCommand(cmd)
-				if err != nil {
-					res = &imap.StatusResp{
-						Tag:  cmd.Tag,
-						Type: imap.StatusRespBad,
-						Info: err.Error(),
-					}
+			} else if !c.utf8Enabled() && hasUTF8(cmd.Arguments) {
+				res = &imap.StatusResp{
+					Tag:  cmd.Tag,
+					Type: imap.StatusRespBad,
+					Info: "8-bit data is only allowed in literals unless UTF8=ACCEPT is enabled",
 				}
+			} else if c.slots != nil && concurrentCommand(cmd, c.ctx.MailboxReadOnly) {
+				c.slots <- struct{}{}
+				c.inflight.Add(1)
+				go c.serveConcurrent(cmd)
+				continue
+			} else {
+				// Other commands wait until concurrent commands have completed
+				c.inflight.Wait()
+
+				res, up = c.handleCommand(cmd)
 			}
 		}
 
 		if res != nil {
-
 			if err := c.WriteResp(res); err != nil {
 				if c.s.LogPrintNetConnErr {
 					c.s.ErrorLog.Println("cannot write response:", err)
 				}
-				continue
-			}
-
-			if up != nil && res.Type == imap.StatusRespOk {
+			} else if up != nil && res.Type == imap.StatusRespOk {
 				if err := up.Upgrade(c.conn); err != nil {
 					c.s.ErrorLog.Println("cannot upgrade connection:", err)
 					return err
 				}
+				c.updateSession()
 			}
 		}
+		c.active.end()
+	}
+}
+
+// concurrentCommand checks if a command can be processed concurrently with
+// other ones, because it doesn't change the state of the session. readOnly is
+// true if the selected mailbox is read-only.
+func concurrentCommand(cmd *imap.Command, readOnly bool) bool {
+	name := cmd.Name
+	args := cmd.Arguments
+	if name == "UID" && len(args) > 0 {
+		if sub, ok := args[0].(string); ok {
+			name = strings.ToUpper(sub)
+			args = args[1:]
+		}
+	}
+
+	switch name {
+	case "CAPABILITY", "NOOP", "CHECK", "SEARCH", "STATUS", "LIST", "LSUB", "NAMESPACE":
+		return true
+	case "FETCH":
+		// Fetching a body sets the \Seen flag
+		return readOnly || fetchPeek(args)
+	}
+	return false
+}
+
+// fetchPeek checks if the arguments of a FETCH command only contain items
+// which don't set the \Seen flag.
+func fetchPeek(args []interface{}) bool {
+	cmd := &commands.Fetch{}
+	if err := cmd.Parse(args); err != nil {
+		return false
+	}
+
+	for _, item := range cmd.Items {
+		switch {
+		case item == imap.FetchRFC822, item == imap.FetchRFC822Text:
+			return false
+		case strings.HasPrefix(string(item), "BINARY["):
+			return false
+		case strings.HasPrefix(string(item), "BODY["), strings.HasPrefix(string(item), "BODY.PEEK["):
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil || !section.Peek {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// serveConcurrent handles a command concurrently with other ones.
+func (c *conn) serveConcurrent(cmd *imap.Command) {
+	defer func() {
+		<-c.slots
+		c.active.end()
+		c.inflight.Done()
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			c.WriteResp(&imap.StatusResp{
+				Type: imap.StatusRespBye,
+				Info: "Internal server error, closing connection.",
+			})
+
+			stack := debug.Stack()
+			c.s.ErrorLog.Printf("panic serving %v: %v\n%s", c.Info().RemoteAddr, r, stack)
+			c.Close()
+		}
+	}()
+
+	res, _ := c.handleCommand(cmd)
+	if res == nil {
+		return
+	}
+	if err := c.WriteResp(res); err != nil && c.s.LogPrintNetConnErr {
+		c.s.ErrorLog.Println("cannot write response:", err)
 	}
 }
 
@@ -382,31 +720,107 @@ func (c *conn) WaitReady() {
 	c.Conn.WaitReady()
 }
 
+// tagSetter is implemented by handlers which need the tag of the command they
+// handle, e.g. to correlate ESEARCH responses.
+type tagSetter interface {
+	setTag(tag string)
+}
+
 func (c *conn) commandHandler(cmd *imap.Command) (hdlr Handler, err error) {
 	newHandler := c.s.Command(cmd.Name)
-	if newHandler == nil {
+	if newHandler == nil || c.capabilityDisabled(connTenant(c), cmd.Name) {
 		err = errors.New("Unknown command")
 		return
 	}
 
 	hdlr = newHandler()
+	if setter, ok := hdlr.(commands.UTF8Setter); ok {
+		setter.SetUTF8(c.utf8Enabled())
+	}
+	if setter, ok := hdlr.(tagSetter); ok {
+		setter.setTag(cmd.Tag)
+	}
 	err = hdlr.Parse(cmd.Arguments)
 	return
 }
 
-func (c *conn) handleCommand(cmd *imap.Command) (res *imap.StatusResp, up Upgrader, err error) {
-	hdlr, err := c.commandHandler(cmd)
-	if err != nil {
-		return
+func (c *conn) handleCommand(cmd *imap.Command) (res *imap.StatusResp, up Upgrader) {
+	if metrics := c.s.Metrics; metrics != nil {
+		if n := literalBytes(cmd.Arguments); n > 0 {
+			metrics.LiteralBytesIn(n)
+		}
+
+		start := time.Now()
+		defer func() {
+			var result imap.StatusRespType
+			if res != nil {
+				result = res.Type
+			}
+			metrics.CommandCompleted(c.s.metricsCommandName(cmd), result, time.Since(start))
+		}()
+	}
+
+	handle := func(conn Conn, cmd *imap.Command) (*imap.StatusResp, error) {
+		hdlr, err := conn.commandHandler(cmd)
+		if err != nil {
+			return &imap.StatusResp{
+				Tag:  cmd.Tag,
+				Type: imap.StatusRespBad,
+				Info: err.Error(),
+			}, err
+		}
+
+		var ev *AuditEvent
+		if c.s.Audit != nil {
+			ev = c.auditEvent(cmd, hdlr)
+		}
+
+		view := conn.mailboxView()
+		view.begin(cmd.Name)
+		hdlrErr := hdlr.Handle(conn)
+		// Write updates received during the command before its tagged response
+		view.end(conn, cmd.Name)
+
+		res := commandResp(cmd, hdlrErr)
+		if ev != nil {
+			c.audit(ev, res, hdlrErr)
+		}
+
+		up, _ = hdlr.(Upgrader)
+		return res, hdlrErr
+	}
+
+	res, err := chainInterceptors(c.s.Interceptors, handle)(c.conn, cmd)
+	c.updateSession()
+	if res == nil {
+		res = commandResp(cmd, err)
+	} else {
+		res.Tag = cmd.Tag
 	}
+	return
+}
 
-	hdlrErr := hdlr.Handle(c.conn)
-	if statusErr, ok := hdlrErr.(*imap.ErrStatusResp); ok {
+// commandResp returns the tagged response of a command, given the error
+// returned by its handler. It returns nil if no response must be sent.
+func commandResp(cmd *imap.Command, err error) *imap.StatusResp {
+	var res *imap.StatusResp
+	var statusErr *imap.ErrStatusResp
+	var codeErr *imap.StatusError
+	if errors.As(err, &statusErr) {
 		res = statusErr.Resp
-	} else if hdlrErr != nil {
+	} else if errors.As(err, &codeErr) {
+		res = &imap.StatusResp{
+			Type: codeErr.Type,
+			Code: codeErr.Code,
+			Info: err.Error(),
+		}
+		if res.Type == "" {
+			res.Type = imap.StatusRespNo
+		}
+	} else if err != nil {
 		res = &imap.StatusResp{
 			Type: imap.StatusRespNo,
-			Info: hdlrErr.Error(),
+			Info: err.Error(),
 		}
 	} else {
 		res = &imap.StatusResp{
@@ -421,7 +835,5 @@ func (c *conn) handleCommand(cmd *imap.Command) (res *imap.StatusResp, up Upgrad
 			res.Info = cmd.Name + " completed"
 		}
 	}
-
-	up, _ = hdlr.(Upgrader)
-	return
+	return res
 }
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/linanh/go-imap"
+)
+
+// A debugCapture mirrors the network activity of a connection to the server's
+// Debug writer and to the writer capturing the connection's user or IP
+// address, if any.
+type debugCapture struct {
+	locker   sync.Mutex // protects target, username and ip
+	global   io.Writer
+	target   io.Writer
+	username string
+	ip       string
+
+	// Serializes writes of both directions
+	writeLocker sync.Mutex
+
+	local, remote debugStream
+}
+
+func newDebugCapture(global io.Writer, redaction imap.DebugRedaction) *debugCapture {
+	d := &debugCapture{global: global}
+	d.local.capture = d
+	d.remote.capture = d
+	if redaction != 0 {
+		d.local.redactor = imap.NewRedactWriter(d, redaction)
+		d.remote.redactor = imap.NewRedactWriter(d, redaction)
+	}
+	return d
+}
+
+func (d *debugCapture) writers() (global, target io.Writer) {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	return d.global, d.target
+}
+
+// Write writes captured data. The capture must be locked for writing.
+func (d *debugCapture) Write(b []byte) (int, error) {
+	global, target := d.writers()
+
+	// Debug output must not break connections: errors are ignored
+	if global != nil {
+		global.Write(b)
+	}
+	if target != nil {
+		target.Write(b)
+	}
+	return len(b), nil
+}
+
+// debugStream is one direction of the network activity of a connection.
+type debugStream struct {
+	capture *debugCapture
+	// Removes sensitive data, nil if disabled. Only accessed with
+	// capture.writeLocker held.
+	redactor *imap.RedactWriter
+}
+
+func (s *debugStream) Write(b []byte) (int, error) {
+	d := s.capture
+	global, target := d.writers()
+	captured := global != nil || target != nil
+	if !captured && s.redactor == nil {
+		return len(b), nil
+	}
+
+	d.writeLocker.Lock()
+	defer d.writeLocker.Unlock()
+
+	if s.redactor != nil {
+		// While the stream isn't captured, the redactor only follows it, so
+		// that it can resume with the next command or response
+		s.redactor.SetPaused(!captured)
+		s.redactor.Write(b)
+	} else {
+		d.Write(b)
+	}
+	return len(b), nil
+}
+
+// activityConn records that the client is sending data, e.g. a command.
+type activityConn struct {
+	net.Conn
+	active *activity
+}
+
+func (c activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.active.receive()
+	}
+	return n, err
+}
+
+// DebugUser mirrors the network activity of the connections of a user to w,
+// starting with the current ones. Connections are captured once the user has
+// authenticated. If w is nil, capture is stopped.
+func (s *Server) DebugUser(username string, w io.Writer) {
+	s.setDebugTarget("user:"+username, w)
+}
+
+// DebugIP mirrors the network activity of the connections from an IP address
+// to w, starting with the current ones. If w is nil, capture is stopped.
+func (s *Server) DebugIP(ip string, w io.Writer) {
+	s.setDebugTarget("ip:"+ip, w)
+}
+
+func (s *Server) setDebugTarget(key string, w io.Writer) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if w == nil {
+		delete(s.debugTargets, key)
+	} else {
+		if s.debugTargets == nil {
+			s.debugTargets = make(map[string]io.Writer)
+		}
+		s.debugTargets[key] = imap.NewLockedWriter(w)
+	}
+
+	for conn := range s.conns {
+		s.updateDebugTarget(conn.debugCapture())
+	}
+}
+
+// updateDebugTarget selects the writer capturing a connection. The server must
+// be locked.
+func (s *Server) updateDebugTarget(d *debugCapture) {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+
+	var w io.Writer
+	if d.username != "" {
+		w = s.debugTargets["user:"+d.username]
+	}
+	if w == nil && d.ip != "" {
+		w = s.debugTargets["ip:"+d.ip]
+	}
+	d.target = w
+}
+
+// updateDebugUser updates the debug capture of a connection after its user
+// has changed.
+func (c *conn) updateDebugUser(username string) {
+	d := c.debug
+	d.locker.Lock()
+	changed := d.username != username
+	d.username = username
+	d.locker.Unlock()
+
+	if changed {
+		c.s.locker.Lock()
+		c.s.updateDebugTarget(d)
+		c.s.locker.Unlock()
+	}
+}
@@ -0,0 +1,85 @@
+package server_test
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/server"
+)
+
+func TestServer_DebugUser(t *testing.T) {
+	var user, ip lockedBuffer
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.DebugRedaction = imap.RedactCredentials
+		s.DebugUser("username", &user)
+		s.DebugIP("127.0.0.1", &ip)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a002 NOOP\r\n")
+	scanner.Scan()
+
+	s.DebugUser("username", nil)
+
+	io.WriteString(c, "a003 CHECK\r\n")
+	scanner.Scan()
+
+	if strings.Contains(ip.String(), "password") || !strings.Contains(ip.String(), "a001 LOGIN username [redacted]\r\n") {
+		t.Errorf("Credentials not redacted:\n%v", ip.String())
+	}
+	if !strings.Contains(ip.String(), "* OK [CAPABILITY") {
+		t.Errorf("Greeting not captured by IP:\n%v", ip.String())
+	}
+
+	// The user capture starts after authentication and replaces the IP capture
+	if strings.Contains(user.String(), "a001 LOGIN") {
+		t.Errorf("Capture by user started before authentication:\n%v", user.String())
+	}
+	if !strings.Contains(user.String(), "a002 NOOP\r\n") || strings.Contains(ip.String(), "NOOP") {
+		t.Errorf("Session not captured by user:\nuser: %v\nip: %v", user.String(), ip.String())
+	}
+
+	// Once the user capture is stopped, the IP capture resumes
+	if strings.Contains(user.String(), "CHECK") || !strings.Contains(ip.String(), "a003 CHECK\r\n") {
+		t.Errorf("User capture not stopped:\nuser: %v\nip: %v", user.String(), ip.String())
+	}
+}
+
+func TestServer_DebugIP_DuringLiteral(t *testing.T) {
+	var ip lockedBuffer
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.DebugRedaction = imap.RedactCredentials
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username {8}\r\n")
+	scanner.Scan() // Continuation request
+
+	// Capture starts with the next command
+	s.DebugIP("127.0.0.1", &ip)
+	io.WriteString(c, "password\r\n")
+	expectTagged(t, scanner, "a001")
+	io.WriteString(c, "a002 NOOP\r\n")
+	expectTagged(t, scanner, "a002")
+
+	if strings.Contains(ip.String(), "password") {
+		t.Errorf("Credentials not redacted:\n%v", ip.String())
+	}
+	if !strings.Contains(ip.String(), "a002 NOOP\r\n") {
+		t.Errorf("Session not captured:\n%v", ip.String())
+	}
+}
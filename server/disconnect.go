@@ -0,0 +1,160 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// watchBufferSize is the size of the data read ahead from a connection.
+const watchBufferSize = 4096
+
+var errWatchedConnClosed = errors.New("Use of closed network connection")
+
+// timeoutError is returned by watchedConn.Read when the read deadline expires.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type readChunk struct {
+	b   []byte
+	err error
+}
+
+// A watchedConn reads from a connection in a background goroutine, so that a
+// disconnection is noticed while a command is being handled, when the server
+// isn't reading from the connection. At most one chunk of data is read ahead.
+//
+// Read deadlines are handled by watchedConn, the background goroutine reads
+// without deadline.
+type watchedConn struct {
+	net.Conn
+	onDisconnect func()
+
+	chunks    chan readChunk
+	free      chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	locker       sync.Mutex // protects readDeadline
+	readDeadline time.Time
+
+	// Only accessed by Read
+	buf     []byte
+	pending []byte
+	err     error
+}
+
+// newWatchedConn starts watching a connection. onDisconnect is called when
+// reading from the connection fails, e.g. when the client disconnects.
+func newWatchedConn(c net.Conn, onDisconnect func()) *watchedConn {
+	wc := &watchedConn{
+		Conn:         c,
+		onDisconnect: onDisconnect,
+		chunks:       make(chan readChunk),
+		free:         make(chan []byte, 1),
+		closed:       make(chan struct{}),
+	}
+	go wc.watch()
+	return wc
+}
+
+func (c *watchedConn) watch() {
+	for {
+		var b []byte
+		select {
+		case b = <-c.free:
+		default:
+			b = make([]byte, watchBufferSize)
+		}
+
+		n, err := c.Conn.Read(b)
+		if err != nil {
+			c.onDisconnect()
+		}
+		if n == 0 && err == nil {
+			continue
+		}
+
+		select {
+		case c.chunks <- readChunk{b[:n], err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *watchedConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		var timeout <-chan time.Time
+		c.locker.Lock()
+		deadline := c.readDeadline
+		c.locker.Unlock()
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, timeoutError{}
+			}
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case chunk := <-c.chunks:
+			c.buf, c.pending, c.err = chunk.b, chunk.b, chunk.err
+		case <-timeout:
+			return 0, timeoutError{}
+		case <-c.closed:
+			return 0, errWatchedConnClosed
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	if len(c.pending) == 0 && c.buf != nil {
+		// The buffer can be reused by the background goroutine
+		select {
+		case c.free <- c.buf[:cap(c.buf)]:
+		default:
+		}
+		c.buf = nil
+	}
+	if n == 0 && c.err != nil {
+		return 0, c.err
+	}
+	return n, nil
+}
+
+func (c *watchedConn) SetDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *watchedConn) SetReadDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return nil
+}
+
+func (c *watchedConn) setReadDeadline(t time.Time) {
+	c.locker.Lock()
+	c.readDeadline = t
+	c.locker.Unlock()
+}
+
+func (c *watchedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
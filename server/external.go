@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+
+	"github.com/emersion/go-sasl"
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+)
+
+// peerCertificate returns the verified client certificate of a connection, nil
+// if the client didn't present one.
+func peerCertificate(conn Conn) *x509.Certificate {
+	state := conn.TLSState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// NewExternalServerFactory returns a SASLServerFactory for the EXTERNAL
+// mechanism, as defined in RFC 4422 appendix A. The client is authenticated
+// with its TLS certificate, which is mapped to a user by the backend.
+func NewExternalServerFactory() SASLServerFactory {
+	return func(conn Conn) sasl.Server {
+		return &externalServer{conn: conn}
+	}
+}
+
+type externalServer struct {
+	conn Conn
+	done bool
+}
+
+func (s *externalServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.done {
+		return nil, false, sasl.ErrUnexpectedClientResponse
+	}
+
+	// No initial response, ask for it
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	s.done = true
+
+	be, ok := s.conn.Server().Backend.(backend.ExternalBackend)
+	if !ok {
+		return nil, false, errors.New("EXTERNAL is not supported by the backend")
+	}
+
+	cert := peerCertificate(s.conn)
+	if cert == nil {
+		return nil, false, errors.New("No verified client certificate")
+	}
+
+	user, err := be.LoginExternal(s.conn, cert, string(response))
+	if err != nil {
+		return nil, false, err
+	}
+
+	ctx := s.conn.Context()
+	ctx.State = imap.AuthenticatedState
+	ctx.User = user
+	return nil, true, nil
+}
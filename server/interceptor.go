@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/linanh/go-imap"
+)
+
+// A CommandHandler processes a command. It returns the tagged response to send
+// to the client, nil if none must be sent, and the error returned by the
+// command's Handler, if any. The error is already reflected in the response.
+type CommandHandler func(conn Conn, cmd *imap.Command) (*imap.StatusResp, error)
+
+// An Interceptor is called for each command, before its Handler. It can
+// inspect or modify the command, short-circuit it by not calling next, and
+// inspect or rewrite the response returned by next.
+//
+// The server sets the tag of the returned response. If the returned response
+// is nil, it is built from the returned error, like errors returned by
+// Handlers: e.g. returning a nil response and a nil error sends an OK
+// response.
+type Interceptor func(conn Conn, cmd *imap.Command, next CommandHandler) (*imap.StatusResp, error)
+
+// chainInterceptors returns a CommandHandler calling interceptors in order
+// before h.
+func chainInterceptors(interceptors []Interceptor, h CommandHandler) CommandHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], h
+		h = func(conn Conn, cmd *imap.Command) (*imap.StatusResp, error) {
+			return interceptor(conn, cmd, next)
+		}
+	}
+	return h
+}
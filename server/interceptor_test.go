@@ -0,0 +1,110 @@
+package server_test
+
+import (
+	"bufio"
+	"io"
+	"testing"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/server"
+)
+
+func TestServer_Interceptors(t *testing.T) {
+	var order []string
+	var lastRes *imap.StatusResp
+	var lastErr error
+
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.Interceptors = []server.Interceptor{
+			func(conn server.Conn, cmd *imap.Command, next server.CommandHandler) (*imap.StatusResp, error) {
+				order = append(order, "outer "+cmd.Name)
+				res, err := next(conn, cmd)
+				lastRes, lastErr = res, err
+				return res, err
+			},
+			func(conn server.Conn, cmd *imap.Command, next server.CommandHandler) (*imap.StatusResp, error) {
+				order = append(order, "inner "+cmd.Name)
+				switch cmd.Name {
+				case "DELETE":
+					// Short-circuit the command
+					return &imap.StatusResp{
+						Type: imap.StatusRespNo,
+						Info: "Deleting mailboxes is disabled",
+					}, nil
+				case "NOOP":
+					// Rewrite the response
+					res, err := next(conn, cmd)
+					if res != nil {
+						res.Info = "Nothing to do"
+					}
+					return res, err
+				}
+				return next(conn, cmd)
+			},
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "a002 DELETE INBOX\r\n")
+	expectLines(t, scanner, "a002 NO Deleting mailboxes is disabled")
+
+	io.WriteString(c, "a003 NOOP\r\n")
+	expectLines(t, scanner, "a003 OK Nothing to do")
+
+	io.WriteString(c, "a004 SELECT idontexist\r\n")
+	scanner.Scan()
+	if got := scanner.Text(); got != "a004 NO [NONEXISTENT] No such mailbox" {
+		t.Fatalf("Invalid response: %q", got)
+	}
+	if lastRes == nil || lastRes.Type != imap.StatusRespNo || lastErr == nil {
+		t.Fatalf("Interceptor didn't see the command result: %v, %v", lastRes, lastErr)
+	}
+
+	expected := []string{
+		"outer LOGIN", "inner LOGIN",
+		"outer DELETE", "inner DELETE",
+		"outer NOOP", "inner NOOP",
+		"outer SELECT", "inner SELECT",
+	}
+	if len(order) != len(expected) {
+		t.Fatalf("Expected interceptors to be called %v times, got %v", len(expected), order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestServer_InterceptorsBadCommand(t *testing.T) {
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.Interceptors = []server.Interceptor{
+			func(conn server.Conn, cmd *imap.Command, next server.CommandHandler) (*imap.StatusResp, error) {
+				res, err := next(conn, cmd)
+				if err == nil || res == nil || res.Type != imap.StatusRespBad {
+					t.Errorf("Expected a BAD response and an error, got %v, %v", res, err)
+				}
+				return res, err
+			},
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 IDONTEXIST\r\n")
+	scanner.Scan()
+	if got := scanner.Text(); got != "a001 BAD Unknown command" {
+		t.Fatalf("Invalid response: %q", got)
+	}
+}
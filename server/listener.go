@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/throttled/throttled/v2"
+)
+
+// AuthPolicy controls whether clients can authenticate on a listener.
+type AuthPolicy int
+
+const (
+	// AuthDefault allows authentication over TLS, from Server.SecureNet, or
+	// over any connection if Server.AllowInsecureAuth is set.
+	AuthDefault AuthPolicy = iota
+	// AuthRequireTLS only allows authentication over TLS, e.g. after STARTTLS.
+	AuthRequireTLS
+	// AuthAllowInsecure allows authentication over unencrypted connections,
+	// e.g. on an internal network.
+	AuthAllowInsecure
+	// AuthDisabled disables authentication.
+	AuthDisabled
+)
+
+// ListenerConfig configures the connections accepted on a listener, so that a
+// server can serve several ports with different security policies, e.g. port
+// 143 requiring STARTTLS, port 993 with implicit TLS and a plaintext port on
+// an internal network. Zero fields use the server's settings.
+//
+// A connection's ListenerConfig is returned by Conn.ListenerConfig. It must not
+// be modified once the listener is served.
+type ListenerConfig struct {
+	// The name of the listener, e.g. "imaps", reported in SessionInfo.
+	Name string
+	// TCP address to listen on, used by ListenAndServeListener. If blank,
+	// ":imap" or ":imaps" is used.
+	Addr string
+	// Wrap accepted connections with TLS (implicit TLS), instead of offering
+	// STARTTLS.
+	ImplicitTLS bool
+	// The TLS configuration used for implicit TLS and STARTTLS. If nil,
+	// Server.TLSConfig is used.
+	TLSConfig *tls.Config
+	// Whether clients can authenticate.
+	AuthPolicy AuthPolicy
+	// The SASL mechanisms offered, e.g. sasl.Plain. If nil, all mechanisms
+	// enabled on the server are offered. LOGIN is only allowed if PLAIN is.
+	Mechanisms []string
+	// Capabilities not advertised on this listener, e.g. "COMPRESS" or
+	// "IMAP4rev2". An entry also disables capabilities starting with the entry
+	// followed by "=", e.g. "COMPRESS=DEFLATE", and the command of the same
+	// name.
+	DisabledCapabilities []string
+	// Limits the rate of connections per IP address. If nil,
+	// Server.RateLimiter is used.
+	RateLimiter throttled.RateLimiter
+	// Limits failed authentication attempts. If nil, Server.LoginPolicy is
+	// used.
+	LoginPolicy *LoginPolicy
+	// The domain of the tenant served on this listener, if the server's
+	// backend is a TenantRouter.
+	Tenant string
+}
+
+// defaultListenerConfig is used for listeners served with Serve.
+var defaultListenerConfig = &ListenerConfig{}
+
+func (cfg *ListenerConfig) mechanismAllowed(name string) bool {
+	if cfg.Mechanisms == nil {
+		return true
+	}
+	for _, mech := range cfg.Mechanisms {
+		if strings.EqualFold(mech, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// capabilityDisabled checks if a capability or a command is disabled by a
+// connection's listener or tenant.
+func (c *conn) capabilityDisabled(tenant *Tenant, cap string) bool {
+	if capabilityDisabled(c.listener.DisabledCapabilities, cap) {
+		return true
+	}
+	return tenant != nil && capabilityDisabled(tenant.DisabledCapabilities, cap)
+}
+
+func capabilityDisabled(disabledCaps []string, cap string) bool {
+	for _, disabled := range disabledCaps {
+		if strings.EqualFold(cap, disabled) {
+			return true
+		}
+		if len(cap) > len(disabled) && cap[len(disabled)] == '=' && strings.EqualFold(cap[:len(disabled)], disabled) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig returns the TLS configuration of connections accepted on a
+// listener.
+func (s *Server) tlsConfig(cfg *ListenerConfig) *tls.Config {
+	if cfg.TLSConfig != nil {
+		return cfg.TLSConfig
+	}
+	return s.TLSConfig
+}
+
+func (s *Server) rateLimiter(cfg *ListenerConfig) throttled.RateLimiter {
+	if cfg.RateLimiter != nil {
+		return cfg.RateLimiter
+	}
+	return s.RateLimiter
+}
+
+// loginPolicy returns the LoginPolicy of a connection, nil if none.
+func loginPolicy(conn Conn) *LoginPolicy {
+	if policy := conn.ListenerConfig().LoginPolicy; policy != nil {
+		return policy
+	}
+	return conn.Server().LoginPolicy
+}
+
+// ServeListener accepts incoming connections on the Listener l, and serves them
+// according to cfg.
+func (s *Server) ServeListener(l net.Listener, cfg *ListenerConfig) error {
+	if cfg.ImplicitTLS {
+		tlsConfig := s.tlsConfig(cfg)
+		if tlsConfig == nil {
+			l.Close()
+			return errors.New("TLS support not enabled")
+		}
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return s.serve(l, cfg)
+}
+
+// ListenAndServeListener listens on the TCP network address cfg.Addr and then
+// calls ServeListener.
+func (s *Server) ListenAndServeListener(cfg *ListenerConfig) error {
+	l, err := cfg.listen()
+	if err != nil {
+		return err
+	}
+	return s.ServeListener(l, cfg)
+}
+
+// ListenAndServeListeners listens on the TCP network address of each
+// ListenerConfig, and serves them. If a listener fails, the other ones are
+// closed and its error is returned.
+func (s *Server) ListenAndServeListeners(cfgs ...*ListenerConfig) error {
+	ls := make([]net.Listener, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		l, err := cfg.listen()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return err
+		}
+		ls = append(ls, l)
+	}
+
+	errs := make(chan error, len(ls))
+	for i, l := range ls {
+		go func(l net.Listener, cfg *ListenerConfig) {
+			errs <- s.ServeListener(l, cfg)
+		}(l, cfgs[i])
+	}
+
+	err := <-errs
+	for _, l := range ls {
+		l.Close()
+	}
+	return err
+}
+
+func (cfg *ListenerConfig) listen() (net.Listener, error) {
+	addr := cfg.Addr
+	if addr == "" {
+		addr = ":imap"
+		if cfg.ImplicitTLS {
+			addr = ":imaps"
+		}
+	}
+	return net.Listen("tcp", addr)
+}
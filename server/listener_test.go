@@ -0,0 +1,139 @@
+package server_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/internal"
+	"github.com/linanh/go-imap/server"
+)
+
+func testServerListener(t *testing.T, cfg *server.ListenerConfig) (s *server.Server, l net.Listener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	go s.ServeListener(l, cfg)
+	return
+}
+
+func TestServer_ServeListener_ImplicitTLS(t *testing.T) {
+	s, l := testServerListener(t, &server.ListenerConfig{
+		Name:        "imaps",
+		ImplicitTLS: true,
+		AuthPolicy:  server.AuthRequireTLS,
+	})
+	defer s.Close()
+
+	c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan()
+	if scanner.Text() != "* OK [CAPABILITY IMAP4rev1 "+builtinExtensions+" AUTH=PLAIN] IMAP4rev1 Service Ready" {
+		t.Fatal("Bad greeting:", scanner.Text())
+	}
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	sessions := s.Sessions()
+	if len(sessions) != 1 || sessions[0].Listener != "imaps" || sessions[0].TLS == nil {
+		t.Fatalf("Invalid sessions: %+v", sessions)
+	}
+	if sessions[0].Conn.ListenerConfig().Name != "imaps" {
+		t.Error("Invalid listener config")
+	}
+}
+
+func TestServer_ServeListener_RequireTLS(t *testing.T) {
+	s, l := testServerListener(t, &server.ListenerConfig{
+		AuthPolicy: server.AuthRequireTLS,
+	})
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	// Server.AllowInsecureAuth is ignored
+	scanner := bufio.NewScanner(c)
+	scanner.Scan()
+	if scanner.Text() != "* OK [CAPABILITY IMAP4rev1 "+builtinExtensions+" STARTTLS LOGINDISABLED] IMAP4rev1 Service Ready" {
+		t.Fatal("Bad greeting:", scanner.Text())
+	}
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 AUTHENTICATE PLAIN\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestServer_ServeListener_Mechanisms(t *testing.T) {
+	s, l := testServerListener(t, &server.ListenerConfig{
+		AuthPolicy:           server.AuthAllowInsecure,
+		Mechanisms:           []string{},
+		DisabledCapabilities: []string{"ID", "STARTTLS"},
+	})
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan()
+	if scanner.Text() != "* OK [CAPABILITY IMAP4rev1 LITERAL+ SASL-IR CHILDREN LOGINDISABLED] IMAP4rev1 Service Ready" {
+		t.Fatal("Bad greeting:", scanner.Text())
+	}
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 ID NIL\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 BAD ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a003 STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 BAD ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/linanh/go-imap"
+)
+
+// A LoginEvent describes an authentication attempt.
+type LoginEvent struct {
+	// The time of the attempt.
+	Time time.Time
+	// The client's IP address.
+	IP string
+	// The username of the attempt. It is empty if the SASL mechanism doesn't
+	// provide it.
+	Username string
+	// The LOGIN command or the SASL mechanism name.
+	Mechanism string
+	// True if the user has been authenticated.
+	Success bool
+	// True if the attempt has been rejected without checking credentials,
+	// because the account or the IP address is locked.
+	Locked bool
+	// The number of recent failures for this IP address or account, including
+	// this attempt.
+	Failures int
+	// The delay applied before replying to the client.
+	Delay time.Duration
+	// The error returned to the client, if any.
+	Err error
+}
+
+// LoginPolicy protects LOGIN and AUTHENTICATE against brute-force attacks, by
+// delaying responses to failed attempts and locking accounts or IP addresses
+// after too many failures.
+//
+// Accounts are only known with LOGIN and AUTHENTICATE PLAIN: other SASL
+// mechanisms are only tracked by IP address.
+type LoginPolicy struct {
+	// Failures are counted over this sliding window.
+	Window time.Duration
+	// The number of failures within Window after which the account or the IP
+	// address is locked. Zero disables locking.
+	MaxFailures int
+	// How long accounts and IP addresses stay locked. If zero, Window is used.
+	LockDuration time.Duration
+	// Lock accounts after MaxFailures failures.
+	LockAccounts bool
+	// Lock IP addresses after MaxFailures failures.
+	LockIPs bool
+	// The delay applied to the first failure. It doubles with each subsequent
+	// failure within Window. Zero disables delays.
+	Delay time.Duration
+	// The maximum delay applied to a failure. Zero means no maximum.
+	MaxDelay time.Duration
+	// OnEvent is called after each authentication attempt, e.g. to feed
+	// fail2ban-style systems. It must not block.
+	OnEvent func(ev *LoginEvent)
+
+	locker   sync.Mutex
+	records  map[string]*loginRecord
+	attempts map[Conn]*loginAttempt
+	swept    time.Time
+}
+
+type loginRecord struct {
+	failures    []time.Time
+	lockedUntil time.Time
+}
+
+type loginAttempt struct {
+	username string
+}
+
+type errLoginLocked struct{}
+
+func (errLoginLocked) Error() string {
+	return "Too many failed login attempts"
+}
+
+func loginIP(conn Conn) string {
+	addr := conn.Info().RemoteAddr
+	if addr == nil {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return ip
+}
+
+// record returns the record for key, with failures outside of the window
+// removed. The policy must be locked.
+func (p *LoginPolicy) record(key string, now time.Time) *loginRecord {
+	if p.records == nil {
+		p.records = make(map[string]*loginRecord)
+	}
+
+	// Forget old records from time to time
+	if now.Sub(p.swept) > p.Window {
+		for k, r := range p.records {
+			if r.lockedUntil.Before(now) && (len(r.failures) == 0 || now.Sub(r.failures[len(r.failures)-1]) > p.Window) {
+				delete(p.records, k)
+			}
+		}
+		p.swept = now
+	}
+
+	r, ok := p.records[key]
+	if !ok {
+		r = &loginRecord{}
+		p.records[key] = r
+	}
+
+	i := 0
+	for i < len(r.failures) && now.Sub(r.failures[i]) > p.Window {
+		i++
+	}
+	r.failures = r.failures[i:]
+	return r
+}
+
+func (p *LoginPolicy) locked(key string, now time.Time) bool {
+	r, ok := p.records[key]
+	return ok && now.Before(r.lockedUntil)
+}
+
+// fail records a failure for key and returns the number of recent failures.
+// The policy must be locked.
+func (p *LoginPolicy) fail(key string, lock bool, now time.Time) int {
+	r := p.record(key, now)
+	r.failures = append(r.failures, now)
+	n := len(r.failures)
+
+	if lock && p.MaxFailures > 0 && n >= p.MaxFailures {
+		d := p.LockDuration
+		if d == 0 {
+			d = p.Window
+		}
+		r.lockedUntil = now.Add(d)
+	}
+	return n
+}
+
+func (p *LoginPolicy) delay(failures int) time.Duration {
+	if p.Delay <= 0 || failures <= 0 {
+		return 0
+	}
+
+	d := p.Delay
+	for i := 1; i < failures; i++ {
+		d *= 2
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// checkAccount is called by Server.login when the username of an attempt
+// becomes known. It returns an error if the account is locked.
+func (p *LoginPolicy) checkAccount(conn Conn, username string) error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if attempt, ok := p.attempts[conn]; ok {
+		attempt.username = username
+	}
+	if p.LockAccounts && p.locked("user:"+username, time.Now()) {
+		return errLoginLocked{}
+	}
+	return nil
+}
+
+// authenticate runs an authentication attempt through the policy.
+func (p *LoginPolicy) authenticate(conn Conn, mech string, f func() error) error {
+	ev := &LoginEvent{
+		Time:      time.Now(),
+		IP:        loginIP(conn),
+		Mechanism: mech,
+	}
+	attempt := &loginAttempt{}
+
+	p.locker.Lock()
+	if p.attempts == nil {
+		p.attempts = make(map[Conn]*loginAttempt)
+	}
+	p.attempts[conn] = attempt
+	if p.LockIPs && p.locked("ip:"+ev.IP, ev.Time) {
+		ev.Locked = true
+	}
+	p.locker.Unlock()
+
+	var err error
+	if !ev.Locked {
+		err = f()
+	}
+	if _, ok := err.(errLoginLocked); ok {
+		ev.Locked = true
+	}
+
+	now := time.Now()
+	p.locker.Lock()
+	delete(p.attempts, conn)
+	ev.Username = attempt.username
+	if ev.Username == "" {
+		if user := conn.Context().User; err == nil && user != nil {
+			ev.Username = user.Username()
+		}
+	}
+	if err == nil {
+		ev.Success = true
+		delete(p.records, "user:"+ev.Username)
+	} else if !ev.Locked && !isBadResp(err) {
+		ev.Failures = p.fail("ip:"+ev.IP, p.LockIPs, now)
+		if ev.Username != "" {
+			if n := p.fail("user:"+ev.Username, p.LockAccounts, now); n > ev.Failures {
+				ev.Failures = n
+			}
+		}
+		ev.Delay = p.delay(ev.Failures)
+	}
+	p.locker.Unlock()
+
+	if ev.Locked {
+		err = &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeUnavailable,
+			Info: "Too many failed login attempts, try again later",
+		}}
+	} else if err != nil && !isBadResp(err) && !hasStatusCode(err) {
+		err = &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeAuthenticationFailed,
+			Info: "Authentication failed",
+		}}
+	}
+	ev.Err = err
+
+	if ev.Delay > 0 {
+		time.Sleep(ev.Delay)
+	}
+	if p.OnEvent != nil {
+		p.OnEvent(ev)
+	}
+	return err
+}
+
+// isBadResp checks if err is a BAD response, e.g. a cancelled SASL exchange,
+// which doesn't count as a failed attempt.
+func isBadResp(err error) bool {
+	statusErr, ok := err.(*imap.ErrStatusResp)
+	return ok && statusErr.Resp != nil && statusErr.Resp.Type == imap.StatusRespBad
+}
+
+// hasStatusCode checks if err carries a response code which should be sent to
+// the client, e.g. EXPIRED.
+func hasStatusCode(err error) bool {
+	var statusErr *imap.StatusError
+	return errors.As(err, &statusErr) && statusErr.Code != "" && statusErr.Code != imap.CodeAuthenticationFailed
+}
@@ -0,0 +1,147 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/server"
+)
+
+type loginEvents struct {
+	sync.Mutex
+	events []server.LoginEvent
+}
+
+func (l *loginEvents) add(ev *server.LoginEvent) {
+	l.Lock()
+	l.events = append(l.events, *ev)
+	l.Unlock()
+}
+
+func (l *loginEvents) get(i int) server.LoginEvent {
+	l.Lock()
+	defer l.Unlock()
+	return l.events[i]
+}
+
+func TestLoginPolicy_LockAccount(t *testing.T) {
+	var events loginEvents
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.LoginPolicy = &server.LoginPolicy{
+			Window:       time.Minute,
+			MaxFailures:  2,
+			LockAccounts: true,
+			Delay:        10 * time.Millisecond,
+			MaxDelay:     15 * time.Millisecond,
+			OnEvent:      events.add,
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	for i, tag := range []string{"a001", "a002"} {
+		io.WriteString(c, tag+" LOGIN username wrong\r\n")
+		scanner.Scan()
+		if scanner.Text() != tag+" NO [AUTHENTICATIONFAILED] Authentication failed" {
+			t.Fatal("Bad status response:", scanner.Text())
+		}
+
+		ev := events.get(i)
+		if ev.Success || ev.Locked || ev.Username != "username" || ev.Mechanism != "LOGIN" || ev.Failures != i+1 {
+			t.Fatalf("Bad event #%v: %+v", i, ev)
+		}
+		if want := []time.Duration{10 * time.Millisecond, 15 * time.Millisecond}[i]; ev.Delay != want {
+			t.Fatalf("Bad delay for event #%v: got %v, want %v", i, ev.Delay, want)
+		}
+	}
+
+	// The account is locked, even with the right password
+	io.WriteString(c, "a003 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 NO [UNAVAILABLE] ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+	if ev := events.get(2); !ev.Locked || ev.Success {
+		t.Fatalf("Bad event: %+v", ev)
+	}
+
+	// AUTHENTICATE PLAIN is locked too
+	ir := base64.StdEncoding.EncodeToString([]byte("\x00username\x00password"))
+	io.WriteString(c, "a004 AUTHENTICATE PLAIN "+ir+"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a004 NO [UNAVAILABLE] ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestLoginPolicy_LockIP(t *testing.T) {
+	var events loginEvents
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.LoginPolicy = &server.LoginPolicy{
+			Window:      time.Minute,
+			MaxFailures: 1,
+			LockIPs:     true,
+			OnEvent:     events.add,
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	ir := base64.StdEncoding.EncodeToString([]byte("\x00nobody\x00wrong"))
+	io.WriteString(c, "a001 AUTHENTICATE PLAIN "+ir+"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO [AUTHENTICATIONFAILED] ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+	if ev := events.get(0); ev.IP != "127.0.0.1" || ev.Mechanism != "PLAIN" || ev.Username != "nobody" {
+		t.Fatalf("Bad event: %+v", ev)
+	}
+
+	// Another account from the same IP address
+	io.WriteString(c, "a002 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 NO [UNAVAILABLE] ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestLoginPolicy_Success(t *testing.T) {
+	var events loginEvents
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.LoginPolicy = &server.LoginPolicy{
+			Window:       time.Minute,
+			MaxFailures:  2,
+			LockAccounts: true,
+			OnEvent:      events.add,
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username wrong\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "a002 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+	if ev := events.get(1); !ev.Success || ev.Err != nil || ev.Username != "username" {
+		t.Fatalf("Bad event: %+v", ev)
+	}
+}
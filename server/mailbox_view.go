@@ -0,0 +1,431 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/responses"
+)
+
+// A mailboxView is the selected mailbox as seen by a session. It maps UIDs to
+// the sequence numbers known by the client, which differ from the backend's
+// ones as long as expunged messages haven't been reported.
+//
+// RFC 3501 section 7.4.1: an EXPUNGE response must not be sent when no command
+// is in progress, nor while responding to a FETCH, STORE or SEARCH command.
+// Updates are queued and written when allowed.
+type mailboxView struct {
+	// Serializes flushes, so that responses are written in order.
+	flushLocker sync.Mutex
+
+	locker sync.Mutex
+	// The name of the selected mailbox, empty if none.
+	name    string
+	mailbox backend.Mailbox
+	// The UIDs of the messages known by the client, in sequence number order.
+	uids []uint32
+	// UIDs of expunged messages which haven't been reported yet.
+	expunged map[uint32]bool
+	// Updates waiting to be written.
+	events []viewEvent
+	// True if the backend may have messages unknown to the view.
+	stale bool
+	// True if the client has enabled IMAP4rev2, which removes \Recent.
+	rev2 bool
+	// The number of commands in progress, and how many of them forbid
+	// EXPUNGE responses.
+	commands  int
+	noExpunge int
+}
+
+type viewEvent struct {
+	expunge uint32
+	exists  bool
+	status  *imap.MailboxStatus
+	message *imap.Message
+}
+
+// reset initializes the view with the messages of a newly selected mailbox.
+// rev2 is true if the client has enabled IMAP4rev2.
+func (v *mailboxView) reset(mbox backend.Mailbox, uids []uint32, rev2 bool) {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+
+	v.name = ""
+	v.mailbox = mbox
+	if mbox != nil {
+		v.name = mbox.Name()
+	}
+	v.uids = uids
+	v.expunged = make(map[uint32]bool)
+	v.events = nil
+	v.stale = false
+	v.rev2 = rev2
+}
+
+// index returns the position of uid in the view, or -1.
+func (v *mailboxView) index(uid uint32) int {
+	i := sort.Search(len(v.uids), func(i int) bool { return v.uids[i] >= uid })
+	if i < len(v.uids) && v.uids[i] == uid {
+		return i
+	}
+	return -1
+}
+
+// backendUid maps a backend sequence number to a UID. Backend sequence
+// numbers don't account for expunged messages not reported to the client yet.
+func (v *mailboxView) backendUid(seqNum uint32) uint32 {
+	if seqNum == 0 {
+		return 0
+	}
+	n := uint32(0)
+	for _, uid := range v.uids {
+		if v.expunged[uid] {
+			continue
+		}
+		n++
+		if n == seqNum {
+			return uid
+		}
+	}
+	return 0
+}
+
+// add appends new messages to the view.
+func (v *mailboxView) add(uids []uint32) bool {
+	added := false
+	for _, uid := range uids {
+		if len(v.uids) > 0 && uid <= v.uids[len(v.uids)-1] {
+			continue
+		}
+		v.uids = append(v.uids, uid)
+		added = true
+	}
+	return added
+}
+
+// expunge marks a message as expunged.
+func (v *mailboxView) expunge(uid uint32) {
+	if uid == 0 || v.expunged[uid] || v.index(uid) < 0 {
+		return
+	}
+	v.expunged[uid] = true
+	v.events = append(v.events, viewEvent{expunge: uid})
+}
+
+// record queues a backend update. It returns false if the update doesn't
+// concern the view.
+func (v *mailboxView) record(update backend.Update) bool {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+
+	if v.name == "" || v.name != update.Mailbox() {
+		return false
+	}
+
+	switch update := update.(type) {
+	case *backend.MailboxUpdate:
+		status := update.MailboxStatus
+		_, hasMessages := status.Items[imap.StatusMessages]
+		if hasMessages && int(status.Messages) > len(v.uids)-len(v.expunged) {
+			// New messages have been reported by count only
+			v.stale = true
+		}
+		if hasMessages || v.rev2 {
+			// The message count is computed for the session when written
+			status = &imap.MailboxStatus{
+				Name:           status.Name,
+				ReadOnly:       status.ReadOnly,
+				Items:          status.Items,
+				Flags:          status.Flags,
+				PermanentFlags: status.PermanentFlags,
+				UnseenSeqNum:   status.UnseenSeqNum,
+				Recent:         status.Recent,
+				Unseen:         status.Unseen,
+				UidNext:        status.UidNext,
+				UidValidity:    status.UidValidity,
+				HighestModseq:  status.HighestModseq,
+			}
+			if v.rev2 {
+				status.Items = make(map[imap.StatusItem]interface{}, len(update.Items))
+				for item, value := range update.Items {
+					if item != imap.StatusRecent {
+						status.Items[item] = value
+					}
+				}
+				status.Flags = removeRecent(status.Flags)
+				status.PermanentFlags = removeRecent(status.PermanentFlags)
+				status.UnseenSeqNum = 0
+			}
+		}
+		v.events = append(v.events, viewEvent{status: status})
+	case *backend.MessageUpdate:
+		msg := *update.Message
+		if v.rev2 {
+			msg.Flags = removeRecent(msg.Flags)
+		}
+		if msg.Uid == 0 {
+			msg.Uid = v.backendUid(msg.SeqNum)
+		}
+		if msg.Uid == 0 {
+			return true
+		}
+		v.events = append(v.events, viewEvent{message: &msg})
+	case *backend.ExpungeUpdate:
+		v.expunge(v.backendUid(update.SeqNum))
+	case *backend.ExpungeUidUpdate:
+		v.expunge(update.Uid)
+	case *backend.ExistsUidUpdate:
+		if v.add(update.Uids) {
+			v.events = append(v.events, viewEvent{exists: true})
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// sync reconciles the view with the backend when the backend has reported
+// new messages without their UIDs. The view must be locked.
+func (v *mailboxView) sync() {
+	if !v.stale || v.mailbox == nil {
+		return
+	}
+	v.stale = false
+
+	uids, _, err := v.mailbox.SearchMessages(true, new(imap.SearchCriteria), nil)
+	if err != nil {
+		return
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	current := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		current[uid] = true
+	}
+	for _, uid := range v.uids {
+		if !current[uid] {
+			v.expunge(uid)
+		}
+	}
+	v.add(uids)
+}
+
+// expungeForbidden checks if EXPUNGE responses are forbidden while a command
+// is in progress.
+func expungeForbidden(name string) bool {
+	switch name {
+	case "FETCH", "STORE", "SEARCH":
+		return true
+	}
+	return false
+}
+
+// begin is called when a command starts.
+func (v *mailboxView) begin(name string) {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+
+	v.commands++
+	if expungeForbidden(name) {
+		v.noExpunge++
+	}
+}
+
+// end is called when a command completes, before its tagged response. It
+// writes pending updates.
+func (v *mailboxView) end(conn Conn, name string) {
+	v.locker.Lock()
+	v.commands--
+	if expungeForbidden(name) {
+		v.noExpunge--
+	}
+	// Other commands may still be in progress
+	allowExpunge := !expungeForbidden(name) && v.noExpunge == 0
+	v.locker.Unlock()
+
+	v.flush(conn, allowExpunge)
+}
+
+// flush writes pending updates. Expunges are only written if allowExpunge is
+// set.
+func (v *mailboxView) flush(conn Conn, allowExpunge bool) {
+	v.flushLocker.Lock()
+	defer v.flushLocker.Unlock()
+
+	v.locker.Lock()
+	if len(v.events) > 0 {
+		v.sync()
+	}
+	var res []imap.WriterTo
+	var pending []viewEvent
+	for _, ev := range v.events {
+		switch {
+		case ev.expunge != 0:
+			if !allowExpunge {
+				pending = append(pending, ev)
+				continue
+			}
+			i := v.index(ev.expunge)
+			delete(v.expunged, ev.expunge)
+			if i < 0 {
+				continue
+			}
+			v.uids = append(v.uids[:i], v.uids[i+1:]...)
+			res = append(res, expungeResp(uint32(i+1)))
+		case ev.exists:
+			res = append(res, &responses.Select{Mailbox: &imap.MailboxStatus{
+				Items:    map[imap.StatusItem]interface{}{imap.StatusMessages: nil},
+				Messages: uint32(len(v.uids)),
+			}})
+		case ev.status != nil:
+			if _, ok := ev.status.Items[imap.StatusMessages]; ok {
+				ev.status.Messages = uint32(len(v.uids))
+			}
+			res = append(res, &responses.Select{Mailbox: ev.status})
+		case ev.message != nil:
+			i := v.index(ev.message.Uid)
+			if i < 0 {
+				continue
+			}
+			ev.message.SeqNum = uint32(i + 1)
+			ch := make(chan *imap.Message, 1)
+			ch <- ev.message
+			close(ch)
+			res = append(res, &responses.Fetch{Messages: ch})
+		}
+	}
+	v.events = pending
+	v.locker.Unlock()
+
+	ctx := conn.Context()
+	for _, r := range res {
+		done := make(chan struct{})
+		select {
+		case ctx.Responses <- &response{r, done}:
+			<-done
+		case <-ctx.LoggedOut:
+			return
+		}
+	}
+}
+
+// writeUpdates writes pending updates allowed at this point of the session.
+func (v *mailboxView) writeUpdates(conn Conn) {
+	v.locker.Lock()
+	allowExpunge := v.commands > 0 && v.noExpunge == 0
+	v.locker.Unlock()
+
+	v.flush(conn, allowExpunge)
+}
+
+func expungeResp(seqNum uint32) imap.WriterTo {
+	ch := make(chan uint32, 1)
+	ch <- seqNum
+	close(ch)
+	return &responses.Expunge{SeqNums: ch}
+}
+
+// translating returns true if the client's sequence numbers differ from the
+// backend's ones.
+func (v *mailboxView) translating() bool {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+	return len(v.expunged) > 0
+}
+
+// uidSet converts a set of client sequence numbers to UIDs.
+func (v *mailboxView) uidSet(seqset *imap.SeqSet) *imap.SeqSet {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+
+	set := new(imap.SeqSet)
+	max := uint32(len(v.uids))
+	for i, uid := range v.uids {
+		if seqSetContains(seqset, uint32(i+1), max) {
+			set.AddNum(uid)
+		}
+	}
+	return set
+}
+
+// seqNum converts a UID to a client sequence number. It returns zero if the
+// message isn't known by the client.
+func (v *mailboxView) seqNum(uid uint32) uint32 {
+	v.locker.Lock()
+	defer v.locker.Unlock()
+	return uint32(v.index(uid) + 1)
+}
+
+// searchCriteria replaces sequence numbers in criteria with UIDs.
+func (v *mailboxView) searchCriteria(criteria *imap.SearchCriteria) *imap.SearchCriteria {
+	if criteria == nil {
+		return nil
+	}
+
+	c := *criteria
+	c.Not = make([]*imap.SearchCriteria, len(criteria.Not))
+	for i, not := range criteria.Not {
+		c.Not[i] = v.searchCriteria(not)
+	}
+	c.Or = make([][2]*imap.SearchCriteria, len(criteria.Or))
+	for i, or := range criteria.Or {
+		c.Or[i] = [2]*imap.SearchCriteria{v.searchCriteria(or[0]), v.searchCriteria(or[1])}
+	}
+
+	if c.SeqNum != nil {
+		uids := v.uidSet(c.SeqNum)
+		if c.Uid != nil {
+			set := new(imap.SeqSet)
+			for _, seq := range uids.Set {
+				for uid := seq.Start; uid <= seq.Stop; uid++ {
+					if c.Uid.Contains(uid) {
+						set.AddNum(uid)
+					}
+				}
+			}
+			uids = set
+		}
+		c.SeqNum = nil
+		c.Uid = uids
+		if uids.Empty() {
+			// An empty set means no criteria: use NOT ALL to match nothing
+			c.Uid = nil
+			c.Not = append(c.Not, &imap.SearchCriteria{})
+		}
+	}
+	return &c
+}
+
+// sessionSeqSet converts a set of client sequence numbers to UIDs if they
+// differ from the backend's ones.
+func sessionSeqSet(conn Conn, uid bool, seqset *imap.SeqSet) (bool, *imap.SeqSet) {
+	view := conn.mailboxView()
+	if uid || !view.translating() {
+		return uid, seqset
+	}
+	return true, view.uidSet(seqset)
+}
+
+// seqSetContains checks if seqset contains the sequence number n, with "*"
+// standing for max.
+func seqSetContains(seqset *imap.SeqSet, n, max uint32) bool {
+	for _, seq := range seqset.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 {
+			start = max
+		}
+		if stop == 0 {
+			stop = max
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if start <= n && n <= stop {
+			return true
+		}
+	}
+	return false
+}
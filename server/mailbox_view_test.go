@@ -0,0 +1,166 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/server"
+)
+
+// updatesBackend is a memory backend sending updates.
+type updatesBackend struct {
+	*memory.Backend
+	updates chan backend.Update
+}
+
+func (be *updatesBackend) Updates() <-chan backend.Update {
+	return be.updates
+}
+
+// testServerViewSelected starts a server with an updatesBackend, and selects
+// an INBOX containing messages with UIDs 6, 7 and 8.
+func testServerViewSelected(t *testing.T) (s *server.Server, c net.Conn, scanner *bufio.Scanner, bkd *updatesBackend, mbox *memory.Mailbox) {
+	bkd = &updatesBackend{
+		Backend: memory.New(),
+		updates: make(chan backend.Update),
+	}
+
+	u, err := bkd.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox = m.(*memory.Mailbox)
+	for i := 0; i < 2; i++ {
+		body := bytes.NewBufferString("Subject: Hello\r\n\r\nHi there :))")
+		if _, err := mbox.CreateMessage(nil, time.Now(), body, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, c = testServerWithBackend(t, bkd)
+	scanner = bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a000 LOGIN username password\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a000 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a000 ") {
+			break
+		}
+	}
+	return
+}
+
+// sendUpdate sends an update and waits for it to be written to clients.
+func sendUpdate(s *server.Server, bkd *updatesBackend, update backend.Update) {
+	done := update.Done()
+	bkd.updates <- update
+	<-done
+
+	for s.UpdateQueueStats().Queued > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func expectLines(t *testing.T, scanner *bufio.Scanner, lines ...string) {
+	t.Helper()
+
+	for _, want := range lines {
+		scanner.Scan()
+		if strings.HasSuffix(want, " ") {
+			if !strings.HasPrefix(scanner.Text(), want) {
+				t.Fatalf("Expected a line starting with %q, got %q", want, scanner.Text())
+			}
+		} else if scanner.Text() != want {
+			t.Fatalf("Expected %q, got %q", want, scanner.Text())
+		}
+	}
+}
+
+func TestMailboxView_DeferredExpunge(t *testing.T) {
+	s, c, scanner, bkd, mbox := testServerViewSelected(t)
+	defer s.Close()
+	defer c.Close()
+
+	// Another session expunges the message with UID 7
+	mbox.Messages = append(mbox.Messages[:1], mbox.Messages[2:]...)
+	sendUpdate(s, bkd, &backend.ExpungeUidUpdate{
+		Update: backend.NewUpdate("username", "INBOX"),
+		Uid:    7,
+	})
+
+	// The EXPUNGE response must not be sent during FETCH, and the client's
+	// sequence numbers must be preserved
+	io.WriteString(c, "a001 FETCH 1:* (UID)\r\n")
+	expectLines(t, scanner,
+		"* 1 FETCH (UID 6)",
+		"* 3 FETCH (UID 8)",
+		"a001 OK ",
+	)
+
+	io.WriteString(c, "a002 STORE 3 +FLAGS.SILENT (\\Flagged)\r\n")
+	expectLines(t, scanner, "a002 OK ")
+	if flags := mbox.Messages[1].Flags; len(flags) != 1 || flags[0] != "\\Flagged" {
+		t.Fatal("Invalid flags for message with UID 8:", flags)
+	}
+
+	io.WriteString(c, "a003 SEARCH FLAGGED\r\n")
+	expectLines(t, scanner,
+		"* SEARCH 3",
+		"a003 OK ",
+	)
+
+	io.WriteString(c, "a004 NOOP\r\n")
+	expectLines(t, scanner,
+		"* 2 EXPUNGE",
+		"a004 OK ",
+	)
+
+	io.WriteString(c, "a005 FETCH 2 (UID)\r\n")
+	expectLines(t, scanner,
+		"* 2 FETCH (UID 8)",
+		"a005 OK ",
+	)
+}
+
+func TestMailboxView_ExistsUid(t *testing.T) {
+	s, c, scanner, bkd, mbox := testServerViewSelected(t)
+	defer s.Close()
+	defer c.Close()
+
+	body := bytes.NewBufferString("Subject: Hello\r\n\r\nHi there :))")
+	if _, err := mbox.CreateMessage(nil, time.Now(), body, nil); err != nil {
+		t.Fatal(err)
+	}
+	sendUpdate(s, bkd, &backend.ExistsUidUpdate{
+		Update: backend.NewUpdate("username", "INBOX"),
+		Uids:   []uint32{9},
+	})
+	expectLines(t, scanner, "* 4 EXISTS")
+
+	mbox.Messages = mbox.Messages[1:]
+	sendUpdate(s, bkd, &backend.ExpungeUidUpdate{
+		Update: backend.NewUpdate("username", "INBOX"),
+		Uid:    6,
+	})
+
+	// UID FETCH allows EXPUNGE responses, written after the command's data
+	io.WriteString(c, "a001 UID FETCH 9 (FLAGS)\r\n")
+	expectLines(t, scanner,
+		"* 4 FETCH (FLAGS () UID 9)",
+		"* 1 EXPUNGE",
+		"a001 OK ",
+	)
+}
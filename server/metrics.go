@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linanh/go-imap"
+)
+
+// Metrics receives events from the server, e.g. to export them to a
+// monitoring system. Methods are called concurrently and must not block.
+type Metrics interface {
+	// ConnectionOpened is called when a connection is accepted.
+	ConnectionOpened()
+	// ConnectionClosed is called when a connection is closed.
+	ConnectionClosed()
+	// AuthAttempt is called after each LOGIN or AUTHENTICATE attempt.
+	// Mechanism is LOGIN or the SASL mechanism name, or UNKNOWN if the client
+	// requested an unsupported mechanism.
+	AuthAttempt(mechanism string, success bool)
+	// CommandCompleted is called after each command. Name is the command name,
+	// e.g. FETCH or UID FETCH, or UNKNOWN for unknown commands. Result is the
+	// type of the tagged response, empty if no response has been sent.
+	CommandCompleted(name string, result imap.StatusRespType, d time.Duration)
+	// LiteralBytesIn is called with the size of literals sent by a client in a
+	// command.
+	LiteralBytesIn(n int)
+	// LiteralBytesOut is called with the size of message literals sent to a
+	// client in a FETCH response.
+	LiteralBytesOut(n int)
+	// UpdateFannedOut is called for each backend update, with the number of
+	// connections it has been queued for.
+	UpdateFannedOut(recipients int)
+}
+
+// DefaultDurationBuckets are the default upper bounds of the command duration
+// histogram buckets, in seconds.
+var DefaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// MemoryMetrics is a Metrics implementation aggregating counters in memory.
+// They can be exported in the Prometheus text format with WritePrometheus. The
+// zero value is ready to use.
+type MemoryMetrics struct {
+	// The upper bounds of the command duration histogram buckets, in seconds.
+	// If nil, DefaultDurationBuckets is used. It must not be changed once the
+	// metrics are in use.
+	DurationBuckets []float64
+
+	locker      sync.Mutex
+	connsOpened uint64
+	connsClosed uint64
+	auths       map[authMetric]uint64
+	commands    map[commandMetric]uint64
+	durations   map[string]*histogram
+	literalIn   uint64
+	literalOut  uint64
+	updates     uint64
+	deliveries  uint64
+}
+
+type authMetric struct {
+	mechanism string
+	success   bool
+}
+
+type commandMetric struct {
+	name   string
+	result imap.StatusRespType
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, the last one being +Inf
+	sum    float64
+	count  uint64
+}
+
+func (m *MemoryMetrics) ConnectionOpened() {
+	m.locker.Lock()
+	m.connsOpened++
+	m.locker.Unlock()
+}
+
+func (m *MemoryMetrics) ConnectionClosed() {
+	m.locker.Lock()
+	m.connsClosed++
+	m.locker.Unlock()
+}
+
+func (m *MemoryMetrics) AuthAttempt(mechanism string, success bool) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	if m.auths == nil {
+		m.auths = make(map[authMetric]uint64)
+	}
+	m.auths[authMetric{mechanism, success}]++
+}
+
+func (m *MemoryMetrics) buckets() []float64 {
+	if m.DurationBuckets != nil {
+		return m.DurationBuckets
+	}
+	return DefaultDurationBuckets
+}
+
+func (m *MemoryMetrics) CommandCompleted(name string, result imap.StatusRespType, d time.Duration) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	if m.commands == nil {
+		m.commands = make(map[commandMetric]uint64)
+		m.durations = make(map[string]*histogram)
+	}
+	m.commands[commandMetric{name, result}]++
+
+	buckets := m.buckets()
+	h, ok := m.durations[name]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(buckets)+1)}
+		m.durations[name] = h
+	}
+	secs := d.Seconds()
+	i := sort.SearchFloat64s(buckets, secs)
+	h.counts[i]++
+	h.sum += secs
+	h.count++
+}
+
+func (m *MemoryMetrics) LiteralBytesIn(n int) {
+	m.locker.Lock()
+	m.literalIn += uint64(n)
+	m.locker.Unlock()
+}
+
+func (m *MemoryMetrics) LiteralBytesOut(n int) {
+	m.locker.Lock()
+	m.literalOut += uint64(n)
+	m.locker.Unlock()
+}
+
+func (m *MemoryMetrics) UpdateFannedOut(recipients int) {
+	m.locker.Lock()
+	m.updates++
+	m.deliveries += uint64(recipients)
+	m.locker.Unlock()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format.
+func (m *MemoryMetrics) WritePrometheus(w io.Writer) error {
+	var b bytes.Buffer
+
+	m.locker.Lock()
+
+	fmt.Fprintf(&b, "# HELP imap_connections_opened_total Number of accepted connections.\n")
+	fmt.Fprintf(&b, "# TYPE imap_connections_opened_total counter\n")
+	fmt.Fprintf(&b, "imap_connections_opened_total %v\n", m.connsOpened)
+	fmt.Fprintf(&b, "# HELP imap_connections_closed_total Number of closed connections.\n")
+	fmt.Fprintf(&b, "# TYPE imap_connections_closed_total counter\n")
+	fmt.Fprintf(&b, "imap_connections_closed_total %v\n", m.connsClosed)
+	fmt.Fprintf(&b, "# HELP imap_connections_active Number of open connections.\n")
+	fmt.Fprintf(&b, "# TYPE imap_connections_active gauge\n")
+	fmt.Fprintf(&b, "imap_connections_active %v\n", m.connsOpened-m.connsClosed)
+
+	auths := make([]authMetric, 0, len(m.auths))
+	for k := range m.auths {
+		auths = append(auths, k)
+	}
+	sort.Slice(auths, func(i, j int) bool {
+		if auths[i].mechanism != auths[j].mechanism {
+			return auths[i].mechanism < auths[j].mechanism
+		}
+		return !auths[i].success && auths[j].success
+	})
+	fmt.Fprintf(&b, "# HELP imap_auth_attempts_total Number of authentication attempts.\n")
+	fmt.Fprintf(&b, "# TYPE imap_auth_attempts_total counter\n")
+	for _, k := range auths {
+		result := "failure"
+		if k.success {
+			result = "success"
+		}
+		fmt.Fprintf(&b, "imap_auth_attempts_total{mechanism=\"%v\",result=\"%v\"} %v\n",
+			labelEscaper.Replace(k.mechanism), result, m.auths[k])
+	}
+
+	commands := make([]commandMetric, 0, len(m.commands))
+	for k := range m.commands {
+		commands = append(commands, k)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if commands[i].name != commands[j].name {
+			return commands[i].name < commands[j].name
+		}
+		return commands[i].result < commands[j].result
+	})
+	fmt.Fprintf(&b, "# HELP imap_commands_total Number of completed commands, by tagged response type.\n")
+	fmt.Fprintf(&b, "# TYPE imap_commands_total counter\n")
+	for _, k := range commands {
+		result := string(k.result)
+		if result == "" {
+			result = "NONE"
+		}
+		fmt.Fprintf(&b, "imap_commands_total{command=\"%v\",result=\"%v\"} %v\n",
+			labelEscaper.Replace(k.name), labelEscaper.Replace(result), m.commands[k])
+	}
+
+	names := make([]string, 0, len(m.durations))
+	for name := range m.durations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buckets := m.buckets()
+	fmt.Fprintf(&b, "# HELP imap_command_duration_seconds Command processing duration.\n")
+	fmt.Fprintf(&b, "# TYPE imap_command_duration_seconds histogram\n")
+	for _, name := range names {
+		h := m.durations[name]
+		label := labelEscaper.Replace(name)
+
+		var cumulative uint64
+		for i, n := range h.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(buckets) {
+				le = formatFloat(buckets[i])
+			}
+			fmt.Fprintf(&b, "imap_command_duration_seconds_bucket{command=\"%v\",le=\"%v\"} %v\n", label, le, cumulative)
+		}
+		fmt.Fprintf(&b, "imap_command_duration_seconds_sum{command=\"%v\"} %v\n", label, formatFloat(h.sum))
+		fmt.Fprintf(&b, "imap_command_duration_seconds_count{command=\"%v\"} %v\n", label, h.count)
+	}
+
+	fmt.Fprintf(&b, "# HELP imap_literal_bytes_total Number of literal bytes received and sent.\n")
+	fmt.Fprintf(&b, "# TYPE imap_literal_bytes_total counter\n")
+	fmt.Fprintf(&b, "imap_literal_bytes_total{direction=\"in\"} %v\n", m.literalIn)
+	fmt.Fprintf(&b, "imap_literal_bytes_total{direction=\"out\"} %v\n", m.literalOut)
+	fmt.Fprintf(&b, "# HELP imap_updates_total Number of backend updates dispatched to connections.\n")
+	fmt.Fprintf(&b, "# TYPE imap_updates_total counter\n")
+	fmt.Fprintf(&b, "imap_updates_total %v\n", m.updates)
+	fmt.Fprintf(&b, "# HELP imap_update_deliveries_total Number of updates queued for connections.\n")
+	fmt.Fprintf(&b, "# TYPE imap_update_deliveries_total counter\n")
+	fmt.Fprintf(&b, "imap_update_deliveries_total %v\n", m.deliveries)
+
+	m.locker.Unlock()
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// metricsCommandName returns the name of a command reported to Metrics. Unknown
+// commands are reported as UNKNOWN, so that clients cannot create arbitrary
+// metrics.
+func (s *Server) metricsCommandName(cmd *imap.Command) string {
+	if s.Command(cmd.Name) == nil {
+		return "UNKNOWN"
+	}
+	if cmd.Name == "UID" && len(cmd.Arguments) > 0 {
+		if sub, ok := cmd.Arguments[0].(string); ok {
+			sub = strings.ToUpper(sub)
+			if s.Command(sub) != nil {
+				return "UID " + sub
+			}
+		}
+	}
+	return cmd.Name
+}
+
+// literalBytes returns the size of the literals in command arguments.
+func literalBytes(fields []interface{}) int {
+	n := 0
+	for _, f := range fields {
+		switch f := f.(type) {
+		case imap.Literal:
+			n += f.Len()
+		case []interface{}:
+			n += literalBytes(f)
+		}
+	}
+	return n
+}
+
+// messageLiteralBytes returns the size of the body sections of a message.
+func messageLiteralBytes(msg *imap.Message) int {
+	n := 0
+	for _, l := range msg.Body {
+		if l != nil {
+			n += l.Len()
+		}
+	}
+	return n
+}
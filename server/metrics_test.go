@@ -0,0 +1,88 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/server"
+)
+
+func TestMemoryMetrics(t *testing.T) {
+	metrics := &server.MemoryMetrics{}
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.Metrics = metrics
+	})
+	defer s.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username wrong\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a002 LOGIN username password\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "a003 APPEND INBOX {11}\r\n")
+	scanner.Scan() // Continuation request
+	io.WriteString(c, "Hello World\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "a004 SELECT INBOX\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "a004 ") {
+	}
+
+	io.WriteString(c, "a005 FETCH 1 (BODY.PEEK[TEXT])\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "a005 ") {
+	}
+
+	io.WriteString(c, "a006 UID FETCH 1 (FLAGS)\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "a006 ") {
+	}
+
+	io.WriteString(c, "a007 IDONTEXIST\r\n")
+	scanner.Scan()
+
+	c.Close()
+
+	// Wait for the connection to be closed
+	var b bytes.Buffer
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.Reset()
+		if err := metrics.WritePrometheus(&b); err != nil {
+			t.Fatal("Cannot write metrics:", err)
+		}
+		if strings.Contains(b.String(), "imap_connections_closed_total 1\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Connection not closed:\n%v", b.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, line := range []string{
+		"imap_connections_opened_total 1",
+		"imap_connections_active 0",
+		`imap_auth_attempts_total{mechanism="LOGIN",result="failure"} 1`,
+		`imap_auth_attempts_total{mechanism="LOGIN",result="success"} 1`,
+		`imap_commands_total{command="LOGIN",result="NO"} 1`,
+		`imap_commands_total{command="LOGIN",result="OK"} 1`,
+		`imap_commands_total{command="FETCH",result="OK"} 1`,
+		`imap_commands_total{command="UID FETCH",result="OK"} 1`,
+		`imap_commands_total{command="UNKNOWN",result="BAD"} 1`,
+		`imap_command_duration_seconds_bucket{command="APPEND",le="+Inf"} 1`,
+		`imap_command_duration_seconds_count{command="SELECT"} 1`,
+		`imap_literal_bytes_total{direction="in"} 11`,
+		`imap_literal_bytes_total{direction="out"} 11`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("Missing %q in metrics:\n%v", line, b.String())
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+)
+
+// The XOAUTH2 SASL mechanism, as used by Google and Microsoft.
+const XOAuth2 = "XOAUTH2"
+
+// A TokenVerifier verifies OAuth 2.0 bearer tokens (RFC 6750) for the
+// OAUTHBEARER and XOAUTH2 SASL mechanisms.
+type TokenVerifier interface {
+	// VerifyToken checks that token grants access to the mailbox of username
+	// and returns the authenticated username. username is the authorization
+	// identity sent by the client: it may be empty with OAUTHBEARER, in which
+	// case the verifier must derive it from the token.
+	//
+	// A *sasl.OAuthBearerError can be returned to customize the JSON error
+	// sent to the client.
+	VerifyToken(conn Conn, username, token string) (string, error)
+}
+
+// TokenVerifierFunc is an adapter to allow the use of ordinary functions as
+// TokenVerifier.
+type TokenVerifierFunc func(conn Conn, username, token string) (string, error)
+
+func (f TokenVerifierFunc) VerifyToken(conn Conn, username, token string) (string, error) {
+	return f(conn, username, token)
+}
+
+// NewOAuthBearerServerFactory returns a SASLServerFactory for the OAUTHBEARER
+// mechanism, as defined in RFC 7628. The server's backend must implement
+// backend.UserGetter.
+func NewOAuthBearerServerFactory(verifier TokenVerifier) SASLServerFactory {
+	return func(conn Conn) sasl.Server {
+		return &oauthServer{
+			conn:     conn,
+			verifier: verifier,
+			parse:    parseOAuthBearerResponse,
+			dummy:    []byte{0x01},
+		}
+	}
+}
+
+// NewXOAuth2ServerFactory returns a SASLServerFactory for the XOAUTH2
+// mechanism. The server's backend must implement backend.UserGetter.
+func NewXOAuth2ServerFactory(verifier TokenVerifier) SASLServerFactory {
+	return func(conn Conn) sasl.Server {
+		return &oauthServer{
+			conn:     conn,
+			verifier: verifier,
+			parse:    parseXOAuth2Response,
+			dummy:    []byte{},
+		}
+	}
+}
+
+type oauthServer struct {
+	conn     Conn
+	verifier TokenVerifier
+	parse    func(response []byte) (username, token string, err error)
+	// The response expected from the client after an error challenge.
+	dummy []byte
+
+	started bool
+	failErr error
+}
+
+// parseOAuthBearerResponse parses an OAUTHBEARER client response, as defined
+// in RFC 7628 section 3.1.
+func parseOAuthBearerResponse(response []byte) (username, token string, err error) {
+	parts := bytes.SplitN(response, []byte{','}, 3)
+	if len(parts) != 3 {
+		return "", "", errors.New("Invalid OAUTHBEARER response")
+	}
+
+	// Channel binding isn't supported
+	if flag := string(parts[0]); flag != "n" && flag != "y" {
+		return "", "", errors.New("Channel binding is not supported")
+	}
+
+	if len(parts[1]) > 0 {
+		if !bytes.HasPrefix(parts[1], []byte("a=")) {
+			return "", "", errors.New("Invalid OAUTHBEARER authorization identity")
+		}
+		if username, err = decodeSASLName(string(parts[1][2:])); err != nil {
+			return "", "", err
+		}
+	}
+
+	token, err = parseOAuthAuth(parts[2])
+	return username, token, err
+}
+
+// parseXOAuth2Response parses an XOAUTH2 client response:
+//
+//	"user=" username "\x01auth=Bearer " token "\x01\x01"
+func parseXOAuth2Response(response []byte) (username, token string, err error) {
+	if !bytes.HasPrefix(response, []byte("user=")) {
+		return "", "", errors.New("Invalid XOAUTH2 response")
+	}
+
+	i := bytes.IndexByte(response, 0x01)
+	if i < 0 {
+		return "", "", errors.New("Invalid XOAUTH2 response")
+	}
+	username = string(response[len("user="):i])
+
+	token, err = parseOAuthAuth(response[i:])
+	return username, token, err
+}
+
+// parseOAuthAuth extracts the bearer token from a list of key-value pairs
+// separated by 0x01.
+func parseOAuthAuth(b []byte) (string, error) {
+	var token string
+	for _, kv := range bytes.Split(b, []byte{0x01}) {
+		if len(kv) == 0 {
+			continue
+		}
+
+		parts := bytes.SplitN(kv, []byte{'='}, 2)
+		if len(parts) != 2 {
+			return "", errors.New("Invalid OAuth key-value pair")
+		}
+		if string(parts[0]) != "auth" {
+			// host, port and other keys are ignored
+			continue
+		}
+
+		const prefix = "bearer "
+		value := string(parts[1])
+		if !strings.HasPrefix(strings.ToLower(value), prefix) {
+			return "", errors.New("Unsupported OAuth token type")
+		}
+		token = value[len(prefix):]
+	}
+
+	if token == "" {
+		return "", errors.New("Missing OAuth token")
+	}
+	return token, nil
+}
+
+// fail sends a JSON error challenge, as defined in RFC 7628 section 3.2.2. The
+// exchange fails once the client has acknowledged it.
+func (s *oauthServer) fail(err error) ([]byte, bool, error) {
+	oauthErr, ok := err.(*sasl.OAuthBearerError)
+	if !ok {
+		oauthErr = &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+	}
+
+	challenge, jsonErr := json.Marshal(oauthErr)
+	if jsonErr != nil {
+		return nil, false, jsonErr
+	}
+
+	s.failErr = err
+	return challenge, false, nil
+}
+
+func (s *oauthServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.failErr != nil {
+		if !bytes.Equal(response, s.dummy) {
+			return nil, false, sasl.ErrUnexpectedClientResponse
+		}
+		return nil, true, s.failErr
+	}
+	if s.started {
+		return nil, false, sasl.ErrUnexpectedClientResponse
+	}
+
+	// No initial response, ask for it
+	if len(response) == 0 {
+		return []byte{}, false, nil
+	}
+	s.started = true
+
+	username, token, err := s.parse(response)
+	if err != nil {
+		return nil, false, err
+	}
+
+	be, ok := s.conn.Server().Backend.(backend.UserGetter)
+	if !ok {
+		return nil, false, errors.New("OAuth is not supported by the backend")
+	}
+
+	username, err = s.verifier.VerifyToken(s.conn, username, token)
+	if err != nil {
+		return s.fail(err)
+	}
+
+	user, err := be.GetUser(s.conn, username)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ctx := s.conn.Context()
+	ctx.State = imap.AuthenticatedState
+	ctx.User = user
+	return nil, true, nil
+}
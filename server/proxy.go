@@ -0,0 +1,282 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultProxyHeaderTimeout is the default maximum duration to wait for a PROXY
+// protocol header.
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+// ErrInvalidProxyHeader is returned when reading from a connection which
+// didn't start with a valid PROXY protocol header.
+var ErrInvalidProxyHeader = errors.New("Invalid PROXY protocol header")
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2FamTCP4 = 0x11
+	proxyV2FamTCP6 = 0x21
+
+	proxyV2TypeAuthority = 0x02
+	proxyV2TypeSSL       = 0x20
+	proxyV2ClientSSL     = 0x01
+)
+
+// ProxyListener is a net.Listener reading PROXY protocol v1 and v2 headers sent
+// by load balancers, as defined in
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt.
+//
+// The RemoteAddr and LocalAddr methods of accepted connections return the
+// addresses of the original connection, which are used by conn.Info(), rate
+// limiting, authentication policies and logs. If a v2 header reports that the
+// client has connected over TLS, the connection is considered encrypted, and
+// ConnInfo.TLSTerminated is set. The server name sent by the proxy, if any, is
+// reported in ConnInfo.ServerName.
+//
+// Headers are read lazily, so that a slow client doesn't block Accept. To use
+// the PROXY protocol with implicit TLS, wrap the ProxyListener with
+// tls.NewListener.
+type ProxyListener struct {
+	net.Listener
+
+	// Headers are only read from connections originating from these networks,
+	// e.g. load balancers. Other connections are accepted as is. If empty, no
+	// header is read.
+	Trusted []*net.IPNet
+	// The maximum duration to wait for a header. If zero,
+	// DefaultProxyHeaderTimeout is used.
+	HeaderTimeout time.Duration
+}
+
+func (l *ProxyListener) trusted(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+
+	for _, ipNet := range l.Trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	return &proxyConn{Conn: c, timeout: timeout}, nil
+}
+
+// A proxyConn is a connection starting with a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once          sync.Once
+	r             *bufio.Reader
+	err           error
+	remote        net.Addr
+	local         net.Addr
+	tlsTerminated bool
+	serverName    string
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		c.r = bufio.NewReader(c.Conn)
+		c.err = c.readHeader()
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// TLSTerminated checks if the client has connected to the proxy over TLS.
+func (c *proxyConn) TLSTerminated() bool {
+	c.init()
+	return c.tlsTerminated
+}
+
+// ServerName returns the server name the client has requested to the proxy
+// with TLS SNI, if any.
+func (c *proxyConn) ServerName() string {
+	c.init()
+	return c.serverName
+}
+
+func (c *proxyConn) readHeader() error {
+	b, err := c.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return c.readHeaderV1()
+	}
+	if bytes.Equal(b, proxyV2Signature) {
+		return c.readHeaderV2()
+	}
+	return ErrInvalidProxyHeader
+}
+
+// readHeaderV1 reads a human-readable header, e.g.
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 993\r\n".
+func (c *proxyConn) readHeaderV1() error {
+	// Headers are at most 107 bytes long
+	var line []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return ErrInvalidProxyHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ErrInvalidProxyHeader
+	}
+
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || srcErr != nil || dstErr != nil {
+		return ErrInvalidProxyHeader
+	}
+
+	c.remote = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	c.local = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return nil
+}
+
+// readHeaderV2 reads a binary header.
+func (c *proxyConn) readHeaderV2() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[12]>>4 != 2 {
+		return ErrInvalidProxyHeader
+	}
+	cmd, fam := hdr[12]&0xF, hdr[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	switch cmd {
+	case proxyV2CmdLocal:
+		// Sent by the proxy itself, e.g. for health checks
+		return nil
+	case proxyV2CmdProxy:
+	default:
+		return ErrInvalidProxyHeader
+	}
+
+	var tlvs []byte
+	switch fam {
+	case proxyV2FamTCP4:
+		if len(payload) < 12 {
+			return ErrInvalidProxyHeader
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		c.local = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+		tlvs = payload[12:]
+	case proxyV2FamTCP6:
+		if len(payload) < 36 {
+			return ErrInvalidProxyHeader
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		c.local = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+		tlvs = payload[36:]
+	default:
+		// Unsupported address family: keep the proxy's addresses
+		return nil
+	}
+
+	for len(tlvs) >= 3 {
+		typ, n := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return ErrInvalidProxyHeader
+		}
+		value := tlvs[3 : 3+n]
+		tlvs = tlvs[3+n:]
+
+		switch typ {
+		case proxyV2TypeAuthority:
+			c.serverName = string(value)
+		case proxyV2TypeSSL:
+			if len(value) >= 1 {
+				c.tlsTerminated = value[0]&proxyV2ClientSSL != 0
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package server_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/server"
+)
+
+func testServerProxy(t *testing.T, trusted string, configure func(s *server.Server)) (s *server.Server, c net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	_, ipNet, err := net.ParseCIDR(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = server.New(memory.New())
+	if configure != nil {
+		configure(s)
+	}
+	go s.Serve(&server.ProxyListener{Listener: l, Trusted: []*net.IPNet{ipNet}})
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	return
+}
+
+func TestProxyListener_V1(t *testing.T) {
+	s, c := testServerProxy(t, "127.0.0.0/8", func(s *server.Server) {
+		s.AllowInsecureAuth = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 143\r\n")
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	sessions := s.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %v", len(sessions))
+	}
+	info := sessions[0].Conn.Info()
+	if info.RemoteAddr.String() != "192.0.2.1:56324" || info.LocalAddr.String() != "198.51.100.1:143" {
+		t.Errorf("Invalid addresses: %v, %v", info.RemoteAddr, info.LocalAddr)
+	}
+	if info.TLSTerminated {
+		t.Error("Expected TLS not to be terminated")
+	}
+}
+
+func TestProxyListener_V2(t *testing.T) {
+	s, c := testServerProxy(t, "127.0.0.0/8", nil)
+	defer s.Close()
+	defer c.Close()
+
+	// PP2_TYPE_AUTHORITY TLV, and PP2_TYPE_SSL TLV with the PP2_CLIENT_SSL flag
+	tlv := append([]byte{0x02, 0, 16}, "mail.example.org"...)
+	tlv = append(tlv, 0x20, 0, 5, 0x01, 0, 0, 0, 0)
+
+	hdr := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	hdr = append(hdr, 0x21, 0x11)
+	hdr = append(hdr, 0, byte(12+len(tlv)))
+	hdr = append(hdr, 192, 0, 2, 1, 198, 51, 100, 1)
+	hdr = append(hdr, 0xDC, 0x04) // 56324
+	hdr = append(hdr, 0x03, 0xE1) // 993
+	hdr = append(hdr, tlv...)
+	c.Write(hdr)
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	// Authentication is allowed, since the client has connected over TLS
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Invalid status response:", scanner.Text())
+	}
+
+	info := s.Sessions()[0].Conn.Info()
+	if info.RemoteAddr.String() != "192.0.2.1:56324" {
+		t.Errorf("Invalid remote address: %v", info.RemoteAddr)
+	}
+	if !info.TLSTerminated {
+		t.Error("Expected TLS to be terminated")
+	}
+	if info.ServerName != "mail.example.org" {
+		t.Errorf("Invalid server name: %q", info.ServerName)
+	}
+}
+
+func TestProxyListener_Untrusted(t *testing.T) {
+	s, c := testServerProxy(t, "192.0.2.0/24", nil)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	// The header isn't parsed
+	io.WriteString(c, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 143\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "PROXY BAD ") {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+}
+
+func TestProxyListener_Invalid(t *testing.T) {
+	s, c := testServerProxy(t, "127.0.0.0/8", nil)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "* ") {
+			t.Fatal("Unexpected response:", scanner.Text())
+		}
+	}
+}
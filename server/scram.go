@@ -0,0 +1,370 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+)
+
+// The suffix of SCRAM mechanisms supporting channel binding.
+const scramPlusSuffix = "-PLUS"
+
+// Channel binding types, as defined in RFC 5929 and RFC 9266.
+const (
+	channelBindingTLSUnique   = "tls-unique"
+	channelBindingTLSExporter = "tls-exporter"
+)
+
+// errSCRAMAuthFailed is returned when SCRAM authentication fails. It doesn't
+// tell whether the user exists.
+var errSCRAMAuthFailed = errors.New("SCRAM authentication failed")
+
+// The iteration count sent for unknown users, the minimum recommended by RFC
+// 7677.
+const fakeSCRAMIterations = 4096
+
+// NewSCRAMServerFactory returns a SASLServerFactory for a SCRAM mechanism,
+// e.g. "SCRAM-SHA-256" or "SCRAM-SHA-256-PLUS", as defined in RFC 5802 and RFC
+// 7677. The server's backend must implement backend.SCRAMBackend.
+//
+// -PLUS mechanisms require TLS and bind the authentication to the TLS
+// connection, using tls-exporter for TLS 1.3 and tls-unique otherwise.
+func NewSCRAMServerFactory(mechanism string) SASLServerFactory {
+	plus := strings.HasSuffix(mechanism, scramPlusSuffix)
+	hashMechanism := strings.TrimSuffix(mechanism, scramPlusSuffix)
+
+	return func(conn Conn) sasl.Server {
+		return &scramServer{
+			conn:      conn,
+			mechanism: hashMechanism,
+			h:         backend.SCRAMHash(hashMechanism),
+			plus:      plus,
+		}
+	}
+}
+
+type scramServer struct {
+	conn      Conn
+	mechanism string
+	h         func() hash.Hash
+	plus      bool
+
+	step            int
+	gs2Header       string
+	cbType          string
+	username        string
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+	creds           *backend.SCRAMCredentials
+	// The user doesn't exist: the exchange goes on with fake credentials, and
+	// fails when the proof is checked
+	unknownUser bool
+}
+
+// decodeSASLName decodes a saslname, as defined in RFC 5802 section 5.1 and
+// used in GS2 headers (RFC 5801).
+func decodeSASLName(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '=':
+			if strings.HasPrefix(s[i:], "=2C") {
+				b.WriteByte(',')
+			} else if strings.HasPrefix(s[i:], "=3D") {
+				b.WriteByte('=')
+			} else {
+				return "", errors.New("Invalid SASL name encoding")
+			}
+			i += 2
+		case ',':
+			return "", errors.New("Invalid SASL name encoding")
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// channelBinding returns the channel binding data for the connection.
+func (s *scramServer) channelBinding() ([]byte, error) {
+	state := s.conn.TLSState()
+	if state == nil {
+		return nil, errors.New("Channel binding requires TLS")
+	}
+
+	switch s.cbType {
+	case channelBindingTLSUnique:
+		if len(state.TLSUnique) == 0 {
+			return nil, errors.New("tls-unique channel binding is not available")
+		}
+		return state.TLSUnique, nil
+	case channelBindingTLSExporter:
+		return state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	default:
+		return nil, errors.New("Unsupported channel binding type")
+	}
+}
+
+// plusAdvertised checks if the -PLUS variant of the mechanism, which supports
+// channel binding, is advertised to the client.
+func (s *scramServer) plusAdvertised() bool {
+	plusCap := "AUTH=" + s.mechanism + scramPlusSuffix
+	for _, cap := range s.conn.Capabilities() {
+		if cap == plusCap {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scramServer) handleClientFirst(response []byte) ([]byte, error) {
+	msg := string(response)
+
+	// gs2-header: gs2-cbind-flag "," [authzid] ","
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid SCRAM client-first-message")
+	}
+
+	switch flag := parts[0]; {
+	case flag == "n":
+		if s.plus {
+			return nil, errors.New("Channel binding is required by this mechanism")
+		}
+	case flag == "y":
+		// The client supports channel binding but thinks the server doesn't: if
+		// we have advertised it, this is a downgrade attack
+		if s.plus || s.plusAdvertised() {
+			return nil, errors.New("Channel binding downgrade detected")
+		}
+	case strings.HasPrefix(flag, "p="):
+		if !s.plus {
+			return nil, errors.New("Channel binding is not supported by this mechanism")
+		}
+		s.cbType = strings.TrimPrefix(flag, "p=")
+		if _, err := s.channelBinding(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Invalid SCRAM channel binding flag")
+	}
+
+	var authzid string
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, errors.New("Invalid SCRAM authorization identity")
+		}
+		var err error
+		if authzid, err = decodeSASLName(strings.TrimPrefix(parts[1], "a=")); err != nil {
+			return nil, err
+		}
+	}
+
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	var clientNonce string
+	for _, attr := range strings.Split(s.clientFirstBare, ",") {
+		switch {
+		case strings.HasPrefix(attr, "m="):
+			return nil, errors.New("Unsupported SCRAM extension")
+		case strings.HasPrefix(attr, "n="):
+			username, err := decodeSASLName(strings.TrimPrefix(attr, "n="))
+			if err != nil {
+				return nil, err
+			}
+			s.username = username
+		case strings.HasPrefix(attr, "r="):
+			clientNonce = strings.TrimPrefix(attr, "r=")
+		}
+	}
+	if s.username == "" || clientNonce == "" {
+		return nil, errors.New("Invalid SCRAM client-first-message")
+	}
+	if authzid != "" && authzid != s.username {
+		return nil, errors.New("Identities not supported")
+	}
+
+	be, ok := s.conn.Server().Backend.(backend.SCRAMBackend)
+	if !ok {
+		return nil, errors.New("SCRAM is not supported by the backend")
+	}
+	creds, err := be.SCRAMCredentials(s.conn, s.username, s.mechanism)
+	if err != nil {
+		// Don't tell whether the user exists: send a salt which doesn't change
+		// between attempts, like for an existing user
+		creds = s.conn.Server().fakeSCRAMCredentials(s.mechanism, s.username)
+		s.unknownUser = true
+	}
+	s.creds = creds
+
+	var b [18]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	s.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(b[:])
+
+	s.serverFirst = "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(creds.Salt) +
+		",i=" + strconv.Itoa(creds.Iterations)
+	return []byte(s.serverFirst), nil
+}
+
+func (s *scramServer) handleClientFinal(response []byte) ([]byte, error) {
+	msg := string(response)
+
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, errors.New("Invalid SCRAM client-final-message")
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil {
+		return nil, err
+	}
+
+	var cb, nonce string
+	for _, attr := range strings.Split(withoutProof, ",") {
+		switch {
+		case strings.HasPrefix(attr, "c="):
+			cb = strings.TrimPrefix(attr, "c=")
+		case strings.HasPrefix(attr, "r="):
+			nonce = strings.TrimPrefix(attr, "r=")
+		}
+	}
+	if nonce != s.nonce {
+		return nil, errors.New("Invalid SCRAM nonce")
+	}
+
+	expectedCB := []byte(s.gs2Header)
+	if s.cbType != "" {
+		data, err := s.channelBinding()
+		if err != nil {
+			return nil, err
+		}
+		expectedCB = append(expectedCB, data...)
+	}
+	if cb != base64.StdEncoding.EncodeToString(expectedCB) {
+		return nil, errors.New("Invalid SCRAM channel binding")
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+
+	mac := hmac.New(s.h, s.creds.StoredKey)
+	mac.Write([]byte(authMessage))
+	clientSignature := mac.Sum(nil)
+	if len(proof) != len(clientSignature) {
+		return nil, errSCRAMAuthFailed
+	}
+
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := s.h()
+	storedKey.Write(clientKey)
+	if !hmac.Equal(storedKey.Sum(nil), s.creds.StoredKey) || s.unknownUser {
+		return nil, errSCRAMAuthFailed
+	}
+
+	mac = hmac.New(s.h, s.creds.ServerKey)
+	mac.Write([]byte(authMessage))
+	serverSignature := mac.Sum(nil)
+
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+func (s *scramServer) login() error {
+	var user backend.User
+	var err error
+	if r, ok := s.conn.Server().Backend.(*TenantRouter); ok {
+		// Don't count the login twice in the tenant's rate limit
+		user, err = r.scramGetUser(s.conn, s.username)
+	} else {
+		be := s.conn.Server().Backend.(backend.SCRAMBackend)
+		user, err = be.GetUser(s.conn, s.username)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx := s.conn.Context()
+	ctx.State = imap.AuthenticatedState
+	ctx.User = user
+	return nil
+}
+
+func (s *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.h == nil {
+		return nil, false, errors.New("Unknown SCRAM mechanism")
+	}
+
+	switch s.step {
+	case 0:
+		if len(response) == 0 {
+			// No initial response, ask for the client-first-message
+			s.step = 1
+			return []byte{}, false, nil
+		}
+		s.step = 2
+		challenge, err = s.handleClientFirst(response)
+		return challenge, false, err
+	case 1:
+		s.step++
+		challenge, err = s.handleClientFirst(response)
+		return challenge, false, err
+	case 2:
+		s.step++
+		challenge, err = s.handleClientFinal(response)
+		return challenge, false, err
+	case 3:
+		// The client acknowledges the server-final-message
+		s.step++
+		if len(bytes.TrimSpace(response)) != 0 {
+			return nil, false, sasl.ErrUnexpectedClientResponse
+		}
+		return nil, true, s.login()
+	default:
+		return nil, false, sasl.ErrUnexpectedClientResponse
+	}
+}
+
+// fakeSCRAMCredentials returns the credentials used for an unknown user. They
+// are derived from the server's SCRAM secret, so that the same salt is sent to
+// each attempt.
+func (s *Server) fakeSCRAMCredentials(mechanism, username string) *backend.SCRAMCredentials {
+	s.scramSecretOnce.Do(func() {
+		s.scramSecret = s.SCRAMSecret
+		if len(s.scramSecret) == 0 {
+			s.scramSecret = make([]byte, 32)
+			if _, err := rand.Read(s.scramSecret); err != nil {
+				panic(err)
+			}
+		}
+	})
+
+	h := backend.SCRAMHash(mechanism)
+	mac := hmac.New(sha256.New, s.scramSecret)
+	mac.Write([]byte(mechanism + "\x00" + username))
+	sum := mac.Sum(nil)
+
+	storedKey := h()
+	storedKey.Write(sum)
+	return &backend.SCRAMCredentials{
+		Salt:       sum[:16],
+		Iterations: fakeSCRAMIterations,
+		StoredKey:  storedKey.Sum(nil),
+		ServerKey:  sum[16:],
+	}
+}
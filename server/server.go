@@ -2,6 +2,7 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -10,12 +11,12 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/linanh/go-imap"
 	"github.com/linanh/go-imap/backend"
-	"github.com/linanh/go-imap/responses"
 	"github.com/throttled/throttled/v2"
 )
 
@@ -74,7 +75,7 @@ type ConnExtension interface {
 //
 // To disable the default status response, use imap.ErrStatusResp{nil} instead.
 func ErrStatusResp(res *imap.StatusResp) error {
-	return &imap.ErrStatusResp{res}
+	return &imap.ErrStatusResp{Resp: res}
 }
 
 // ErrNoStatusResp can be returned by a Handler to prevent the default status
@@ -82,7 +83,7 @@ func ErrStatusResp(res *imap.StatusResp) error {
 //
 // Deprecated: Use imap.ErrStatusResp{nil} instead
 func ErrNoStatusResp() error {
-	return &imap.ErrStatusResp{nil}
+	return &imap.ErrStatusResp{Resp: nil}
 }
 
 // An IMAP server.
@@ -91,6 +92,16 @@ type Server struct {
 	listeners map[net.Listener]struct{}
 	conns     map[Conn]struct{}
 
+	updatesOnce  sync.Once
+	debugTargets map[string]io.Writer
+	draining     bool
+	shutdown     int32 // accessed atomically
+	queueStats   UpdateQueueStats
+
+	// Derives fake SCRAM credentials for unknown users
+	scramSecretOnce sync.Once
+	scramSecret     []byte
+
 	commands   map[string]HandlerFactory
 	auths      map[string]SASLServerFactory
 	extensions []Extension
@@ -103,18 +114,66 @@ type Server struct {
 	Backend backend.Backend
 	// Backend updates that will be sent to connected clients.
 	Updates <-chan backend.Update
+	// The maximum number of updates queued for a connection. Connections
+	// reading too slowly to keep up with updates are closed with a BYE
+	// response. If zero, DefaultMaxQueuedUpdates is used.
+	MaxQueuedUpdates int
+	// UpdateBus distributes updates between server instances. If set, backend
+	// updates, including the updates of tenants, are published to the bus, and
+	// updates received from the bus are sent to connected clients.
+	UpdateBus backend.UpdateBus
 	// Automatically logout clients after a duration. To do not logout users
 	// automatically, set this to zero. The duration MUST be at least
 	// MinAutoLogout (as stated in RFC 3501 section 5.4).
 	AutoLogout time.Duration
+	// The maximum duration of FETCH and SEARCH backend operations. The deadline
+	// is passed to context-aware backends, see backend.MailboxContext. Zero
+	// means no limit.
+	CommandTimeout time.Duration
+	// The maximum number of commands processed concurrently for a connection
+	// (RFC 3501 section 5.5). Only commands which don't change the state of
+	// the session, such as FETCH, SEARCH, STATUS and LIST, are processed
+	// concurrently: other commands wait until previous commands have completed.
+	// Zero or one disables concurrent processing.
+	MaxConcurrentCommands int
+	// Interceptors are called for each command, the first one being the
+	// outermost. They can be used to add cross-cutting logic, e.g. auditing or
+	// authorization.
+	Interceptors []Interceptor
+	// Metrics receives events about connections, authentication, commands and
+	// updates. If nil, no metrics are collected.
+	Metrics Metrics
+	// Audit records operations on mailboxes and messages. If nil, they are not
+	// recorded.
+	Audit AuditSink
 	// Allow authentication over unencrypted connections.
 	AllowInsecureAuth bool
+	// SCRAMSecret derives the salts sent by SCRAM mechanisms for unknown users,
+	// so that clients can't tell whether a user exists. It should be shared by
+	// server instances serving the same users. If empty, a random secret is
+	// generated.
+	SCRAMSecret []byte
+	// LoginPolicy protects LOGIN and AUTHENTICATE against brute-force attacks.
+	// If nil, failed attempts are not limited.
+	LoginPolicy *LoginPolicy
+	// Authenticator checks the credentials of LOGIN and AUTHENTICATE PLAIN. If
+	// set, users are then retrieved with backend.UserGetter, which the backend
+	// must implement. If nil, Backend.Login is used.
+	Authenticator Authenticator
 	// From secure network over unencrypted connections is secure.
 	SecureNet []*net.IPNet
 	// Print network error
 	LogPrintNetConnErr bool
+	// The text of the BYE response sent by Shutdown. If empty,
+	// DefaultShutdownReason is used.
+	ShutdownReason string
 	// An io.Writer to which all network activity will be mirrored.
 	Debug io.Writer
+	// DebugRedaction selects the data removed from debug output, including
+	// output captured with DebugUser and DebugIP. Data is only parsed while it
+	// is captured: capture of an open connection then starts with its next
+	// command or response.
+	DebugRedaction imap.DebugRedaction
 	// ErrorLog specifies an optional logger for errors accepting
 	// connections and unexpected behavior from handlers.
 	// If nil, logging goes to os.Stderr via the log package's
@@ -123,7 +182,19 @@ type Server struct {
 	// The maximum literal size, in bytes. Literals exceeding this size will be
 	// rejected. A value of zero disables the limit (this is the default).
 	MaxLiteralSize uint32
-	backendExts    map[string]struct{}
+	// Advertise IMAP4rev2 (RFC 9051) alongside IMAP4rev1. Clients can switch to
+	// IMAP4rev2 semantics with ENABLE IMAP4rev2. IMAP4rev2 is only advertised
+	// if the backend supports UIDPLUS, since IMAP4rev2 requires UID EXPUNGE.
+	IMAP4rev2 bool
+	// Server identification returned to clients with the ID command (RFC
+	// 2971), e.g. imap.IDName and imap.IDVersion. If nil, NIL is returned.
+	ID map[string]string
+	// Allow authenticated clients to enable COMPRESS=DEFLATE (RFC 4978).
+	Compress bool
+	// The DEFLATE compression level, see compress/flate. Zero means
+	// flate.DefaultCompression.
+	CompressLevel int
+	backendExts   map[string]struct{}
 	//Rate Limiter
 	RateLimiter throttled.RateLimiter
 }
@@ -149,7 +220,7 @@ func New(bkd backend.Backend) *Server {
 					return errors.New("Identities not supported")
 				}
 
-				user, err := bkd.Login(conn, username, password)
+				user, err := conn.Server().login(conn, username, password)
 				if err != nil {
 					return err
 				}
@@ -162,10 +233,22 @@ func New(bkd backend.Backend) *Server {
 		},
 	}
 
+	if _, ok := bkd.(backend.SCRAMBackend); ok {
+		for _, mech := range []string{backend.SCRAMSHA1, backend.SCRAMSHA256} {
+			s.auths[mech] = NewSCRAMServerFactory(mech)
+			s.auths[mech+scramPlusSuffix] = NewSCRAMServerFactory(mech + scramPlusSuffix)
+		}
+	}
+
+	if _, ok := bkd.(backend.ExternalBackend); ok {
+		s.auths[sasl.External] = NewExternalServerFactory()
+	}
+
 	s.commands = map[string]HandlerFactory{
 		"NOOP":       func() Handler { return &Noop{} },
 		"CAPABILITY": func() Handler { return &Capability{} },
 		"LOGOUT":     func() Handler { return &Logout{} },
+		"ID":         func() Handler { return &ID{} },
 
 		"STARTTLS":     func() Handler { return &StartTLS{} },
 		"LOGIN":        func() Handler { return &Login{} },
@@ -190,6 +273,10 @@ func New(bkd backend.Backend) *Server {
 		},
 		"STATUS": func() Handler { return &Status{} },
 		"APPEND": func() Handler { return &Append{} },
+		"ENABLE": func() Handler { return &Enable{} },
+
+		"NAMESPACE": func() Handler { return &Namespace{} },
+		"COMPRESS":  func() Handler { return &Compress{} },
 
 		"CHECK":   func() Handler { return &Check{} },
 		"CLOSE":   func() Handler { return &Close{} },
@@ -198,6 +285,7 @@ func New(bkd backend.Backend) *Server {
 		"FETCH":   func() Handler { return &Fetch{} },
 		"STORE":   func() Handler { return &Store{} },
 		"COPY":    func() Handler { return &Copy{} },
+		"MOVE":    func() Handler { return &Move{} },
 		"UID":     func() Handler { return &Uid{} },
 	}
 
@@ -206,6 +294,10 @@ func New(bkd backend.Backend) *Server {
 
 // Serve accepts incoming connections on the Listener l.
 func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, defaultListenerConfig)
+}
+
+func (s *Server) serve(l net.Listener, cfg *ListenerConfig) error {
 	s.locker.Lock()
 	s.listeners[l] = struct{}{}
 	s.locker.Unlock()
@@ -217,11 +309,7 @@ func (s *Server) Serve(l net.Listener) error {
 		delete(s.listeners, l)
 	}()
 
-	updater, ok := s.Backend.(backend.BackendUpdater)
-	if ok {
-		s.Updates = updater.Updates()
-		go s.listenUpdates()
-	}
+	s.updatesOnce.Do(s.startUpdates)
 
 	for {
 		c, err := l.Accept()
@@ -229,7 +317,7 @@ func (s *Server) Serve(l net.Listener) error {
 			return err
 		}
 
-		var conn Conn = newConn(s, c)
+		var conn Conn = newConn(s, c, cfg)
 		for _, ext := range s.extensions {
 			if ext, ok := ext.(ConnExtension); ok {
 				conn = ext.NewConn(conn)
@@ -278,9 +366,9 @@ func (s *Server) ListenAndServeTLS() error {
 
 func (s *Server) serveConn(conn Conn) error {
 	//Check rate limit
-	if s.RateLimiter != nil {
+	if rateLimiter := s.rateLimiter(conn.ListenerConfig()); rateLimiter != nil {
 		remoteIPStr, _, _ := net.SplitHostPort(conn.Info().RemoteAddr.String())
-		limited, result, _ := s.RateLimiter.RateLimit(remoteIPStr, 1)
+		limited, result, _ := rateLimiter.RateLimit(remoteIPStr, 1)
 		//exceeds the rate limit
 		if limited {
 			msg := fmt.Sprintf("Too many IMAP sessions for this host, please retry after %d seconds", result.RetryAfter/time.Second)
@@ -294,10 +382,18 @@ func (s *Server) serveConn(conn Conn) error {
 		}
 	}
 
+	conn.debugCapture().ip = loginIP(conn)
+
 	s.locker.Lock()
 	s.conns[conn] = struct{}{}
+	s.updateDebugTarget(conn.debugCapture())
 	s.locker.Unlock()
 
+	if s.Metrics != nil {
+		s.Metrics.ConnectionOpened()
+		defer s.Metrics.ConnectionClosed()
+	}
+
 	defer func() {
 		s.locker.Lock()
 		defer s.locker.Unlock()
@@ -308,6 +404,56 @@ func (s *Server) serveConn(conn Conn) error {
 	return conn.serve(conn)
 }
 
+func (s *Server) startUpdates() {
+	router, _ := s.Backend.(*TenantRouter)
+
+	updater, ok := s.Backend.(backend.BackendUpdater)
+	if s.UpdateBus != nil {
+		if ok {
+			go s.publishUpdates(updater.Updates(), "")
+		}
+		// Updates of tenants are tagged with their domain, so that they are
+		// only sent to the tenant's connections by all instances
+		if router != nil {
+			for _, t := range router.Tenants() {
+				if updater, ok := t.Backend.(backend.BackendUpdater); ok {
+					go s.publishUpdates(updater.Updates(), t.Domain())
+				}
+			}
+		}
+		s.Updates = s.UpdateBus.Updates()
+		go s.listenUpdates()
+		return
+	}
+
+	if ok {
+		s.Updates = updater.Updates()
+		go s.listenUpdates()
+	}
+
+	// Updates of tenants are only sent to their connections
+	if router != nil {
+		for _, t := range router.Tenants() {
+			if updater, ok := t.Backend.(backend.BackendUpdater); ok {
+				go s.listenTenantUpdates(t, updater.Updates())
+			}
+		}
+	}
+}
+
+// publishUpdates forwards backend updates to the update bus. If domain isn't
+// empty, updates are tagged with the domain of their tenant.
+func (s *Server) publishUpdates(updates <-chan backend.Update, domain string) {
+	for update := range updates {
+		if domain != "" {
+			update = backend.WithDomain(update, domain)
+		}
+		if err := s.UpdateBus.Publish(update); err != nil {
+			s.ErrorLog.Println("cannot publish update:", err)
+		}
+	}
+}
+
 // Command gets a command handler factory for the provided command name.
 func (s *Server) Command(name string) HandlerFactory {
 	// Extensions can override builtin commands
@@ -324,83 +470,105 @@ func (s *Server) listenUpdates() {
 	for {
 		update := <-s.Updates
 
-		var res imap.WriterTo
-		switch update := update.(type) {
-		case *backend.StatusUpdate:
-			res = update.StatusResp
-		case *backend.MailboxUpdate:
-			res = &responses.Select{Mailbox: update.MailboxStatus}
-		case *backend.MailboxInfoUpdate:
-			ch := make(chan *imap.MailboxInfo, 1)
-			ch <- update.MailboxInfo
-			close(ch)
-
-			res = &responses.List{Mailboxes: ch}
-		case *backend.MessageUpdate:
-			ch := make(chan *imap.Message, 1)
-			ch <- update.Message
-			close(ch)
-
-			res = &responses.Fetch{Messages: ch}
-		case *backend.ExpungeUpdate:
-			ch := make(chan uint32, 1)
-			ch <- update.SeqNum
-			close(ch)
-
-			res = &responses.Expunge{SeqNums: ch}
-		default:
-			s.ErrorLog.Printf("unhandled update: %T\n", update)
+		// Updates tagged with a domain are only sent to the tenant's connections
+		var tenant *Tenant
+		if domain := backend.UpdateDomain(update); domain != "" {
+			if router, ok := s.Backend.(*TenantRouter); ok {
+				tenant = router.Tenant(domain)
+			}
+			if tenant == nil {
+				close(update.Done())
+				continue
+			}
 		}
-		if res == nil {
+		s.dispatchUpdate(update, tenant)
+	}
+}
+
+func (s *Server) listenTenantUpdates(t *Tenant, updates <-chan backend.Update) {
+	for update := range updates {
+		s.dispatchUpdate(update, t)
+	}
+}
+
+// dispatchUpdate queues an update for the connections it concerns. If tenant
+// isn't nil, only connections authenticated to the tenant are concerned.
+func (s *Server) dispatchUpdate(update backend.Update, tenant *Tenant) {
+	switch update.(type) {
+	case *backend.StatusUpdate, *backend.MailboxUpdate, *backend.MailboxInfoUpdate,
+		*backend.MessageUpdate, *backend.ExpungeUpdate,
+		*backend.ExpungeUidUpdate, *backend.ExistsUidUpdate:
+	default:
+		s.ErrorLog.Printf("unhandled update: %T\n", update)
+		close(update.Done())
+		return
+	}
+
+	max := s.MaxQueuedUpdates
+	if max <= 0 {
+		max = DefaultMaxQueuedUpdates
+	}
+
+	// Done is closed once the update has been written to all connections
+	delivery := newUpdateDelivery(update)
+	defer delivery.release()
+
+	recipients := 0
+	s.locker.Lock()
+	for conn := range s.conns {
+		session := conn.session()
+
+		if tenant != nil && session.Tenant != tenant {
 			continue
 		}
 
-		sends := make(chan struct{})
-		wait := 0
-		s.locker.Lock()
-		for conn := range s.conns {
-			ctx := conn.Context()
-
-			if update.Username() != "" && (ctx.User == nil || ctx.User.Username() != update.Username()) {
-				continue
-			}
-			if update.Mailbox() != "" && (ctx.Mailbox == nil || ctx.Mailbox.Name() != update.Mailbox()) {
+		if update.Username() != "" && session.Username != update.Username() {
+			continue
+		}
+		if update.Mailbox() != "" && session.Mailbox != update.Mailbox() {
+			continue
+		}
+		if *conn.silent() {
+			// If silent is set, do not send message updates
+			if _, ok := update.(*backend.MessageUpdate); ok {
 				continue
 			}
-			if *conn.silent() {
-				// If silent is set, do not send message updates
-				if _, ok := res.(*responses.Fetch); ok {
-					continue
-				}
-			}
-
-			conn := conn // Copy conn to a local variable
-			go func() {
-				done := make(chan struct{})
-				conn.Context().Responses <- &response{
-					response: res,
-					done:     done,
-				}
-				<-done
-				sends <- struct{}{}
-			}()
+		}
 
-			wait++
+		coalesced, ok, overflowed := conn.updateQueue().push(conn, update, delivery, max)
+		if coalesced {
+			s.queueStats.Coalesced++
 		}
-		s.locker.Unlock()
+		if ok {
+			recipients++
+		}
+		if overflowed {
+			s.queueStats.Overflows++
+			s.ErrorLog.Printf("update queue full for %v, closing connection", session.Info.RemoteAddr)
+			go closeWithBye(conn, "Too many pending updates, closing connection")
+		}
+	}
+	s.locker.Unlock()
 
-		if wait > 0 {
-			go func() {
-				for done := 0; done < wait; done++ {
-					<-sends
-				}
+	if s.Metrics != nil {
+		s.Metrics.UpdateFannedOut(recipients)
+	}
+}
 
-				close(update.Done())
-			}()
-		} else {
-			close(update.Done())
+// UpdateQueueStats returns statistics about the update queues of connections.
+func (s *Server) UpdateQueueStats() UpdateQueueStats {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	stats := s.queueStats
+	for conn := range s.conns {
+		n := conn.updateQueue().len()
+		stats.Queued += n
+		if n > stats.MaxDepth {
+			stats.MaxDepth = n
 		}
 	}
+	return stats
 }
 
 // ForEachConn iterates through all opened connections.
@@ -412,6 +580,81 @@ func (s *Server) ForEachConn(f func(Conn)) {
 	}
 }
 
+// DefaultShutdownReason is the default text of the BYE response sent by
+// Shutdown.
+const DefaultShutdownReason = "Server shutting down"
+
+// How often Shutdown checks whether connections are closed.
+const shutdownPollInterval = 50 * time.Millisecond
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.shutdown) != 0
+}
+
+func (s *Server) shutdownReason() string {
+	if s.ShutdownReason != "" {
+		return s.ShutdownReason
+	}
+	return DefaultShutdownReason
+}
+
+// Shutdown gracefully shuts down the server. It stops listening, refuses new
+// logins and sends a BYE response to idle connections, and to connections
+// waiting for the client in a long-running command such as IDLE. Connections
+// receiving or handling another command are sent a BYE response once the
+// command has completed. Shutdown then waits for all connections to be closed.
+//
+// If ctx expires first, remaining connections are closed, and ctx's error is
+// returned. Shutdown returns the number of connections closed this way.
+// Backend users are logged out in both cases.
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	atomic.StoreInt32(&s.shutdown, 1)
+
+	s.locker.Lock()
+	s.draining = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	byes := make(map[Conn]bool)
+	for conn := range s.conns {
+		if !conn.activity().busy() {
+			byes[conn] = true
+			go closeWithBye(conn, s.shutdownReason())
+		}
+	}
+	s.locker.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.locker.Lock()
+		n := len(s.conns)
+		for conn := range s.conns {
+			// A command may have started waiting for the client, e.g. IDLE
+			if !byes[conn] && conn.activity().waitingClient() {
+				byes[conn] = true
+				go closeWithBye(conn, s.shutdownReason())
+			}
+		}
+		s.locker.Unlock()
+		if n == 0 {
+			return 0, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.locker.Lock()
+			n := len(s.conns)
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.locker.Unlock()
+			return n, ctx.Err()
+		}
+	}
+}
+
 // Stops listening and closes all current connections.
 func (s *Server) Close() error {
 	s.locker.Lock()
@@ -428,6 +671,31 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// login authenticates a user with a password, either with the server's
+// Authenticator or with Backend.Login.
+func (s *Server) login(conn Conn, username, password string) (backend.User, error) {
+	if policy := loginPolicy(conn); policy != nil {
+		if err := policy.checkAccount(conn, username); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Authenticator == nil {
+		return backend.BackendWithContext(s.Backend).LoginContext(conn.Context().Ctx, conn, username, password)
+	}
+
+	be, ok := s.Backend.(backend.UserGetter)
+	if !ok {
+		return nil, errors.New("Backend doesn't support user lookup")
+	}
+
+	name, err := s.Authenticator.Authenticate(conn, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return be.GetUser(conn, name)
+}
+
 // Enable some IMAP extensions on this server.
 // Wiki entry: https://github.com/emersion/go-imap/wiki/Using-extensions
 func (s *Server) Enable(extensions ...Extension) {
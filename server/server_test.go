@@ -2,19 +2,43 @@ package server_test
 
 import (
 	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
 	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/backend/updatebus"
 	"github.com/linanh/go-imap/server"
 )
 
 // Extnesions that are always advertised by go-imap server.
-const builtinExtensions = "LITERAL+ SASL-IR CHILDREN"
+const builtinExtensions = "LITERAL+ SASL-IR CHILDREN ID"
+
+// extBackend is a memory backend supporting additional extensions.
+type extBackend struct {
+	*memory.Backend
+	exts []string
+}
+
+func (be *extBackend) SupportedExtensions() []string {
+	return be.exts
+}
 
 func testServer(t *testing.T) (s *server.Server, conn net.Conn) {
-	bkd := memory.New()
+	return testServerWithBackend(t, memory.New())
+}
+
+func testServerWithBackend(t *testing.T, bkd backend.Backend) (s *server.Server, conn net.Conn) {
+	return testServerWithConfig(t, bkd, nil)
+}
 
+func testServerWithConfig(t *testing.T, bkd backend.Backend, configure func(s *server.Server)) (s *server.Server, conn net.Conn) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal("Cannot listen:", err)
@@ -22,6 +46,9 @@ func testServer(t *testing.T) (s *server.Server, conn net.Conn) {
 
 	s = server.New(bkd)
 	s.AllowInsecureAuth = true
+	if configure != nil {
+		configure(s)
+	}
 
 	go s.Serve(l)
 
@@ -33,6 +60,33 @@ func testServer(t *testing.T) (s *server.Server, conn net.Conn) {
 	return
 }
 
+// login reads the greeting of a connection and logs in.
+func login(t *testing.T, c net.Conn, username string) *bufio.Scanner {
+	t.Helper()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN "+username+" password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		c.Close()
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+	return scanner
+}
+
+// dialLoggedIn connects to a server and logs in.
+func dialLoggedIn(t *testing.T, addr, username string) (net.Conn, *bufio.Scanner) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	return c, login(t, c, username)
+}
+
 func TestServer_greeting(t *testing.T) {
 	s, conn := testServer(t)
 	defer s.Close()
@@ -47,3 +101,86 @@ func TestServer_greeting(t *testing.T) {
 		t.Fatal("Bad greeting:", greeting)
 	}
 }
+
+func TestServer_UpdateBus(t *testing.T) {
+	bus := updatebus.NewLocal()
+	defer bus.Close()
+
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.UpdateBus = bus
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+
+	update := &backend.StatusUpdate{
+		Update: backend.NewUpdate("username", ""),
+		StatusResp: &imap.StatusResp{
+			Type: imap.StatusRespOk,
+			Code: imap.CodeAlert,
+			Info: "Published on another node",
+		},
+	}
+	done := update.Done()
+	if err := bus.Publish(update); err != nil {
+		t.Fatal("Cannot publish update:", err)
+	}
+	<-done
+
+	scanner.Scan()
+	if scanner.Text() != "* OK [ALERT] Published on another node" {
+		t.Fatal("Invalid update:", scanner.Text())
+	}
+}
+
+func TestServer_UpdateBusLocalOnly(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := updatebus.NewHub()
+	go hub.Serve(l)
+	defer hub.Close()
+
+	bus, err := updatebus.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+
+	bkd := &updatesBackend{
+		Backend: memory.New(),
+		updates: make(chan backend.Update),
+	}
+	s, c := testServerWithConfig(t, bkd, func(s *server.Server) {
+		s.UpdateBus = bus
+		s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := login(t, c, "username")
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "a002 ") {
+	}
+
+	// Sequence numbers cannot be relayed, but local clients receive the update
+	update := &backend.ExpungeUpdate{
+		Update: backend.NewUpdate("username", "INBOX"),
+		SeqNum: 1,
+	}
+	done := update.Done()
+	bkd.updates <- update
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Update not delivered to local clients")
+	}
+
+	io.WriteString(c, "a003 NOOP\r\n")
+	expectLines(t, scanner, "* 1 EXPUNGE")
+}
@@ -0,0 +1,148 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/server"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.ShutdownReason = "Maintenance"
+	})
+	defer s.Close()
+	defer c.Close()
+	scanner := login(t, c, "username")
+
+	// This connection is receiving a literal when shutting down
+	c2, scanner2 := dialLoggedIn(t, c.RemoteAddr().String(), "username")
+	defer c2.Close()
+	io.WriteString(c2, "b002 APPEND INBOX {11}\r\n")
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "+ ") {
+		t.Fatal("Invalid continuation request:", scanner2.Text())
+	}
+
+	done := make(chan error, 1)
+	var forced int
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var err error
+		forced, err = s.Shutdown(ctx)
+		done <- err
+	}()
+
+	// The idle connection is closed right away
+	expectLines(t, scanner, "* BYE Maintenance")
+	if scanner.Scan() {
+		t.Fatalf("Expected the idle connection to be closed, got %q", scanner.Text())
+	}
+
+	// The other connection completes its command
+	io.WriteString(c2, "Hello World\r\n")
+	for scanner2.Scan() && !strings.HasPrefix(scanner2.Text(), "b002 ") {
+	}
+	if !strings.HasPrefix(scanner2.Text(), "b002 OK ") {
+		t.Fatal("Invalid status response:", scanner2.Text())
+	}
+	expectLines(t, scanner2, "* BYE Maintenance")
+
+	if err := <-done; err != nil {
+		t.Fatal("Shutdown failed:", err)
+	}
+	if forced != 0 {
+		t.Errorf("Expected no connection to be forcibly closed, got %v", forced)
+	}
+
+	if _, err := net.Dial("tcp", c.RemoteAddr().String()); err == nil {
+		t.Error("Expected the server to stop listening")
+	}
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	s, c := testServer(t)
+	defer s.Close()
+	defer c.Close()
+	scanner := login(t, c, "username")
+
+	// The literal is never sent
+	io.WriteString(c, "a002 APPEND INBOX {11}\r\n")
+	scanner.Scan()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	forced, err := s.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected the context to expire, got %v", err)
+	}
+	if forced != 1 {
+		t.Errorf("Expected 1 connection to be forcibly closed, got %v", forced)
+	}
+}
+
+// idleExtension implements a minimal IDLE command.
+type idleExtension struct{}
+
+func (idleExtension) Capabilities(c server.Conn) []string {
+	return []string{"IDLE"}
+}
+
+func (idleExtension) Command(name string) server.HandlerFactory {
+	if name != "IDLE" {
+		return nil
+	}
+	return func() server.Handler { return &idleHandler{} }
+}
+
+type idleHandler struct{}
+
+func (h *idleHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+func (h *idleHandler) Handle(conn server.Conn) error {
+	if err := conn.WriteResp(&imap.ContinuationReq{Info: "idling"}); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan()
+	return scanner.Err()
+}
+
+func TestServer_ShutdownIdle(t *testing.T) {
+	s, c := testServerWithConfig(t, memory.New(), func(s *server.Server) {
+		s.Enable(idleExtension{})
+	})
+	defer s.Close()
+	defer c.Close()
+	scanner := login(t, c, "username")
+
+	io.WriteString(c, "a002 IDLE\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "+ ") {
+		t.Fatal("Invalid continuation request:", scanner.Text())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Shutdown(ctx)
+		done <- err
+	}()
+
+	// The client doesn't send DONE
+	expectLines(t, scanner, "* BYE Server shutting down")
+	if err := <-done; err != nil {
+		t.Fatal("Shutdown failed:", err)
+	}
+}
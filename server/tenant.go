@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+	"github.com/throttled/throttled/v2"
+)
+
+// A Tenant is a virtual domain hosted by a server, with its own backend.
+type Tenant struct {
+	// The tenant's backend. Users are authenticated with their full login,
+	// e.g. "user@example.org". If it implements backend.BackendUpdater, its
+	// updates are only sent to the tenant's connections. If Server.UpdateBus is
+	// set, they are published to the bus, tagged with the tenant's domain.
+	Backend backend.Backend
+	// Capabilities not advertised to the tenant's clients, see
+	// ListenerConfig.DisabledCapabilities.
+	DisabledCapabilities []string
+	// Limits the rate of logins per IP address to this tenant. If nil, logins
+	// aren't limited.
+	RateLimiter throttled.RateLimiter
+
+	domain string
+}
+
+// Domain returns the tenant's domain.
+func (t *Tenant) Domain() string {
+	return t.domain
+}
+
+// TenantRouter is a backend.Backend serving several virtual domains from one
+// Server, each with its own Tenant. Use it as the server's backend.
+//
+// The tenant of a connection is selected from, in order of precedence, the
+// listener's ListenerConfig.Tenant, the server name requested with TLS SNI, and
+// the domain of the login, e.g. "example.org" for "user@example.org". Logins
+// for another domain than the one selected by the listener or by SNI are
+// rejected, so that tenants are isolated. A server name matches a tenant if
+// it is the tenant's domain or one of its subdomains, e.g.
+// "imap.example.org".
+//
+// SCRAM and EXTERNAL authentication are routed like logins, and are only
+// advertised if the tenant's backend implements backend.SCRAMBackend or
+// backend.ExternalBackend. Before the tenant of a connection is known, they are
+// advertised if at least one tenant supports them.
+//
+// The selected tenant is available in Context.Tenant after authentication.
+// Tenants must not be modified once the server is serving.
+type TenantRouter struct {
+	tenants map[string]*Tenant
+}
+
+// NewTenantRouter creates a router without any tenant.
+func NewTenantRouter() *TenantRouter {
+	return &TenantRouter{tenants: make(map[string]*Tenant)}
+}
+
+// Add adds a tenant for a domain.
+func (r *TenantRouter) Add(domain string, t *Tenant) {
+	t.domain = strings.ToLower(domain)
+	r.tenants[t.domain] = t
+}
+
+// Tenant returns the tenant of a domain, nil if there is none.
+func (r *TenantRouter) Tenant(domain string) *Tenant {
+	return r.tenants[strings.ToLower(domain)]
+}
+
+// Tenants returns all tenants.
+func (r *TenantRouter) Tenants() []*Tenant {
+	tenants := make([]*Tenant, 0, len(r.tenants))
+	for _, t := range r.tenants {
+		tenants = append(tenants, t)
+	}
+	return tenants
+}
+
+// serverTenant returns the tenant of a server name, matching the domain or one
+// of its parents.
+func (r *TenantRouter) serverTenant(name string) *Tenant {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for name != "" {
+		if t, ok := r.tenants[name]; ok {
+			return t
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return nil
+}
+
+// connTenant returns the tenant selected by a connection's listener or by the
+// server name it has requested, before authentication.
+func (r *TenantRouter) connTenant(conn Conn) *Tenant {
+	if domain := conn.ListenerConfig().Tenant; domain != "" {
+		return r.Tenant(domain)
+	}
+	if name := conn.Info().ServerName; name != "" {
+		return r.serverTenant(name)
+	}
+	return nil
+}
+
+// route returns the tenant of a login, and checks the tenant's rate limit.
+// conn is the value passed to backend methods, which is a Conn for logins
+// handled by the server.
+func (r *TenantRouter) route(conn interface{}, username string) (*Tenant, error) {
+	t, err := r.lookup(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if c, ok := conn.(Conn); ok && t.RateLimiter != nil {
+		limited, result, err := t.RateLimiter.RateLimit(t.domain+"/"+loginIP(c), 1)
+		if err != nil {
+			return nil, err
+		}
+		if limited {
+			return nil, &imap.StatusError{
+				Code: imap.CodeUnavailable,
+				Info: fmt.Sprintf("Too many logins, try again after %d seconds", result.RetryAfter/time.Second),
+			}
+		}
+	}
+	return t, nil
+}
+
+// lookup returns the tenant of a login, without checking its rate limit.
+func (r *TenantRouter) lookup(conn interface{}, username string) (*Tenant, error) {
+	var t *Tenant
+	if c, ok := conn.(Conn); ok {
+		t = c.Context().Tenant
+		if t == nil {
+			t = r.connTenant(c)
+		}
+		if t == nil && c.ListenerConfig().Tenant != "" {
+			// The listener's tenant doesn't exist
+			return nil, backend.ErrInvalidCredentials
+		}
+	}
+
+	if i := strings.LastIndexByte(username, '@'); i >= 0 {
+		domainTenant := r.Tenant(username[i+1:])
+		if domainTenant == nil || (t != nil && t != domainTenant) {
+			return nil, backend.ErrInvalidCredentials
+		}
+		t = domainTenant
+	}
+	if t == nil {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return t, nil
+}
+
+// setTenant records the tenant of an authenticated connection.
+func setTenant(conn interface{}, t *Tenant) {
+	if c, ok := conn.(Conn); ok {
+		c.Context().Tenant = t
+	}
+}
+
+func (r *TenantRouter) Login(conn interface{}, username, password string) (backend.User, error) {
+	return r.LoginContext(context.Background(), conn, username, password)
+}
+
+func (r *TenantRouter) LoginContext(ctx context.Context, conn interface{}, username, password string) (backend.User, error) {
+	t, err := r.route(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	user, err := backend.BackendWithContext(t.Backend).LoginContext(ctx, conn, username, password)
+	if err != nil {
+		return nil, err
+	}
+	setTenant(conn, t)
+	return user, nil
+}
+
+// GetUser implements backend.UserGetter, for logins checked by
+// Server.Authenticator or by OAuth verifiers. The tenant's backend must
+// implement backend.UserGetter.
+func (r *TenantRouter) GetUser(conn interface{}, username string) (backend.User, error) {
+	t, err := r.route(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	return r.getUser(conn, t, username)
+}
+
+func (r *TenantRouter) getUser(conn interface{}, t *Tenant, username string) (backend.User, error) {
+	be, ok := t.Backend.(backend.UserGetter)
+	if !ok {
+		return nil, fmt.Errorf("Backend of tenant %v doesn't support user lookup", t.domain)
+	}
+	user, err := be.GetUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	setTenant(conn, t)
+	return user, nil
+}
+
+// SCRAMCredentials implements backend.SCRAMBackend. The tenant's backend must
+// implement backend.SCRAMBackend.
+func (r *TenantRouter) SCRAMCredentials(conn interface{}, username, mechanism string) (*backend.SCRAMCredentials, error) {
+	t, err := r.route(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	be, ok := t.Backend.(backend.SCRAMBackend)
+	if !ok {
+		return nil, fmt.Errorf("Backend of tenant %v doesn't support SCRAM", t.domain)
+	}
+	return be.SCRAMCredentials(conn, username, mechanism)
+}
+
+// scramGetUser returns the user of a SCRAM login, once the client has proved
+// its identity. The login has already been rate limited by SCRAMCredentials.
+func (r *TenantRouter) scramGetUser(conn interface{}, username string) (backend.User, error) {
+	t, err := r.lookup(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	return r.getUser(conn, t, username)
+}
+
+// LoginExternal implements backend.ExternalBackend. The tenant is selected by
+// the identity requested by the client, or by the connection if the identity
+// is empty. The tenant's backend must implement backend.ExternalBackend.
+func (r *TenantRouter) LoginExternal(conn interface{}, cert *x509.Certificate, identity string) (backend.User, error) {
+	t, err := r.route(conn, identity)
+	if err != nil {
+		return nil, err
+	}
+	be, ok := t.Backend.(backend.ExternalBackend)
+	if !ok {
+		return nil, fmt.Errorf("Backend of tenant %v doesn't support EXTERNAL", t.domain)
+	}
+	user, err := be.LoginExternal(conn, cert, identity)
+	if err != nil {
+		return nil, err
+	}
+	setTenant(conn, t)
+	return user, nil
+}
+
+// mechanismSupported checks if a tenant's backend can serve a SASL mechanism.
+func (t *Tenant) mechanismSupported(name string) bool {
+	switch {
+	case strings.HasPrefix(name, "SCRAM-"):
+		_, ok := t.Backend.(backend.SCRAMBackend)
+		return ok
+	case name == sasl.External:
+		_, ok := t.Backend.(backend.ExternalBackend)
+		return ok
+	}
+	return true
+}
+
+// mechanismSupported checks if the tenant of a connection can serve a SASL
+// mechanism. Before the tenant is known, e.g. if it is selected by the domain
+// of the login, mechanisms supported by at least one tenant are accepted.
+func (r *TenantRouter) mechanismSupported(conn Conn, name string) bool {
+	if t := connTenant(conn); t != nil {
+		return t.mechanismSupported(name)
+	}
+	if conn.ListenerConfig().Tenant != "" {
+		// The listener's tenant doesn't exist
+		return false
+	}
+	for _, t := range r.tenants {
+		if t.mechanismSupported(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportedExtensions returns the extensions supported by all tenants. Once a
+// client has authenticated, the extensions of its tenant are used.
+func (r *TenantRouter) SupportedExtensions() []string {
+	var exts []string
+	first := true
+	for _, t := range r.tenants {
+		tenantExts := t.Backend.SupportedExtensions()
+		if first {
+			exts = append(exts, tenantExts...)
+			first = false
+			continue
+		}
+
+		supported := make(map[string]bool, len(tenantExts))
+		for _, ext := range tenantExts {
+			supported[ext] = true
+		}
+		common := exts[:0]
+		for _, ext := range exts {
+			if supported[ext] {
+				common = append(common, ext)
+			}
+		}
+		exts = common
+	}
+	return exts
+}
+
+// connTenant returns the tenant of a connection: the tenant the client has
+// authenticated to, or the tenant selected by its listener or server name. It
+// returns nil if the server's backend isn't a TenantRouter, or if the tenant
+// is unknown.
+func connTenant(conn Conn) *Tenant {
+	if t := conn.Context().Tenant; t != nil {
+		return t
+	}
+	if r, ok := conn.Server().Backend.(*TenantRouter); ok {
+		return r.connTenant(conn)
+	}
+	return nil
+}
+
+// connBackend returns the backend of a connection's tenant, or the server's
+// backend.
+func connBackend(conn Conn) backend.Backend {
+	if t := conn.Context().Tenant; t != nil {
+		return t.Backend
+	}
+	return conn.Server().Backend
+}
+
+// supportsExtension checks if the backend of a connection supports an
+// extension.
+func supportsExtension(conn Conn, ext string) bool {
+	if t := conn.Context().Tenant; t != nil {
+		for _, tenantExt := range t.Backend.SupportedExtensions() {
+			if tenantExt == ext {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := conn.Server().backendExts[ext]
+	return ok
+}
@@ -0,0 +1,340 @@
+package server_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/backend/updatebus"
+	"github.com/linanh/go-imap/server"
+	"github.com/throttled/throttled/v2"
+)
+
+// tenantBackend is a memory backend for a domain, sending updates.
+type tenantBackend struct {
+	updatesBackend
+	exts []string
+}
+
+func newTenantBackend(exts ...string) *tenantBackend {
+	return &tenantBackend{
+		updatesBackend: updatesBackend{memory.New(), make(chan backend.Update)},
+		exts:           exts,
+	}
+}
+
+func (be *tenantBackend) Login(conn interface{}, username, password string) (backend.User, error) {
+	if i := strings.IndexByte(username, '@'); i >= 0 {
+		username = username[:i]
+	}
+	return be.Backend.Login(conn, username, password)
+}
+
+func (be *tenantBackend) SupportedExtensions() []string {
+	return be.exts
+}
+
+func testTenantRouter() (*server.TenantRouter, *tenantBackend, *tenantBackend) {
+	org, com := newTenantBackend("UIDPLUS"), newTenantBackend()
+
+	router := server.NewTenantRouter()
+	router.Add("example.org", &server.Tenant{Backend: org})
+	router.Add("Example.com", &server.Tenant{
+		Backend:              com,
+		DisabledCapabilities: []string{"ID"},
+	})
+	return router, org, com
+}
+
+func TestTenantRouter_Login(t *testing.T) {
+	router, _, _ := testTenantRouter()
+	s, c := testServerWithBackend(t, router)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	for _, username := range []string{"username", "username@example.net"} {
+		io.WriteString(c, "a001 LOGIN "+username+" password\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+			t.Fatalf("Bad status response for %v: %v", username, scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "a002 LOGIN username@EXAMPLE.com password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	sessions := s.Sessions()
+	if len(sessions) != 1 || sessions[0].Tenant != "example.com" {
+		t.Fatalf("Invalid sessions: %+v", sessions)
+	}
+	if ctx := sessions[0].Conn.Context(); ctx.Tenant != router.Tenant("example.com") {
+		t.Error("Invalid tenant in context")
+	}
+
+	// The tenant's capabilities are advertised
+	io.WriteString(c, "a003 CAPABILITY\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* CAPABILITY IMAP4rev1 LITERAL+ SASL-IR CHILDREN" {
+		t.Fatal("Bad capabilities:", scanner.Text())
+	}
+	expectTagged(t, scanner, "a003")
+
+	io.WriteString(c, "a004 ID NIL\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a004 BAD ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestTenantRouter_Listener(t *testing.T) {
+	router, _, _ := testTenantRouter()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	s := server.New(router)
+	defer s.Close()
+	go s.ServeListener(l, &server.ListenerConfig{
+		AuthPolicy: server.AuthAllowInsecure,
+		Tenant:     "example.org",
+	})
+
+	c, scanner := dialLoggedIn(t, l.Addr().String(), "username")
+	defer c.Close()
+
+	// Logins for other tenants are rejected
+	c2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan() // Greeting
+	io.WriteString(c2, "a001 LOGIN username@example.com password\r\n")
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner2.Text())
+	}
+
+	io.WriteString(c, "a002 CAPABILITY\r\n")
+	scanner.Scan()
+	if scanner.Text() != "* CAPABILITY IMAP4rev1 "+builtinExtensions+" UIDPLUS" {
+		t.Fatal("Bad capabilities:", scanner.Text())
+	}
+}
+
+func TestTenantRouter_Updates(t *testing.T) {
+	router, org, _ := testTenantRouter()
+	s, c := testServerWithBackend(t, router)
+	defer s.Close()
+	addr := c.RemoteAddr().String()
+	c.Close()
+
+	// Both tenants have a user with the same name
+	cOrg, scannerOrg := dialLoggedIn(t, addr, "username@example.org")
+	defer cOrg.Close()
+	cCom, scannerCom := dialLoggedIn(t, addr, "username@example.com")
+	defer cCom.Close()
+
+	sendUpdate(s, &org.updatesBackend, &backend.StatusUpdate{
+		Update:     backend.NewUpdate("username", ""),
+		StatusResp: &imap.StatusResp{Type: imap.StatusRespOk, Code: imap.CodeAlert, Info: "Hello"},
+	})
+
+	scannerOrg.Scan()
+	if scannerOrg.Text() != "* OK [ALERT] Hello" {
+		t.Fatal("Expected update, got:", scannerOrg.Text())
+	}
+
+	io.WriteString(cCom, "a002 NOOP\r\n")
+	scannerCom.Scan()
+	if !strings.HasPrefix(scannerCom.Text(), "a002 OK ") {
+		t.Fatal("Unexpected response:", scannerCom.Text())
+	}
+}
+
+func TestTenantRouter_UpdateBus(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := updatebus.NewHub()
+	go hub.Serve(l)
+	defer hub.Close()
+
+	bus, err := updatebus.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	// Another server instance
+	other, err := updatebus.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	router, org, _ := testTenantRouter()
+	s, c := testServerWithConfig(t, router, func(s *server.Server) {
+		s.UpdateBus = bus
+	})
+	defer s.Close()
+	addr := c.RemoteAddr().String()
+	c.Close()
+
+	// Both tenants have a user with the same name
+	cOrg, scannerOrg := dialLoggedIn(t, addr, "username@example.org")
+	defer cOrg.Close()
+	cCom, scannerCom := dialLoggedIn(t, addr, "username@example.com")
+	defer cCom.Close()
+
+	// Updates of the tenant's backend are published to the bus
+	sendUpdate(s, &org.updatesBackend, &backend.StatusUpdate{
+		Update:     backend.NewUpdate("username", ""),
+		StatusResp: &imap.StatusResp{Type: imap.StatusRespOk, Code: imap.CodeAlert, Info: "Hello"},
+	})
+	expectLines(t, scannerOrg, "* OK [ALERT] Hello")
+
+	// Updates received from other instances are only sent to the tenant
+	update := backend.WithDomain(&backend.StatusUpdate{
+		Update:     backend.NewUpdate("username", ""),
+		StatusResp: &imap.StatusResp{Type: imap.StatusRespOk, Code: imap.CodeAlert, Info: "Hello again"},
+	}, "example.org")
+	go func() {
+		<-other.Updates()
+	}()
+	if err := other.Publish(update); err != nil {
+		t.Fatal("Cannot publish update:", err)
+	}
+	expectLines(t, scannerOrg, "* OK [ALERT] Hello again")
+
+	io.WriteString(cCom, "a002 NOOP\r\n")
+	scannerCom.Scan()
+	if !strings.HasPrefix(scannerCom.Text(), "a002 OK ") {
+		t.Fatal("Unexpected response:", scannerCom.Text())
+	}
+}
+
+// countRateLimiter limits each key to a number of requests.
+type countRateLimiter struct {
+	limit int
+	keys  map[string]int
+}
+
+func (l *countRateLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	l.keys[key] += quantity
+	limited := l.keys[key] > l.limit
+	return limited, throttled.RateLimitResult{Limit: l.limit, RetryAfter: time.Minute}, nil
+}
+
+func TestTenantRouter_RateLimiter(t *testing.T) {
+	limiter := &countRateLimiter{limit: 1, keys: make(map[string]int)}
+	router := server.NewTenantRouter()
+	router.Add("example.org", &server.Tenant{
+		Backend:     newTenantBackend(),
+		RateLimiter: limiter,
+	})
+
+	s, c := testServerWithBackend(t, router)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username@example.org invalid\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO [AUTHENTICATIONFAILED] ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a002 LOGIN username@example.org password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 NO [UNAVAILABLE] ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	if limiter.keys["example.org/127.0.0.1"] != 2 {
+		t.Errorf("Invalid rate limiter keys: %v", limiter.keys)
+	}
+}
+
+func TestTenantRouter_SCRAM(t *testing.T) {
+	limiter := &countRateLimiter{limit: 1, keys: make(map[string]int)}
+	router := server.NewTenantRouter()
+	router.Add("example.org", &server.Tenant{
+		Backend:     &scramBackend{memory.New()},
+		RateLimiter: limiter,
+	})
+	router.Add("example.com", &server.Tenant{Backend: newTenantBackend()})
+
+	s := server.New(router)
+	defer s.Close()
+
+	dial := func(tenant string) (net.Conn, *bufio.Scanner) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("Cannot listen:", err)
+		}
+		go s.ServeListener(l, &server.ListenerConfig{
+			AuthPolicy: server.AuthAllowInsecure,
+			Tenant:     tenant,
+		})
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("Cannot connect to server:", err)
+		}
+		scanner := bufio.NewScanner(c)
+		scanner.Scan() // Greeting
+		return c, scanner
+	}
+
+	// SCRAM isn't advertised to clients of a tenant which doesn't support it
+	c, scanner := dial("example.com")
+	defer c.Close()
+	if strings.Contains(scanner.Text(), "AUTH=SCRAM-") {
+		t.Fatal("SCRAM advertised for a tenant without SCRAM support:", scanner.Text())
+	}
+
+	c, scanner = dial("example.org")
+	defer c.Close()
+	if !strings.Contains(scanner.Text(), " AUTH=SCRAM-SHA-256") {
+		t.Fatal("SCRAM-SHA-256 not advertised:", scanner.Text())
+	}
+
+	res := testAuthenticateSCRAM(t, c, scanner, "SCRAM-SHA-256", "n,,", nil)
+	if !strings.HasPrefix(res, "a001 OK ") {
+		t.Fatal("Bad status response:", res)
+	}
+
+	// The login is only counted once
+	if limiter.keys["example.org/127.0.0.1"] != 1 {
+		t.Errorf("Invalid rate limiter keys: %v", limiter.keys)
+	}
+	authenticated := 0
+	for _, session := range s.Sessions() {
+		if session.Username != "" {
+			authenticated++
+			if session.Tenant != "example.org" {
+				t.Errorf("Invalid session: %+v", session)
+			}
+		}
+	}
+	if authenticated != 1 {
+		t.Errorf("Expected 1 authenticated session, got %v", authenticated)
+	}
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/responses"
+)
+
+// DefaultMaxQueuedUpdates is the default maximum number of updates queued for
+// a connection.
+const DefaultMaxQueuedUpdates = 1000
+
+// How long to wait for the BYE response when closing a connection.
+const byeTimeout = 5 * time.Second
+
+// UpdateQueueStats contains statistics about the update queues of connections.
+type UpdateQueueStats struct {
+	// The number of updates queued for all connections.
+	Queued int
+	// The largest number of updates queued for a single connection.
+	MaxDepth int
+	// The number of updates merged with an already queued update.
+	Coalesced uint64
+	// The number of connections closed because their queue was full.
+	Overflows uint64
+}
+
+// An updateDelivery tracks the connections a backend update has been queued
+// for. The update's Done channel is closed once it has been written to all of
+// them, or once they have been closed.
+type updateDelivery struct {
+	pending int32 // accessed atomically
+	done    chan struct{}
+}
+
+// newUpdateDelivery creates a delivery for an update, which holds a reference
+// until release is called.
+func newUpdateDelivery(update backend.Update) *updateDelivery {
+	return &updateDelivery{pending: 1, done: update.Done()}
+}
+
+func (d *updateDelivery) add() {
+	atomic.AddInt32(&d.pending, 1)
+}
+
+func (d *updateDelivery) release() {
+	if atomic.AddInt32(&d.pending, -1) == 0 {
+		close(d.done)
+	}
+}
+
+// A queuedUpdate is an update waiting to be written, with the deliveries it
+// completes. An update merged with queued ones completes all of their
+// deliveries.
+type queuedUpdate struct {
+	update     backend.Update
+	deliveries []*updateDelivery
+}
+
+func (qu *queuedUpdate) release() {
+	for _, d := range qu.deliveries {
+		d.release()
+	}
+}
+
+// An updateQueue holds the updates waiting to be written to a connection. A
+// single goroutine writes them, so that a slow client doesn't block other
+// ones.
+type updateQueue struct {
+	locker     sync.Mutex
+	updates    []queuedUpdate
+	running    bool
+	writing    bool
+	overflowed bool
+}
+
+// len returns the number of queued updates, including the one being written.
+func (q *updateQueue) len() int {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	n := len(q.updates)
+	if q.writing {
+		n++
+	}
+	return n
+}
+
+// push queues an update. If d isn't nil, it is released once the update has
+// been written. coalesced is true if the update has been merged with a queued
+// one. ok is false if the update has been dropped because the queue has
+// overflowed. overflowed is true if the queue has just overflowed because it
+// already contains max updates, in which case the connection must be closed.
+func (q *updateQueue) push(conn Conn, update backend.Update, d *updateDelivery, max int) (coalesced, ok, overflowed bool) {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	var deliveries []*updateDelivery
+	if d != nil {
+		deliveries = []*updateDelivery{d}
+	}
+
+	if q.overflowed {
+		// The connection is being closed
+		return false, false, false
+	}
+	if i := coalesceUpdate(q.updates, update); i >= 0 {
+		if d != nil {
+			d.add()
+		}
+		q.updates[i].deliveries = append(q.updates[i].deliveries, deliveries...)
+		return true, true, false
+	}
+	if len(q.updates) >= max {
+		// The connection is closed: queued updates won't be written
+		q.overflowed = true
+		for _, qu := range q.updates {
+			qu.release()
+		}
+		q.updates = nil
+		return false, false, true
+	}
+
+	if d != nil {
+		d.add()
+	}
+	q.updates = append(q.updates, queuedUpdate{update, deliveries})
+	if !q.running {
+		q.running = true
+		go q.run(conn)
+	}
+	return false, true, false
+}
+
+func (q *updateQueue) run(conn Conn) {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	for len(q.updates) > 0 && !q.overflowed {
+		qu := q.updates[0]
+		q.updates[0] = queuedUpdate{}
+		q.updates = q.updates[1:]
+		q.writing = true
+		q.locker.Unlock()
+
+		writeUpdate(conn, qu.update)
+		qu.release()
+
+		q.locker.Lock()
+		q.writing = false
+	}
+	q.running = false
+}
+
+// writeUpdate writes an update to a connection.
+func writeUpdate(conn Conn, update backend.Update) {
+	if view := conn.mailboxView(); update.Mailbox() != "" && view.record(update) {
+		// The view translates sequence numbers and defers expunges
+		view.writeUpdates(conn)
+		return
+	}
+
+	res := updateResponse(update)
+	if res == nil {
+		return
+	}
+
+	ctx := conn.Context()
+	done := make(chan struct{})
+	select {
+	case ctx.Responses <- &response{res, done}:
+		<-done
+	case <-ctx.LoggedOut:
+	}
+}
+
+// updateResponse returns the response for an update, or nil if the update can
+// only be handled by a mailbox view.
+func updateResponse(update backend.Update) imap.WriterTo {
+	switch update := update.(type) {
+	case *backend.StatusUpdate:
+		return update.StatusResp
+	case *backend.MailboxUpdate:
+		return &responses.Select{Mailbox: update.MailboxStatus}
+	case *backend.MailboxInfoUpdate:
+		ch := make(chan *imap.MailboxInfo, 1)
+		ch <- update.MailboxInfo
+		close(ch)
+
+		return &responses.List{Mailboxes: ch}
+	case *backend.MessageUpdate:
+		ch := make(chan *imap.Message, 1)
+		ch <- update.Message
+		close(ch)
+
+		return &responses.Fetch{Messages: ch}
+	case *backend.ExpungeUpdate:
+		ch := make(chan uint32, 1)
+		ch <- update.SeqNum
+		close(ch)
+
+		return &responses.Expunge{SeqNums: ch}
+	}
+	return nil
+}
+
+// coalesceUpdate merges update with a queued update it supersedes: EXISTS
+// updates replace previous ones, and flags updates replace previous ones for
+// the same message. Updates are never merged across an expunge, since it
+// changes sequence numbers. It returns the index of the merged update, or -1.
+func coalesceUpdate(queued []queuedUpdate, update backend.Update) int {
+	for i := len(queued) - 1; i >= 0; i-- {
+		prev := queued[i].update
+		switch prev.(type) {
+		case *backend.ExpungeUpdate, *backend.ExpungeUidUpdate:
+			return -1
+		}
+		if prev.Username() != update.Username() || prev.Mailbox() != update.Mailbox() {
+			continue
+		}
+
+		switch update := update.(type) {
+		case *backend.MailboxUpdate:
+			if prev, ok := prev.(*backend.MailboxUpdate); ok && isExistsUpdate(prev) && isExistsUpdate(update) {
+				queued[i].update = update
+				return i
+			}
+		case *backend.ExistsUidUpdate:
+			if prev, ok := prev.(*backend.ExistsUidUpdate); ok {
+				uids := make([]uint32, 0, len(prev.Uids)+len(update.Uids))
+				uids = append(uids, prev.Uids...)
+				uids = append(uids, update.Uids...)
+				queued[i].update = &backend.ExistsUidUpdate{Update: prev.Update, Uids: uids}
+				return i
+			}
+		case *backend.MessageUpdate:
+			if prev, ok := prev.(*backend.MessageUpdate); ok && isFlagsUpdate(prev) && isFlagsUpdate(update) &&
+				prev.Message.SeqNum == update.Message.SeqNum && prev.Message.Uid == update.Message.Uid {
+				queued[i].update = update
+				return i
+			}
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+// isExistsUpdate checks if a mailbox update only contains the number of
+// messages.
+func isExistsUpdate(update *backend.MailboxUpdate) bool {
+	status := update.MailboxStatus
+	_, ok := status.Items[imap.StatusMessages]
+	return ok && len(status.Items) == 1 && status.Flags == nil && status.PermanentFlags == nil && status.UnseenSeqNum == 0
+}
+
+// isFlagsUpdate checks if a message update only contains flags.
+func isFlagsUpdate(update *backend.MessageUpdate) bool {
+	for item := range update.Message.Items {
+		if item != imap.FetchFlags && item != imap.FetchUid {
+			return false
+		}
+	}
+	return true
+}
+
+// closeWithBye sends a BYE response to a connection, then closes it.
+func closeWithBye(conn Conn, reason string) {
+	ctx := conn.Context()
+	bye := &imap.StatusResp{
+		Type: imap.StatusRespBye,
+		Info: reason,
+	}
+
+	done := make(chan struct{})
+	select {
+	case ctx.Responses <- &response{bye, done}:
+		select {
+		case <-done:
+		case <-time.After(byeTimeout):
+		}
+	case <-ctx.LoggedOut:
+	case <-time.After(byeTimeout):
+	}
+	conn.Close()
+}
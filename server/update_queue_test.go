@@ -0,0 +1,184 @@
+package server_test
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linanh/go-imap"
+	"github.com/linanh/go-imap/backend"
+	"github.com/linanh/go-imap/backend/memory"
+	"github.com/linanh/go-imap/server"
+)
+
+func TestUpdateQueue_CoalesceAndOverflow(t *testing.T) {
+	bkd := &updatesBackend{
+		Backend: memory.New(),
+		updates: make(chan backend.Update),
+	}
+	s, c := testServerWithConfig(t, bkd, func(s *server.Server) {
+		s.MaxQueuedUpdates = 10
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+
+	// Updates aren't written to the stalled client, so their Done channels are
+	// not closed: wait for an update without recipients instead
+	send := func(update backend.Update) {
+		bkd.updates <- update
+
+		flush := &backend.StatusUpdate{
+			Update:     backend.NewUpdate("nobody", ""),
+			StatusResp: &imap.StatusResp{Type: imap.StatusRespOk},
+		}
+		done := flush.Done()
+		bkd.updates <- flush
+		<-done
+	}
+	alert := func() backend.Update {
+		return &backend.StatusUpdate{
+			Update: backend.NewUpdate("username", ""),
+			StatusResp: &imap.StatusResp{
+				Type: imap.StatusRespOk,
+				Code: imap.CodeAlert,
+				Info: strings.Repeat("x", 1024*1024),
+			},
+		}
+	}
+	exists := func(n uint32) backend.Update {
+		status := imap.NewMailboxStatus("INBOX", []imap.StatusItem{imap.StatusMessages})
+		status.Messages = n
+		return &backend.MailboxUpdate{
+			Update:        backend.NewUpdate("username", ""),
+			MailboxStatus: status,
+		}
+	}
+
+	// The client doesn't read anything: once the socket buffers are full,
+	// updates are queued
+	deadline := time.Now().Add(10 * time.Second)
+	var queued int
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("Updates are not queued")
+		}
+		send(alert())
+
+		// Make sure the connection is stalled
+		queued = s.UpdateQueueStats().Queued
+		if queued < 3 {
+			continue
+		}
+		time.Sleep(50 * time.Millisecond)
+		if s.UpdateQueueStats().Queued == queued {
+			break
+		}
+	}
+
+	for i := uint32(1); i <= 5; i++ {
+		send(exists(i))
+	}
+	stats := s.UpdateQueueStats()
+	if stats.Coalesced != 4 {
+		t.Errorf("Expected 4 coalesced updates, got %v", stats.Coalesced)
+	}
+	if stats.Queued != queued+1 {
+		t.Errorf("Expected %v queued updates, got %v", queued+1, stats.Queued)
+	}
+	if stats.MaxDepth != stats.Queued {
+		t.Errorf("Expected max depth to be %v, got %v", stats.Queued, stats.MaxDepth)
+	}
+
+	for s.UpdateQueueStats().Overflows == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Update queue doesn't overflow")
+		}
+		send(alert())
+	}
+	// Only the update being written remains
+	if stats := s.UpdateQueueStats(); stats.Queued > 1 {
+		t.Errorf("Expected queued updates to be dropped after overflow, got %v", stats.Queued)
+	}
+
+	// Further updates are dropped, without another overflow
+	send(alert())
+	if n := s.Alert("username", "Maintenance in 5 minutes"); n != 0 {
+		t.Errorf("Expected the alert to be dropped, sent to %v sessions", n)
+	}
+	if overflows := s.UpdateQueueStats().Overflows; overflows != 1 {
+		t.Errorf("Expected 1 overflow, got %v", overflows)
+	}
+}
+
+func TestUpdateQueue_DoneAfterWrite(t *testing.T) {
+	bkd := &updatesBackend{
+		Backend: memory.New(),
+		updates: make(chan backend.Update),
+	}
+	s, c := testServerWithBackend(t, bkd)
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Buffer(nil, 2*1024*1024)
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+
+	alert := func(info string) *backend.StatusUpdate {
+		return &backend.StatusUpdate{
+			Update: backend.NewUpdate("username", ""),
+			StatusResp: &imap.StatusResp{
+				Type: imap.StatusRespOk,
+				Code: imap.CodeAlert,
+				Info: info,
+			},
+		}
+	}
+
+	// Stall the connection until updates are queued
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("Updates are not queued")
+		}
+		bkd.updates <- alert(strings.Repeat("x", 1024*1024))
+
+		queued := s.UpdateQueueStats().Queued
+		if queued < 2 {
+			continue
+		}
+		time.Sleep(50 * time.Millisecond)
+		if s.UpdateQueueStats().Queued == queued {
+			break
+		}
+	}
+
+	update := alert("Last update")
+	done := update.Done()
+	bkd.updates <- update
+
+	select {
+	case <-done:
+		t.Fatal("Done channel closed before the update is written")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for scanner.Scan() {
+		if scanner.Text() == "* OK [ALERT] Last update" {
+			break
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done channel not closed after the update is written")
+	}
+}
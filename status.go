@@ -57,6 +57,30 @@ const (
 	CodeHighestModseq  StatusRespCode = "HIGHESTMODSEQ"
 )
 
+// Status response codes defined in RFC 5530 section 3.
+const (
+	CodeUnavailable          StatusRespCode = "UNAVAILABLE"
+	CodeAuthenticationFailed StatusRespCode = "AUTHENTICATIONFAILED"
+	CodeAuthorizationFailed  StatusRespCode = "AUTHORIZATIONFAILED"
+	CodeExpired              StatusRespCode = "EXPIRED"
+	CodePrivacyRequired      StatusRespCode = "PRIVACYREQUIRED"
+	CodeContactAdmin         StatusRespCode = "CONTACTADMIN"
+	CodeNoPerm               StatusRespCode = "NOPERM"
+	CodeInUse                StatusRespCode = "INUSE"
+	CodeExpungeIssued        StatusRespCode = "EXPUNGEISSUED"
+	CodeCorruption           StatusRespCode = "CORRUPTION"
+	CodeServerBug            StatusRespCode = "SERVERBUG"
+	CodeClientBug            StatusRespCode = "CLIENTBUG"
+	CodeCannot               StatusRespCode = "CANNOT"
+	CodeLimit                StatusRespCode = "LIMIT"
+	CodeOverQuota            StatusRespCode = "OVERQUOTA"
+	CodeAlreadyExists        StatusRespCode = "ALREADYEXISTS"
+	CodeNonExistent          StatusRespCode = "NONEXISTENT"
+)
+
+// Status response code defined in RFC 4978 section 3.
+const CodeCompressionActive StatusRespCode = "COMPRESSIONACTIVE"
+
 // A status response.
 // See RFC 3501 section 7.1
 type StatusResp struct {
@@ -84,7 +108,7 @@ func (r *StatusResp) Err() error {
 	}
 
 	if r.Type == StatusRespNo || r.Type == StatusRespBad {
-		return errors.New(r.Info)
+		return &StatusError{Type: r.Type, Code: r.Code, Info: r.Info}
 	}
 	return nil
 }
@@ -135,3 +159,52 @@ func (err *ErrStatusResp) Error() string {
 	}
 	return err.Resp.Info
 }
+
+// A StatusError is an error with a response code, e.g. one defined in RFC
+// 5530.
+//
+// A server backend can return a StatusError, possibly wrapped, to have the
+// server reply with the corresponding response code. Clients return a
+// StatusError for NO and BAD responses, which can be inspected with errors.As.
+//
+// Two StatusErrors match with errors.Is if they have the same code, so that
+// errors.Is(err, imap.ErrOverQuota) reports whether err has the OVERQUOTA
+// code.
+type StatusError struct {
+	// The status type, either NO or BAD. If empty, NO is used.
+	Type StatusRespType
+	// The status code.
+	Code StatusRespCode
+	// The human-readable error message.
+	Info string
+}
+
+func (err *StatusError) Error() string {
+	return err.Info
+}
+
+func (err *StatusError) Is(target error) bool {
+	other, ok := target.(*StatusError)
+	return ok && err.Code != "" && err.Code == other.Code
+}
+
+// Errors with a response code defined in RFC 5530 section 3.
+var (
+	ErrUnavailable          = &StatusError{Code: CodeUnavailable, Info: "Temporary failure, try again later"}
+	ErrAuthenticationFailed = &StatusError{Code: CodeAuthenticationFailed, Info: "Authentication failed"}
+	ErrAuthorizationFailed  = &StatusError{Code: CodeAuthorizationFailed, Info: "Authorization failed"}
+	ErrExpired              = &StatusError{Code: CodeExpired, Info: "Credentials have expired"}
+	ErrPrivacyRequired      = &StatusError{Code: CodePrivacyRequired, Info: "Operation not permitted without privacy"}
+	ErrContactAdmin         = &StatusError{Code: CodeContactAdmin, Info: "Please contact your administrator"}
+	ErrNoPerm               = &StatusError{Code: CodeNoPerm, Info: "Permission denied"}
+	ErrInUse                = &StatusError{Code: CodeInUse, Info: "Resource is in use"}
+	ErrExpungeIssued        = &StatusError{Code: CodeExpungeIssued, Info: "Some messages have been expunged"}
+	ErrCorruption           = &StatusError{Code: CodeCorruption, Info: "Corrupted data"}
+	ErrServerBug            = &StatusError{Code: CodeServerBug, Info: "Internal server error"}
+	ErrClientBug            = &StatusError{Code: CodeClientBug, Info: "Client error"}
+	ErrCannot               = &StatusError{Code: CodeCannot, Info: "Operation cannot be performed"}
+	ErrLimit                = &StatusError{Code: CodeLimit, Info: "Limit exceeded"}
+	ErrOverQuota            = &StatusError{Code: CodeOverQuota, Info: "Quota exceeded"}
+	ErrAlreadyExists        = &StatusError{Code: CodeAlreadyExists, Info: "Already exists"}
+	ErrNonExistent          = &StatusError{Code: CodeNonExistent, Info: "Does not exist"}
+)
@@ -2,6 +2,8 @@ package imap_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/linanh/go-imap"
@@ -92,3 +94,29 @@ func TestStatus_Err(t *testing.T) {
 		t.Error("NO status returned incorrect error message:", err)
 	}
 }
+
+func TestStatus_Err_Code(t *testing.T) {
+	status := &imap.StatusResp{Type: imap.StatusRespNo, Code: imap.CodeOverQuota, Info: "Mailbox is full"}
+	err := status.Err()
+
+	var statusErr *imap.StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("Err() = %T, want *imap.StatusError", err)
+	}
+	if statusErr.Type != imap.StatusRespNo || statusErr.Code != imap.CodeOverQuota || statusErr.Info != "Mailbox is full" {
+		t.Errorf("Err() = %+v", statusErr)
+	}
+
+	wrapped := fmt.Errorf("cannot append: %w", err)
+	if !errors.Is(wrapped, imap.ErrOverQuota) {
+		t.Error("errors.Is(err, imap.ErrOverQuota) = false, want true")
+	}
+	if errors.Is(wrapped, imap.ErrLimit) {
+		t.Error("errors.Is(err, imap.ErrLimit) = true, want false")
+	}
+
+	status = &imap.StatusResp{Type: imap.StatusRespNo, Info: "NO!"}
+	if errors.Is(status.Err(), &imap.StatusError{}) {
+		t.Error("Error without code matches an empty StatusError")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 type flusher interface {
@@ -46,12 +47,31 @@ func isAscii(s string) bool {
 	return true
 }
 
+// Check if a string can be sent as a quoted string once UTF-8 is allowed in
+// quoted strings.
+func isQuotableUTF8(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, c := range s {
+		if unicode.IsControl(c) || !strconv.IsPrint(c) {
+			return false
+		}
+	}
+	return true
+}
+
 // An IMAP writer.
 type Writer struct {
 	io.Writer
 
 	AllowAsyncLiterals bool
 
+	// AllowUTF8 permits UTF-8 in quoted strings, as allowed once UTF8=ACCEPT
+	// has been enabled (RFC 6855 section 3). Otherwise 8-bit strings are sent
+	// as literals.
+	AllowUTF8 bool
+
 	continues <-chan bool
 }
 
@@ -78,7 +98,7 @@ func (w *Writer) writeQuoted(s string) error {
 }
 
 func (w *Writer) writeQuotedOrLiteral(s string) error {
-	if !isAscii(s) {
+	if !isAscii(s) && !(w.AllowUTF8 && isQuotableUTF8(s)) {
 		// IMAP doesn't allow 8-bit data outside literals
 		return w.writeLiteral(bytes.NewBufferString(s))
 	}
@@ -178,6 +198,13 @@ func (w *Writer) writeLiteral(l Literal) error {
 	return nil
 }
 
+func (w *Writer) writeLiteral8(l Literal) error {
+	if err := w.writeString(string(literal8Start)); err != nil {
+		return err
+	}
+	return w.writeLiteral(l)
+}
+
 func (w *Writer) writeField(field interface{}) error {
 	if field == nil {
 		return w.writeString(nilAtom)
@@ -192,6 +219,8 @@ func (w *Writer) writeField(field interface{}) error {
 		return w.writeNumber(uint32(field))
 	case uint32:
 		return w.writeNumber(field)
+	case Literal8:
+		return w.writeLiteral8(field.Literal)
 	case Literal:
 		return w.writeLiteral(field)
 	case []interface{}:
@@ -101,6 +101,28 @@ func TestWriter_WriteField_8bitString(t *testing.T) {
 	}
 }
 
+func TestWriter_WriteField_8bitString_AllowUTF8(t *testing.T) {
+	w, b := newWriter()
+	w.AllowUTF8 = true
+
+	if err := w.writeField("☺"); err != nil {
+		t.Error(err)
+	}
+	if b.String() != "\"☺\"" {
+		t.Error("Not the expected quoted string:", b.String())
+	}
+
+	w, b = newWriter()
+	w.AllowUTF8 = true
+
+	if err := w.writeField("☺\n"); err != nil {
+		t.Error(err)
+	}
+	if b.String() != "{4}\r\n☺\n" {
+		t.Error("Not the expected literal:", b.String())
+	}
+}
+
 func TestWriter_WriteField_NilString(t *testing.T) {
 	w, b := newWriter()
 
@@ -202,6 +224,19 @@ func TestWriter_WriteField_Literal(t *testing.T) {
 	}
 }
 
+func TestWriter_WriteField_Literal8(t *testing.T) {
+	w, b := newWriter()
+
+	literal := Literal8{bytes.NewBufferString("hello world")}
+
+	if err := w.writeField(literal); err != nil {
+		t.Error(err)
+	}
+	if b.String() != "~{11}\r\nhello world" {
+		t.Error("Not the expected literal8:", b.String())
+	}
+}
+
 func TestWriter_WriteField_NonSyncLiteral(t *testing.T) {
 	w, b := newWriter()
 	w.AllowAsyncLiterals = true